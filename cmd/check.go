@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+// runCheck scores the fingerprint a request would be sent with and prints the report,
+// it returns the exit status: 1 below the minimum score, 2 for invalid arguments
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: proxy check [flags]")
+		flags.PrintDefaults()
+	}
+
+	setup := flags.String("setup", "", "proxy-tls-setup value: a built in setup or a profile name")
+	ja3 := flags.String("ja3", "", "proxy-tls value, a JA3 token overriding the setup")
+	profilesFile := flags.String("profiles", "", "JSON file with named profiles selectable through -setup")
+	userAgent := flags.String("user-agent", "", "User-Agent of the request")
+	pseudoOrder := flags.String("pseudo-order", "", "HTTP/2 pseudo-header order, e.g. :method,:path,:authority,:scheme")
+	plain := flags.Bool("http", false, "the request goes to an http origin, proxy-protocol: http")
+	downgrade := flags.Bool("downgrade", false, "offer HTTP/1.1 only, as proxy-downgrade does")
+	clientHints := flags.String("client-hints", "fill", "browser headers of the setup: fill, force or off")
+	minScore := flags.Int("min-score", core.DEFAULT_CONSISTENCY_SCORE, "lowest score that passes")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+
+	var headers listFlag
+	flags.Var(&headers, "header", "request header as \"Name: value\" in the order sent, repeatable")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	hints, err := core.ParseClientHintsMode(*clientHints)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid client hints mode:", err)
+		return 2
+	}
+
+	var profiles core.Profiles
+	if *profilesFile != "" {
+		if profiles, err = core.LoadProfiles(*profilesFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Can't load profiles:", err)
+			return 2
+		}
+	}
+
+	req := &http.Request{Header: make(http.Header)}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Fprintf(os.Stderr, "Invalid header %q\n", header)
+			return 2
+		}
+
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		req.HeaderOrder.Add(strings.TrimSpace(name))
+	}
+
+	if *userAgent != "" {
+		req.Header.Set("User-Agent", *userAgent)
+		req.HeaderOrder.Add("user-agent")
+	}
+
+	// Named profiles expand to their JA3 token like proxy-tls-setup does
+	fp := core.Fingerprint{Setup: *setup, JA3: *ja3, Secure: !*plain}
+	if profile := profiles.Lookup(*setup); profile != nil && fp.JA3 == "" {
+		fp.JA3, fp.Spec = profile.JA3, profile.SpecOptions
+	}
+
+	fp.Identity = profiles.Identity(*setup)
+	core.ApplyClientHints(req, fp.Identity, hints, fp.Secure)
+
+	fp.Header, fp.HeaderOrder = req.Header, req.HeaderOrder.Order
+	fp.HTTP2 = fp.Secure && !*downgrade
+	if *pseudoOrder != "" {
+		fp.PseudoOrder = strings.Split(*pseudoOrder, ",")
+	}
+
+	report, err := core.CheckConsistency(fp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't build the ClientHello:", err)
+		return 2
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		fmt.Print(report)
+	}
+
+	if report.Score < *minScore {
+		return 1
+	}
+
+	return 0
+}
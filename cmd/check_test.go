@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+const (
+	testChromeUA  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	testFirefoxUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:120.0) Gecko/20100101 Firefox/120.0"
+
+	testFirefoxJA3 = "771,4865-4867-4866-49195-49199-52393-52392-49196-49200-49162-49161-49171-49172-156-157-47-53,0-23-65281-10-11-16-5-34-51-43-13-45-28-65037,29-23-24-25-256-257,0"
+)
+
+// runCheckOutput runs the check command and returns its exit status and what it printed
+func runCheckOutput(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	code := runCheck(args)
+	writer.Close()
+	os.Stdout = stdout
+
+	return code, <-output
+}
+
+func TestRunCheckExitCode(t *testing.T) {
+	profiles := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(profiles, []byte(`{"broken": {"ja3": "`+testFirefoxJA3+`", "client": {"browser": "chrome", "version": 120, "platform": "windows"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"chrome", []string{"-setup", "chrome"}, 0},
+		{"chrome user agent and headers", []string{"-setup", "chrome", "-user-agent", testChromeUA, "-header", "Accept: */*"}, 0},
+		{"firefox over http/1.1", []string{"-setup", "firefox", "-downgrade"}, 0},
+		{"plain http", []string{"-http", "-user-agent", testFirefoxUA, "-client-hints", "off"}, 0},
+
+		{"chrome user agent firefox ja3", []string{"-ja3", testFirefoxJA3, "-user-agent", testChromeUA}, 1},
+		{"chrome profile firefox ja3", []string{"-profiles", profiles, "-setup", "broken"}, 1},
+		{"lower minimum", []string{"-ja3", testFirefoxJA3, "-user-agent", testChromeUA, "-min-score", "60"}, 0},
+		{"minimum over 100", []string{"-setup", "chrome", "-min-score", "101"}, 1},
+
+		{"unknown flag", []string{"-unknown"}, 2},
+		{"client hints mode", []string{"-client-hints", "always"}, 2},
+		{"header without colon", []string{"-header", "Accept */*"}, 2},
+		{"header without name", []string{"-header", ": value"}, 2},
+		{"missing profiles", []string{"-profiles", filepath.Join(t.TempDir(), "missing.json")}, 2},
+		{"invalid ja3", []string{"-ja3", "771,abc"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, output := runCheckOutput(t, tt.args...); code != tt.code {
+				t.Fatalf("runCheck(%q) = %d, want %d\n%s", tt.args, code, tt.code, output)
+			}
+		})
+	}
+}
+
+func TestRunCheckJSON(t *testing.T) {
+	code, output := runCheckOutput(t, "-json", "-ja3", testFirefoxJA3, "-user-agent", testChromeUA)
+	if code != 1 {
+		t.Fatalf("exit status %d, want 1", code)
+	}
+
+	var report core.ConsistencyReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		t.Fatalf("output %q: %v", output, err)
+	}
+
+	if report.Family != "chromium" || report.Score != 100-core.TLS_CONSISTENCY_WEIGHT || len(report.Findings) != 1 || report.Findings[0].Check != "tls" {
+		t.Fatalf("report = %+v", report)
+	}
+}
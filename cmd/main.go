@@ -16,7 +16,23 @@ import (
 
 const usageMsg = "http tls proxy service address"
 
+// listFlag collects the values of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
 	var addr *string
 	if port, exists := os.LookupEnv("PORT"); exists {
 		addr = flag.String("addr", ":"+port, usageMsg)
@@ -24,6 +40,63 @@ func main() {
 		addr = flag.String("addr", ":3128", usageMsg)
 	}
 
+	caBundle := flag.String("ca-bundle", "", "PEM file with CA certificates used instead of the system pool")
+	insecure := flag.Bool("insecure", false, "skip upstream certificate chain verification")
+
+	sessionCacheSize := flag.Int("session-cache-size", 1024, "TLS sessions cached per profile, 0 disables resumption")
+	sessionCacheTTL := flag.Duration("session-cache-ttl", time.Hour, "lifetime of a cached TLS session")
+
+	protocolCacheTTL := flag.Duration("protocol-cache-ttl", core.DEFAULT_PROTOCOL_TTL, "how long the negotiated protocol of an origin is remembered, 0 disables it")
+	http3GoHello := flag.Bool("http3-go-hello", false, "allow proxy-http3 although QUIC connections send the Go TLS ClientHello, not the profile's")
+	profilesFile := flag.String("profiles", "", "JSON file with named profiles selectable through proxy-tls-setup")
+	clientHints := flag.String("client-hints", "fill", "browser headers of the proxy-tls-setup profile without proxy-client-hints: fill, force or off")
+	consistency := flag.String("consistency", "off", "fingerprint consistency check without proxy-consistency: off, warn or strict")
+	consistencyMinScore := flag.Int("consistency-min-score", core.DEFAULT_CONSISTENCY_SCORE, "lowest consistency score strict mode lets through")
+	headerRulesFile := flag.String("header-rules", "", "JSON file with header rewrite rules matched by host, path, method and profile")
+	echDNS := flag.Bool("ech-dns", false, "look up ECH configs in the HTTPS DNS record of upstream hosts")
+	echNameserver := flag.String("ech-nameserver", "", "nameserver for HTTPS record lookups, default is the -dns server or the first resolv.conf entry")
+
+	dnsServer := flag.String("dns", "", "upstream DNS server: https://host/dns-query, tls://host[:853], udp://host[:53] or tcp://host[:53], default is the system resolver")
+	dnsPrefer := flag.String("dns-prefer", "", "address family dialed first: ipv4 or ipv6")
+
+	bindMode := flag.String("bind-mode", "", "source address selection without a proxy-bind header: rotate, random, an address or a sticky key")
+
+	stickySessionTTL := flag.Duration("proxy-session-ttl", 10*time.Minute, "idle lifetime of a proxy-session")
+	maxStickySessions := flag.Int("proxy-session-max", 1000, "sticky sessions kept at once, 0 means no limit")
+	redirect := flag.String("redirect", "follow", "redirect policy without proxy-redirect: passthrough, follow[=N] or same-origin[=N]")
+	retries := flag.Int("retries", 2, "retries of transient failures of idempotent requests, proxy-retries overrides it")
+	retryBackoff := flag.Duration("retry-backoff", 100*time.Millisecond, "delay before the first retry, doubled per retry")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", 2*time.Second, "longest delay between retries")
+	retryBodyLimit := flag.Int64("retry-body-limit", 1<<20, "largest request body kept in memory for retries")
+	idleReadTimeout := flag.Duration("idle-read-timeout", time.Minute, "longest wait for the next bytes of a response body, 0 disables it")
+	webSocketIdleTimeout := flag.Duration("websocket-idle-timeout", 5*time.Minute, "close relayed WebSockets without traffic for this long, 0 disables it")
+	maxRequestBody := flag.Int64("max-request-body", 0, "largest request body in bytes, 0 means no limit")
+	maxResponseBody := flag.Int64("max-response-body", 0, "largest response body in bytes, 0 means no limit")
+	maxInFlight := flag.Int("max-in-flight", 0, "requests and tunnels open at once, 0 means no limit")
+	maxClientConns := flag.Int("max-client-conns", 0, "requests and tunnels open at once per client IP, 0 means no limit")
+	hostRate := flag.Float64("host-rate", 0, "requests per second to one destination host, 0 means no limit")
+	hostBurst := flag.Int("host-burst", 10, "requests to one destination host allowed in a burst")
+	limitWait := flag.Duration("limit-wait", 5*time.Second, "longest wait of a request for a free slot or token")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "failures in a row that open the circuit breaker of an origin, 0 disables breakers")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "how long an open circuit breaker refuses requests before a probe")
+	breakerStatuses := flag.String("breaker-statuses", "502,503,504", "response statuses counted as failures, e.g. 403,429,500-599")
+	decompress := flag.String("decompress", "passthrough", "response mode without proxy-decompress: passthrough or decode")
+	cookieJar := flag.Bool("cookie-jar", false, "keep a cookie jar in every sticky session, proxy-cookies overrides it")
+
+	adminAddr := flag.String("admin-addr", "", "admin API address, e.g. 127.0.0.1:3129, empty disables it")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin API")
+
+	denyPrivate := flag.Bool("deny-private", false, "refuse upstream connections to loopback, private, link-local and other non-public addresses")
+
+	var pins, echConfigs, resolves, binds, upstreams, allows, denies listFlag
+	flag.Var(&pins, "pin", "pin upstream host to a SPKI hash as host=sha256/base64, repeatable")
+	flag.Var(&echConfigs, "ech", "ECHConfigList of an upstream host as host=base64, repeatable")
+	flag.Var(&resolves, "resolve", "dial an upstream host at a fixed address as host:addr or host:port:addr, repeatable")
+	flag.Var(&upstreams, "upstream", "upstream proxy as socks5://host:port or http://host:port, repeatable to rotate")
+	flag.Var(&binds, "bind", "local address or IPv6 prefix for outbound connections, repeatable")
+	flag.Var(&allows, "allow", "allowed destination as host glob, address or CIDR with optional :port or :from-to, repeatable")
+	flag.Var(&denies, "deny", "denied destination as host glob, address or CIDR with optional :port or :from-to, repeatable")
+
 	flag.Parse()
 
 	logWriter := core.NewLogWriter(os.Stderr)
@@ -34,10 +107,172 @@ func main() {
 	// Create proxy configuration
 	config := app.DefaultConfig()
 	config.Timeout = 10 * time.Second
+	config.IdleReadTimeout = *idleReadTimeout
+	config.WebSocketIdleTimeout = *webSocketIdleTimeout
+	config.MaxRequestBody = *maxRequestBody
+	config.MaxResponseBody = *maxResponseBody
+	config.MaxInFlight = *maxInFlight
+	config.MaxClientConns = *maxClientConns
+	config.HostRate = *hostRate
+	config.HostBurst = *hostBurst
+	config.LimitWait = *limitWait
+	config.BreakerThreshold = *breakerThreshold
+	config.BreakerCooldown = *breakerCooldown
+	config.Verify.Insecure = *insecure
+	config.SessionCacheSize = *sessionCacheSize
+	config.SessionCacheTTL = *sessionCacheTTL
+	config.ProtocolCacheTTL = *protocolCacheTTL
+	config.HTTP3GoHello = *http3GoHello
+
+	if *caBundle != "" {
+		pool, err := core.LoadCertPool(*caBundle)
+		if err != nil {
+			log.Fatal("Can't load CA bundle: ", err)
+		}
+		config.Verify.RootCAs = pool
+	}
+
+	for _, pin := range pins {
+		if err := config.Verify.AddPin(pin); err != nil {
+			log.Fatal("Invalid pin: ", err)
+		}
+	}
+
+	if *profilesFile != "" {
+		profiles, err := core.LoadProfiles(*profilesFile)
+		if err != nil {
+			log.Fatal("Can't load profiles: ", err)
+		}
+		config.Profiles = profiles
+	}
+
+	if *headerRulesFile != "" {
+		rules, err := core.LoadHeaderRules(*headerRulesFile)
+		if err != nil {
+			log.Fatal("Can't load header rules: ", err)
+		}
+		config.HeaderRules = rules
+	}
+
+	config.ECH.LookupDNS = *echDNS
+	config.ECH.Nameserver = *echNameserver
+
+	for _, ech := range echConfigs {
+		if err := config.ECH.AddHost(ech); err != nil {
+			log.Fatal("Invalid ECH config: ", err)
+		}
+	}
+
+	prefer, err := core.ParseIPPreference(*dnsPrefer)
+	if err != nil {
+		log.Fatal("Invalid DNS preference: ", err)
+	}
+
+	if *dnsServer != "" || prefer != core.PreferNone {
+		if config.Resolver, err = core.NewResolver(*dnsServer, prefer); err != nil {
+			log.Fatal("Invalid DNS server: ", err)
+		}
+	}
+
+	config.ECH.Resolver = config.Resolver
+
+	for _, resolve := range resolves {
+		key, ip, err := core.ParseResolveOverride(resolve)
+		if err != nil {
+			log.Fatal("Invalid resolve: ", err)
+		}
+		config.Resolve[key] = ip
+	}
+
+	for _, rule := range allows {
+		if err := config.ACL.Allow(rule); err != nil {
+			log.Fatal("Invalid allow rule: ", err)
+		}
+	}
+
+	for _, rule := range denies {
+		if err := config.ACL.Deny(rule); err != nil {
+			log.Fatal("Invalid deny rule: ", err)
+		}
+	}
+
+	if *denyPrivate {
+		config.ACL.DenyPrivate()
+	}
+
+	for _, bind := range binds {
+		if err := config.Bind.Add(bind); err != nil {
+			log.Fatal("Invalid bind: ", err)
+		}
+	}
+
+	if _, err := core.ParseBind(*bindMode, config.Bind); err != nil {
+		log.Fatal("Invalid bind mode: ", err)
+	}
+	config.BindMode = *bindMode
+	config.StickySessionTTL = *stickySessionTTL
+	config.MaxStickySessions = *maxStickySessions
+	config.CookieJar = *cookieJar
+	config.Retries = *retries
+	config.RetryBackoff = *retryBackoff
+	config.RetryMaxBackoff = *retryMaxBackoff
+	config.RetryBodyLimit = *retryBodyLimit
+
+	for _, raw := range upstreams {
+		upstream, err := core.ParseUpstream(raw)
+		if err != nil {
+			log.Fatal("Invalid upstream: ", err)
+		}
+		config.Upstreams = append(config.Upstreams, upstream)
+	}
+
+	// The upstream proxy opens the connections, it picks the source address and resolves names
+	if len(upstreams) > 0 {
+		if !config.Bind.Empty() || *bindMode != "" {
+			log.Fatal("Invalid bind: -bind and -bind-mode cannot be used with -upstream")
+		}
+
+		if *dnsServer != "" || prefer != core.PreferNone {
+			logger.Warning("Upstream proxies resolve hosts themselves, -dns and -dns-prefer only apply to ECH lookups")
+		}
+	}
+
+	if err := app.ValidateRedirectPolicy(*redirect); err != nil {
+		log.Fatal("Invalid redirect policy: ", err)
+	}
+	config.Redirect = *redirect
+
+	if config.Decompress, err = core.ParseDecompressMode(*decompress); err != nil {
+		log.Fatal("Invalid decompress mode: ", err)
+	}
+
+	if config.ClientHints, err = core.ParseClientHintsMode(*clientHints); err != nil {
+		log.Fatal("Invalid client hints mode: ", err)
+	}
+
+	if config.Consistency, err = core.ParseConsistencyMode(*consistency); err != nil {
+		log.Fatal("Invalid consistency mode: ", err)
+	}
+	config.ConsistencyMinScore = *consistencyMinScore
+
+	if config.BreakerStatuses, err = core.ParseStatusCodes(*breakerStatuses); err != nil {
+		log.Fatal("Invalid breaker statuses: ", err)
+	}
+
+	handler := app.NewProxyHandler(config, logger)
+
+	if *adminAddr != "" {
+		go func() {
+			logger.Info("Admin API listening on %s", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, app.NewAdminHandler(handler, *adminToken)); err != nil {
+				log.Fatal("Admin ListenAndServe: ", err)
+			}
+		}()
+	}
 
 	server := http.Server{
 		Addr:              *addr,
-		Handler:           app.NewProxyHandler(config, logger),
+		Handler:           handler,
 		ErrorLog:          log.New(logWriter, "[HTTP] ", log.LstdFlags|log.Lshortfile),
 		TLSNextProto:      make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 		ReadTimeout:       0,
@@ -50,7 +285,7 @@ func main() {
 
 	logger.Info("Server started and listening on port %s", strings.Replace(*addr, ":", "", 1))
 
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -1,17 +1,19 @@
 module github.com/kolosok86/proxy
 
-go 1.22
+go 1.24
 
 require (
 	github.com/Kolosok86/http v0.1.2
-	github.com/refraction-networking/utls v1.2.2
-	golang.org/x/net v0.7.0
+	github.com/andybalholm/brotli v1.0.6
+	github.com/klauspost/compress v1.17.4
+	github.com/quic-go/quic-go v0.59.0
+	github.com/refraction-networking/utls v1.8.2
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.4 // indirect
-	github.com/klauspost/compress v1.15.15 // indirect
-	golang.org/x/crypto v0.5.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/text v0.7.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
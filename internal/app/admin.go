@@ -0,0 +1,173 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+// Largest request body the admin API reads
+const MAX_ADMIN_BODY_SIZE = 8 << 20
+
+// AdminHandler serves the admin API of a proxy handler on its own listener
+type AdminHandler struct {
+	proxy  *ProxyHandler
+	token  string
+	routes []adminRoute
+}
+
+// adminRoute is an endpoint of the admin API, a "{key}" segment of its path matches one
+// escaped path segment which is passed unescaped to handle
+type adminRoute struct {
+	method string
+	path   string
+	handle func(wr http.ResponseWriter, req *http.Request, key string)
+}
+
+// NewAdminHandler creates the admin API, a non-empty token is required as a Bearer token
+func NewAdminHandler(proxy *ProxyHandler, token string) *AdminHandler {
+	admin := &AdminHandler{proxy: proxy, token: token}
+
+	admin.routes = []adminRoute{
+		{"GET", "/sessions", admin.listSessions},
+		{"DELETE", "/sessions/{key}", admin.deleteSession},
+		{"GET", "/sessions/{key}/cookies", admin.exportCookies},
+		{"PUT", "/sessions/{key}/cookies", admin.importCookies},
+		{"GET", "/websockets", admin.webSocketStats},
+		{"GET", "/breakers", admin.listBreakers},
+	}
+
+	return admin
+}
+
+func (a *AdminHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if a.token != "" {
+		expected := "Bearer " + a.token
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.Error(wr, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var allowed []string
+	for _, route := range a.routes {
+		key, ok := matchAdminPath(route.path, req.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+
+		if route.method == req.Method {
+			route.handle(wr, req, key)
+			return
+		}
+		allowed = append(allowed, route.method)
+	}
+
+	if len(allowed) == 0 {
+		http.NotFound(wr, req)
+		return
+	}
+
+	wr.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(wr, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
+
+// matchAdminPath matches an escaped request path against a route path, returning the
+// unescaped value of its "{key}" segment
+func matchAdminPath(pattern, path string) (string, bool) {
+	want := strings.Split(pattern, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return "", false
+	}
+
+	var key string
+	for i, segment := range want {
+		if segment != "{key}" {
+			if got[i] != segment {
+				return "", false
+			}
+			continue
+		}
+
+		value, err := url.PathUnescape(got[i])
+		if err != nil || value == "" {
+			return "", false
+		}
+		key = value
+	}
+
+	return key, true
+}
+
+func (a *AdminHandler) listSessions(wr http.ResponseWriter, _ *http.Request, _ string) {
+	writeJSON(wr, a.proxy.sticky.list())
+}
+
+func (a *AdminHandler) deleteSession(wr http.ResponseWriter, _ *http.Request, key string) {
+	if !a.proxy.sticky.delete(key) {
+		http.Error(wr, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	a.proxy.logger.Info("Session %q deleted through the admin API", key)
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminHandler) exportCookies(wr http.ResponseWriter, _ *http.Request, key string) {
+	jar, _ := a.proxy.sticky.cookieJar(key, false)
+	if jar == nil {
+		http.Error(wr, "Session has no cookie jar", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(wr, jar.Export())
+}
+
+// importCookies replaces the jar of a session with a JSON array of cookies, starting the
+// session when it does not exist yet
+func (a *AdminHandler) importCookies(wr http.ResponseWriter, req *http.Request, key string) {
+	var cookies []core.JarCookie
+	if err := json.NewDecoder(io.LimitReader(req.Body, MAX_ADMIN_BODY_SIZE)).Decode(&cookies); err != nil {
+		http.Error(wr, "Invalid cookies: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jar, err := a.proxy.sticky.cookieJar(key, true)
+	if err == errTooManySessions {
+		http.Error(wr, TOO_MANY_SESSIONS_MSG, http.StatusServiceUnavailable)
+		return
+	}
+
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = jar.Import(cookies); err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminHandler) webSocketStats(wr http.ResponseWriter, _ *http.Request, _ string) {
+	writeJSON(wr, a.proxy.websockets.snapshot())
+}
+
+func (a *AdminHandler) listBreakers(wr http.ResponseWriter, _ *http.Request, _ string) {
+	writeJSON(wr, a.proxy.breakers.Snapshot())
+}
+
+func writeJSON(wr http.ResponseWriter, value any) {
+	wr.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(wr).Encode(value); err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/httptest"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+func TestMatchAdminPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		key     string
+		ok      bool
+	}{
+		{"/sessions", "/sessions", "", true},
+		{"/sessions", "/sessions/", "", false},
+		{"/sessions/{key}", "/sessions/a@192.0.2.1", "a@192.0.2.1", true},
+		{"/sessions/{key}", "/sessions/a%2Fb@192.0.2.1", "a/b@192.0.2.1", true},
+		{"/sessions/{key}", "/sessions/", "", false},
+		{"/sessions/{key}", "/sessions/%zz", "", false},
+		{"/sessions/{key}/cookies", "/sessions/a@auth:00/cookies", "a@auth:00", true},
+		{"/sessions/{key}/cookies", "/sessions/a/b/cookies", "", false},
+		{"/breakers", "/websockets", "", false},
+	}
+
+	for _, tt := range tests {
+		key, ok := matchAdminPath(tt.pattern, tt.path)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("matchAdminPath(%q, %q) = %q, %t, want %q, %t", tt.pattern, tt.path, key, ok, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	proxy := NewProxyHandler(DefaultConfig(), core.NewCondLogger(log.New(io.Discard, "", 0), core.DEBUG))
+	defer proxy.Close()
+
+	server := httptest.NewServer(NewAdminHandler(proxy, "secret"))
+	defer server.Close()
+
+	send := func(method, path, token, body string) *http.Response {
+		t.Helper()
+
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"GET", "/sessions", "", "", http.StatusUnauthorized},
+		{"GET", "/sessions", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/sessions", "secret", "", http.StatusOK},
+		{"PUT", "/sessions/a%2Fb@192.0.2.1/cookies", "secret", `[{"name":"id","value":"1","domain":"example.com","path":"/"}]`, http.StatusNoContent},
+		{"GET", "/sessions/a%2Fb@192.0.2.1/cookies", "secret", "", http.StatusOK},
+		{"GET", "/sessions/missing@192.0.2.1/cookies", "secret", "", http.StatusNotFound},
+		{"DELETE", "/sessions/a%2Fb@192.0.2.1", "secret", "", http.StatusNoContent},
+		{"DELETE", "/sessions/a%2Fb@192.0.2.1", "secret", "", http.StatusNotFound},
+		{"POST", "/sessions", "secret", "", http.StatusMethodNotAllowed},
+		{"GET", "/websockets", "secret", "", http.StatusOK},
+		{"GET", "/breakers", "secret", "", http.StatusOK},
+		{"GET", "/unknown", "secret", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.method, tt.path, tt.token, tt.body); resp.StatusCode != tt.status {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+	}
+
+	if allow := send("DELETE", "/sessions/x@192.0.2.1/cookies", "secret", "").Header.Get("Allow"); allow != "GET, PUT" {
+		t.Errorf("Allow = %q, want GET, PUT", allow)
+	}
+}
@@ -3,10 +3,12 @@ package app
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Kolosok86/http"
@@ -20,24 +22,168 @@ const (
 	SERVER_REQUEST_ERROR_MSG = "Server Request Error"
 	HIJACK_ERROR_MSG         = "Can't hijack client connection"
 
+	PEER_CHAIN_HEADER     = "Proxy-Tls-Peer"
+	REDIRECT_CHAIN_HEADER = "Proxy-Redirect-Chain"
+
 	DEFAULT_SCHEME      = "https"
 	HTTP_OK_RESPONSE    = "HTTP/%d.%d 200 OK\r\n\r\n"
 	HTTP_ERROR_RESPONSE = "HTTP/1.1 500 Internal Server Error\r\n\r\n%s"
+
+	TOO_MANY_SESSIONS_MSG     = "Too many sessions"
+	HTTP_UNAVAILABLE_RESPONSE = "HTTP/1.1 503 Service Unavailable\r\n\r\n%s"
+
+	REQUEST_TOO_LARGE_MSG     = "Request body too large"
+	RESPONSE_TOO_LARGE_MSG    = "Response body too large"
+	HTTP_TOO_LARGE_RESPONSE   = "HTTP/1.1 413 Request Entity Too Large\r\n\r\n%s"
+	HTTP_BAD_GATEWAY_RESPONSE = "HTTP/1.1 502 Bad Gateway\r\n\r\n%s"
+
+	LIMITED_MSG           = "Too many requests"
+	CIRCUIT_OPEN_MSG      = "Upstream unavailable"
+	HTTP_LIMITED_RESPONSE = "HTTP/1.1 %d %s\r\nRetry-After: %d\r\n\r\n%s"
+
+	DESTINATION_DENIED_MSG  = "Destination not allowed"
+	HTTP_FORBIDDEN_RESPONSE = "HTTP/1.1 403 Forbidden\r\n\r\n%s"
+
+	INCONSISTENT_MSG          = "Inconsistent fingerprint"
+	HTTP3_HELLO_MSG           = "HTTP/3 would not send the TLS fingerprint of the profile"
+	HTTP_BAD_REQUEST_RESPONSE = "HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s"
 )
 
+// errInconsistent ends a tunneled request strict consistency mode rejected
+var errInconsistent = errors.New("inconsistent fingerprint")
+
+// errHTTP3Hello refuses proxy-http3 while QUIC connections would send Go's own ClientHello
+var errHTTP3Hello = errors.New("proxy-http3 needs -http3-go-hello")
+
 // Config contains the proxy configuration
 type Config struct {
-	Timeout        time.Duration
+	// Timeout bounds the wait for response headers, IdleReadTimeout the wait for the next
+	// bytes of a body, zero means no idle limit
+	Timeout         time.Duration
+	IdleReadTimeout time.Duration
+	// WebSocketIdleTimeout closes a relayed WebSocket without traffic either way, zero means never
+	WebSocketIdleTimeout time.Duration
+
 	AllowedSchemes []string
 	LogLevel       int
+	Verify         *core.VerifyConfig
+	ECH            *core.ECHConfig
+	Profiles       core.Profiles
+	// HTTP3GoHello allows proxy-http3 although QUIC connections send the Go TLS ClientHello
+	// with only the curves of the profile
+	HTTP3GoHello bool
+	// HeaderRules rewrite request and response headers of matching requests
+	HeaderRules core.HeaderRules
+	// ClientHints is the proxy-client-hints mode of requests without the header
+	ClientHints core.ClientHintsMode
+	// Consistency is the proxy-consistency mode of requests, the header can only make it
+	// stricter; strict mode rejects requests scoring below ConsistencyMinScore
+	Consistency         core.ConsistencyMode
+	ConsistencyMinScore int
+
+	// TLS sessions kept per profile for resumption, zero size disables it
+	SessionCacheSize int
+	SessionCacheTTL  time.Duration
+
+	// How long the negotiated protocol of an origin is remembered, zero disables it
+	ProtocolCacheTTL time.Duration
+
+	// Resolver looks up upstream hosts, nil uses the system resolver
+	Resolver *core.Resolver
+	// Resolve holds static "host" or "host:port" to address overrides for every request
+	Resolve map[string]string
+
+	// ACL holds the allowed and denied destinations of upstream connections, checked by name
+	// and by every resolved address
+	ACL *core.ACL
+
+	// Bind holds the local addresses outbound connections may use
+	Bind *core.BindPool
+	// BindMode is the proxy-bind value used when a request has none
+	BindMode string
+
+	// Idle lifetime of a proxy-session and the number of sessions kept at once, zero means no limit
+	StickySessionTTL  time.Duration
+	MaxStickySessions int
+	// CookieJar keeps cookies in every sticky session without a proxy-cookies header
+	CookieJar bool
+
+	// Redirect is the proxy-redirect policy of requests without the header
+	Redirect string
+
+	// Upstreams are proxies requests are tunneled through, rotated per request and retry
+	Upstreams []*core.Upstream
+
+	// Retries of transient failures of idempotent requests, backing off exponentially from
+	// RetryBackoff to RetryMaxBackoff; bodies up to RetryBodyLimit bytes are kept for replay
+	Retries         int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	RetryBodyLimit  int64
+
+	// Decompress is the proxy-decompress mode of requests without the header
+	Decompress core.DecompressMode
+
+	// Largest request and response bodies in bytes, proxy-max-request-body and
+	// proxy-max-response-body can only lower them; zero means no limit
+	MaxRequestBody  int64
+	MaxResponseBody int64
+
+	// MaxInFlight caps requests and tunnels open at once, MaxClientConns those of one client
+	// IP; HostRate is the request rate per destination host with bursts of HostBurst. A request
+	// waits up to LimitWait for its turn, zero values mean no limit
+	MaxInFlight    int
+	MaxClientConns int
+	HostRate       float64
+	HostBurst      int
+	LimitWait      time.Duration
+
+	// BreakerThreshold failures in a row open the circuit breaker of an origin for
+	// BreakerCooldown, connection errors and BreakerStatuses count; zero disables breakers
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	BreakerStatuses  []int
 }
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() *Config {
 	return &Config{
-		Timeout:        10 * time.Second,
+		Timeout:         10 * time.Second,
+		IdleReadTimeout: time.Minute,
+
+		WebSocketIdleTimeout: 5 * time.Minute,
+
 		AllowedSchemes: []string{"http", "https"},
 		LogLevel:       20,
+		Verify:         &core.VerifyConfig{},
+		ECH:            &core.ECHConfig{},
+
+		SessionCacheSize: 1024,
+		SessionCacheTTL:  time.Hour,
+
+		ProtocolCacheTTL: core.DEFAULT_PROTOCOL_TTL,
+
+		Resolve: make(map[string]string),
+		ACL:     &core.ACL{},
+		Bind:    &core.BindPool{},
+
+		StickySessionTTL:  10 * time.Minute,
+		MaxStickySessions: 1000,
+
+		ConsistencyMinScore: core.DEFAULT_CONSISTENCY_SCORE,
+
+		Redirect: "follow",
+
+		Retries:         2,
+		RetryBackoff:    100 * time.Millisecond,
+		RetryMaxBackoff: 2 * time.Second,
+		RetryBodyLimit:  1 << 20,
+
+		HostBurst: 10,
+		LimitWait: 5 * time.Second,
+
+		BreakerCooldown: 30 * time.Second,
+		BreakerStatuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
 	}
 }
 
@@ -59,6 +205,16 @@ type ProxyHandler struct {
 	logger    *core.Logger
 	transport http.RoundTripper
 	validator RequestValidator
+	sessions  *core.SessionStore
+	protocols *core.ProtocolCache
+	sticky    *stickySessions
+
+	// nextUpstream rotates requests through the configured upstream proxies
+	nextUpstream atomic.Uint64
+
+	websockets webSocketStats
+	limits     *limiter
+	breakers   *core.Breakers
 }
 
 func NewProxyHandler(config *Config, logger *core.Logger) *ProxyHandler {
@@ -66,12 +222,27 @@ func NewProxyHandler(config *Config, logger *core.Logger) *ProxyHandler {
 		config = DefaultConfig()
 	}
 
-	return &ProxyHandler{
+	handler := &ProxyHandler{
 		config:    config,
 		transport: &http.Transport{},
 		logger:    logger,
 		validator: &DefaultValidator{},
+		sessions:  core.NewSessionStore(config.SessionCacheSize, config.SessionCacheTTL),
+		protocols: core.NewProtocolCache(config.ProtocolCacheTTL),
+		sticky:    newStickySessions(config.StickySessionTTL, config.MaxStickySessions),
+		limits:    newLimiter(config),
+		breakers:  core.NewBreakers(config.BreakerThreshold, config.BreakerCooldown, config.BreakerStatuses),
 	}
+
+	go handler.sticky.sweep(STICKY_SWEEP_INTERVAL)
+
+	return handler
+}
+
+// Close stops the background work of the handler and closes the idle connections of
+// sticky sessions, the handler must not serve requests afterwards
+func (s *ProxyHandler) Close() {
+	s.sticky.stop()
 }
 
 // NewProxyHandlerWithValidator creates a handler with a custom validator
@@ -92,6 +263,15 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 
 	s.logger.Info("Request: %v %v %v %v", req.RemoteAddr, req.Proto, req.Method, req.URL)
 
+	// A tunnel holds its slot for its whole lifetime
+	release, err := s.limits.acquire(req.Context(), req.RemoteAddr)
+	if err != nil {
+		s.logger.Warning("Request from %v refused: %v", req.RemoteAddr, err)
+		writeLimitError(wr, err)
+		return
+	}
+	defer release()
+
 	if !isConnect {
 		s.HandleHTTP(wr, req)
 	} else {
@@ -102,6 +282,7 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 func (s *ProxyHandler) HandleHTTP(wr http.ResponseWriter, req *http.Request) {
 	// Extract settings from headers
 	proxyConfig := s.extractProxyConfig(req)
+	proxyConfig.client = sessionClient(req)
 
 	// Validate scheme
 	if !s.isSchemeAllowed(proxyConfig.scheme) {
@@ -114,26 +295,92 @@ func (s *ProxyHandler) HandleHTTP(wr http.ResponseWriter, req *http.Request) {
 	s.setupRequest(req, proxyConfig)
 	req.RequestURI = ""
 
-	// Create a client with context
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
-	defer cancel()
+	if err := s.limits.throttle(req.Context(), req.URL.Hostname()); err != nil {
+		s.logger.Warning("Request to %v refused: %v", req.URL.Host, err)
+		writeLimitError(wr, err)
+		return
+	}
 
-	client := s.createHTTPClient(proxyConfig)
+	// Refuse an upload above the limit before it is sent
+	upload, err := limitRequestBody(req, proxyConfig.maxRequestBody)
+	if err != nil {
+		s.logger.Error("Request rejected: %v", err)
+		http.Error(wr, REQUEST_TOO_LARGE_MSG, http.StatusRequestEntityTooLarge)
+		return
+	}
 
-	// Remove service headers
+	// Fill in the browser headers of the profile, rewrite headers by the configured rules,
+	// then remove service headers
+	proxyConfig.userAgent = s.clientHints(req, proxyConfig)
+	s.config.HeaderRules.Request(req, proxyConfig.tlsSetup)
 	s.removeServiceHeaders(req, proxyConfig.nodeEscape)
 
-	// Execute the request
-	resp, err := client.Do(req.WithContext(ctx))
-	if err != nil {
+	if proxyConfig.http3 != core.HTTP3Off && !s.config.HTTP3GoHello {
+		s.logger.Warning("Request from %v refused: %v", req.RemoteAddr, errHTTP3Hello)
+		http.Error(wr, HTTP3_HELLO_MSG, http.StatusBadRequest)
+		return
+	}
+
+	if report := s.checkConsistency(req, proxyConfig); report != nil {
+		http.Error(wr, INCONSISTENT_MSG+"\n"+report.String(), http.StatusBadRequest)
+		return
+	}
+
+	// Execute the request, upstream work stops when the client goes away
+	resp, stop, err := s.fetch(req.Context(), req, proxyConfig)
+	if err != nil && upload != nil && upload.exceeded.Load() {
+		err = errRequestTooLarge
+	}
+
+	switch err {
+	case nil:
+	case errRequestTooLarge:
+		s.logger.Error("Request rejected: %v", err)
+		http.Error(wr, REQUEST_TOO_LARGE_MSG, http.StatusRequestEntityTooLarge)
+		return
+	case errTooManySessions, errInvalidSessionID:
+		s.logger.Error("Session %q rejected: %v", proxyConfig.session, err)
+		if err == errTooManySessions {
+			http.Error(wr, TOO_MANY_SESSIONS_MSG, http.StatusServiceUnavailable)
+		} else {
+			http.Error(wr, BAD_REQ_MSG, http.StatusBadRequest)
+		}
+		return
+	default:
+		if isLimited(err) {
+			s.logger.Warning("Request to %v refused: %v", req.URL.Host, err)
+			writeLimitError(wr, err)
+			return
+		}
+
+		if errors.Is(err, core.ErrDestinationDenied) {
+			s.logger.Warning("Request from %v refused: %v", req.RemoteAddr, err)
+			http.Error(wr, DESTINATION_DENIED_MSG, http.StatusForbidden)
+			return
+		}
+
 		s.logger.Error("HTTP fetch error: %v", err)
 		http.Error(wr, SERVER_REQUEST_ERROR_MSG, http.StatusInternalServerError)
 		return
 	}
+	defer stop()
 	defer resp.Body.Close()
 
 	s.logger.Info("Response: %v %v %v %v", req.RemoteAddr, req.Method, req.URL, resp.Status)
 
+	s.decorateResponse(resp, proxyConfig)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.upgradeWebSocket(wr, req, resp)
+		return
+	}
+
+	if err := limitResponseBody(resp, proxyConfig.maxResponseBody); err != nil {
+		s.logger.Error("Response rejected: %v %v", req.URL, err)
+		http.Error(wr, RESPONSE_TOO_LARGE_MSG, http.StatusBadGateway)
+		return
+	}
+
 	// Copy response headers
 	for key, values := range resp.Header {
 		for _, value := range values {
@@ -141,14 +388,22 @@ func (s *ProxyHandler) HandleHTTP(wr http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	announceTrailers(wr, resp)
+
 	// Set status code
 	wr.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	if _, err := io.Copy(wr, resp.Body); err != nil {
-		s.logger.Error("Error copying response body: %v", err)
-		return
+	// Copy response body, streams are flushed as they arrive
+	if err := copyBody(wr, resp); err != nil {
+		if !s.logCutResponse(req.RemoteAddr, req.URL, proxyConfig.maxResponseBody, err) {
+			s.logger.Error("Error copying response body: %v", err)
+		}
+
+		// Abort the client connection so a cut body does not look complete
+		panic(http.ErrAbortHandler)
 	}
+
+	copyTrailers(wr, resp)
 }
 
 func (s *ProxyHandler) HandleTunnel(wr http.ResponseWriter, req *http.Request) {
@@ -158,6 +413,13 @@ func (s *ProxyHandler) HandleTunnel(wr http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// The tunneled requests are checked again with the addresses they resolve to
+	if err := s.config.ACL.CheckAddr(req.URL.Host); err != nil {
+		s.logger.Warning("Tunnel from %v refused: %v", req.RemoteAddr, err)
+		http.Error(wr, DESTINATION_DENIED_MSG, http.StatusForbidden)
+		return
+	}
+
 	// Upgrade client connection
 	local, reader, err := core.Hijack(wr)
 	if err != nil {
@@ -191,8 +453,9 @@ func (s *ProxyHandler) processProxyRequest(local net.Conn, reader *bufio.ReadWri
 		return err
 	}
 
-	// Extract settings from headers
+	// Extract settings from headers, the session belongs to the client of the tunnel
 	proxyConfig := s.extractProxyConfig(request)
+	proxyConfig.client = sessionClient(originalReq)
 
 	// Validate scheme
 	if !s.isSchemeAllowed(proxyConfig.scheme) {
@@ -204,30 +467,114 @@ func (s *ProxyHandler) processProxyRequest(local net.Conn, reader *bufio.ReadWri
 	// Configure the request
 	s.setupRequest(request, proxyConfig)
 
-	// Create a client with context
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	if err := s.limits.throttle(originalReq.Context(), request.URL.Hostname()); err != nil {
+		s.logger.Warning("Request to %v refused: %v", request.URL.Host, err)
+		writeRawLimitError(local, err)
+		return err
+	}
+
+	// The hijacked connection is not watched by the server anymore so a disconnect
+	// is detected by hand
+	ctx, cancel := context.WithCancel(originalReq.Context())
 	defer cancel()
 
-	client := s.createHTTPClient(proxyConfig)
+	if (request.Body == nil || request.Body == http.NoBody) && !isUpgrade(request) {
+		go watchDisconnect(reader.Reader, cancel)
+	}
 
-	// Remove service headers
+	// Refuse an upload above the limit before it is sent
+	upload, err := limitRequestBody(request, proxyConfig.maxRequestBody)
+	if err != nil {
+		s.logger.Error("Request rejected: %v", err)
+		fmt.Fprintf(local, HTTP_TOO_LARGE_RESPONSE, REQUEST_TOO_LARGE_MSG)
+		return err
+	}
+
+	// Fill in the browser headers of the profile, rewrite headers by the configured rules,
+	// then remove service headers
+	proxyConfig.userAgent = s.clientHints(request, proxyConfig)
+	s.config.HeaderRules.Request(request, proxyConfig.tlsSetup)
 	s.removeServiceHeaders(request, proxyConfig.nodeEscape)
 
+	if proxyConfig.http3 != core.HTTP3Off && !s.config.HTTP3GoHello {
+		s.logger.Warning("Request from %v refused: %v", originalReq.RemoteAddr, errHTTP3Hello)
+		fmt.Fprintf(local, HTTP_BAD_REQUEST_RESPONSE, HTTP3_HELLO_MSG)
+		return errHTTP3Hello
+	}
+
+	if report := s.checkConsistency(request, proxyConfig); report != nil {
+		fmt.Fprintf(local, HTTP_BAD_REQUEST_RESPONSE, INCONSISTENT_MSG+"\n"+report.String())
+		return errInconsistent
+	}
+
 	// Execute the request
-	resp, err := client.Do(request.WithContext(ctx))
-	if err != nil {
+	resp, stop, err := s.fetch(ctx, request, proxyConfig)
+	if err != nil && upload != nil && upload.exceeded.Load() {
+		err = errRequestTooLarge
+	}
+
+	switch err {
+	case nil:
+	case errRequestTooLarge:
+		s.logger.Error("Request rejected: %v", err)
+		fmt.Fprintf(local, HTTP_TOO_LARGE_RESPONSE, REQUEST_TOO_LARGE_MSG)
+		return err
+	case errTooManySessions, errInvalidSessionID:
+		s.logger.Error("Session %q rejected: %v", proxyConfig.session, err)
+		if err == errTooManySessions {
+			fmt.Fprintf(local, HTTP_UNAVAILABLE_RESPONSE, TOO_MANY_SESSIONS_MSG)
+		} else {
+			fmt.Fprintf(local, HTTP_BAD_REQUEST_RESPONSE, BAD_REQ_MSG)
+		}
+		return err
+	default:
+		if isLimited(err) {
+			s.logger.Warning("Request to %v refused: %v", request.URL.Host, err)
+			writeRawLimitError(local, err)
+			return err
+		}
+
+		if errors.Is(err, core.ErrDestinationDenied) {
+			s.logger.Warning("Request from %v refused: %v", originalReq.RemoteAddr, err)
+			fmt.Fprintf(local, HTTP_FORBIDDEN_RESPONSE, DESTINATION_DENIED_MSG)
+			return err
+		}
+
 		s.logger.Error("HTTP fetch error: %v", err)
 		fmt.Fprintf(local, HTTP_ERROR_RESPONSE, SERVER_REQUEST_ERROR_MSG)
 		return err
 	}
 
+	defer stop()
 	defer resp.Body.Close()
 
 	s.logger.Info("Response: %v %v %v %v", originalReq.RemoteAddr, originalReq.Method, originalReq.URL, resp.Status)
 
+	s.decorateResponse(resp, proxyConfig)
+
+	if upstream, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := writeResponseHead(local, resp); err != nil {
+			s.logger.Error("Error writing response: %v", err)
+			return err
+		}
+
+		s.relayWebSocket(local, reader.Reader, upstream, originalReq.RemoteAddr, request.URL.String())
+		return nil
+	}
+
+	if err := limitResponseBody(resp, proxyConfig.maxResponseBody); err != nil {
+		s.logger.Error("Response rejected: %v %v", request.URL, err)
+		fmt.Fprintf(local, HTTP_BAD_GATEWAY_RESPONSE, RESPONSE_TOO_LARGE_MSG)
+		return err
+	}
+
+	chunkTrailers(resp)
+
 	// Send response to client
 	if err := resp.Write(local); err != nil {
-		s.logger.Error("HTTP dump error: %v", err)
+		if !s.logCutResponse(originalReq.RemoteAddr, request.URL, proxyConfig.maxResponseBody, err) {
+			s.logger.Error("HTTP dump error: %v", err)
+		}
 		return err
 	}
 
@@ -241,6 +588,29 @@ type proxyConfig struct {
 	tlsSetup   string
 	tlsHash    string
 	userAgent  string
+	insecure   bool
+	peerChain  bool
+	fresh      bool
+	echConfig  []byte
+	echOff     bool
+	spec       core.SpecOptions
+	shuffle    bool
+	http3      core.HTTP3Mode
+	quic       *core.QUICOptions
+	resolve    map[string]string
+	bind       core.Bind
+	session    string
+	client     string
+	cookies    bool
+	redirect   redirectPolicy
+	retries    int
+	upstream   uint64
+	decompress core.DecompressMode
+	hints      core.ClientHintsMode
+	consistent core.ConsistencyMode
+
+	maxRequestBody  int64
+	maxResponseBody int64
 }
 
 func (s *ProxyHandler) extractProxyConfig(request *http.Request) proxyConfig {
@@ -249,24 +619,351 @@ func (s *ProxyHandler) extractProxyConfig(request *http.Request) proxyConfig {
 		scheme = DEFAULT_SCHEME
 	}
 
+	var echConfig []byte
+	ech := request.Header.Get("proxy-ech")
+	if ech != "" && ech != "off" {
+		configList, err := core.ParseECHConfigList(ech)
+		if err != nil {
+			s.logger.Warning("Ignoring proxy-ech header: %v", err)
+		}
+		echConfig = configList
+	}
+
+	tlsSetup := request.Header.Get("proxy-tls-setup")
+	tlsHash := request.Header.Get("proxy-tls")
+
+	spec := core.SpecOptions{
+		SignatureAlgorithms:  request.Header.Get("proxy-tls-sigalgs"),
+		DelegatedCredentials: request.Header.Get("proxy-tls-delegated-credentials"),
+		CertCompression:      request.Header.Get("proxy-tls-cert-compression"),
+		KeyShares:            request.Header.Get("proxy-tls-keyshares"),
+	}
+
+	shuffle := request.Header.Get("proxy-tls-shuffle")
+
+	var quic *core.QUICOptions
+
+	// Named profiles expand to their JA3 token, headers override profile fields
+	if profile := s.config.Profiles.Lookup(tlsSetup); profile != nil && tlsHash == "" {
+		tlsHash = profile.JA3
+		spec = profile.SpecOptions.Override(spec)
+
+		if shuffle == "" && profile.Shuffle {
+			shuffle = "true"
+		}
+
+		quic = profile.QUIC
+	}
+
+	http3 := core.HTTP3Off
+	if mode := request.Header.Get("proxy-http3"); strings.ToLower(mode) == "auto" {
+		http3 = core.HTTP3Auto
+	} else if isEnabled(mode) {
+		http3 = core.HTTP3Force
+	}
+
 	return proxyConfig{
 		scheme:     scheme,
 		downgrade:  request.Header.Get("proxy-downgrade") != "",
 		nodeEscape: request.Header.Get("proxy-node-escape"),
-		tlsSetup:   request.Header.Get("proxy-tls-setup"),
-		tlsHash:    request.Header.Get("proxy-tls"),
+		tlsSetup:   tlsSetup,
+		tlsHash:    tlsHash,
 		userAgent:  request.UserAgent(),
+		insecure:   request.Header.Get("proxy-insecure") != "",
+		peerChain:  request.Header.Get("proxy-tls-peer") != "",
+		fresh:      request.Header.Get("proxy-tls-fresh") != "",
+		echConfig:  echConfig,
+		echOff:     ech == "off",
+		spec:       spec,
+		shuffle:    isEnabled(shuffle),
+		http3:      http3,
+		quic:       quic,
+		resolve:    s.resolveOverrides(request.Header.Get("proxy-resolve")),
+		bind:       s.bind(request.Header.Get("proxy-bind")),
+		session:    request.Header.Get("proxy-session"),
+		cookies:    s.cookies(request.Header.Get("proxy-cookies")),
+		redirect:   s.redirectPolicy(request.Header.Get("proxy-redirect")),
+		retries:    s.retries(request.Header.Get("proxy-retries")),
+		upstream:   s.nextUpstream.Add(1) - 1,
+		decompress: s.decompress(request.Header.Get("proxy-decompress")),
+		hints:      s.clientHintsMode(request.Header.Get("proxy-client-hints")),
+		consistent: s.consistencyMode(request.Header.Get("proxy-consistency")),
+
+		maxRequestBody:  s.bodyLimit("proxy-max-request-body", request.Header.Get("proxy-max-request-body"), s.config.MaxRequestBody),
+		maxResponseBody: s.bodyLimit("proxy-max-response-body", request.Header.Get("proxy-max-response-body"), s.config.MaxResponseBody),
+	}
+}
+
+// resolveOverrides merges the comma separated proxy-resolve entries over the configured ones
+func (s *ProxyHandler) resolveOverrides(header string) map[string]string {
+	if header == "" {
+		return s.config.Resolve
+	}
+
+	overrides := make(map[string]string, len(s.config.Resolve))
+	for key, addr := range s.config.Resolve {
+		overrides[key] = addr
+	}
+
+	for _, entry := range strings.Split(header, ",") {
+		key, addr, err := core.ParseResolveOverride(entry)
+		if err != nil {
+			s.logger.Warning("Ignoring proxy-resolve entry: %v", err)
+			continue
+		}
+		overrides[key] = addr
+	}
+
+	return overrides
+}
+
+// bind selects the source address of a request, falling back to the configured mode
+func (s *ProxyHandler) bind(header string) core.Bind {
+	if header != "" && len(s.config.Upstreams) > 0 {
+		s.logger.Warning("Ignoring proxy-bind header: connections go through an upstream proxy")
+		return core.Bind{}
+	}
+
+	if header == "" {
+		header = s.config.BindMode
+	}
+
+	bind, err := core.ParseBind(header, s.config.Bind)
+	if err != nil {
+		s.logger.Warning("Ignoring proxy-bind header: %v", err)
+	}
+
+	return bind
+}
+
+// cookies reports whether the session keeps a cookie jar, the header overrides the default
+func (s *ProxyHandler) cookies(header string) bool {
+	if header == "" {
+		return s.config.CookieJar
+	}
+
+	return isEnabled(header)
+}
+
+// redirectPolicy parses the proxy-redirect header, falling back to the configured policy
+func (s *ProxyHandler) redirectPolicy(header string) redirectPolicy {
+	if header != "" {
+		policy, err := parseRedirectPolicy(header)
+		if err == nil {
+			return policy
+		}
+		s.logger.Warning("Ignoring proxy-redirect header: %v", err)
+	}
+
+	policy, _ := parseRedirectPolicy(s.config.Redirect)
+	return policy
+}
+
+// decompress parses the proxy-decompress header, falling back to the configured mode
+func (s *ProxyHandler) decompress(header string) core.DecompressMode {
+	if header == "" {
+		return s.config.Decompress
+	}
+
+	mode, err := core.ParseDecompressMode(header)
+	if err != nil {
+		s.logger.Warning("Ignoring proxy-decompress header: %v", err)
+		return s.config.Decompress
+	}
+
+	return mode
+}
+
+// clientHintsMode parses the proxy-client-hints header, falling back to the configured mode
+func (s *ProxyHandler) clientHintsMode(header string) core.ClientHintsMode {
+	if header == "" {
+		return s.config.ClientHints
+	}
+
+	mode, err := core.ParseClientHintsMode(header)
+	if err != nil {
+		s.logger.Warning("Ignoring proxy-client-hints header: %v", err)
+		return s.config.ClientHints
+	}
+
+	return mode
+}
+
+// clientHints adds the browser headers of the selected profile and warns about a User-Agent
+// that gives the profile away, it returns the User-Agent sent
+func (s *ProxyHandler) clientHints(request *http.Request, config proxyConfig) string {
+	identity := s.config.Profiles.Identity(config.tlsSetup)
+	if identity == nil {
+		return request.UserAgent()
+	}
+
+	if reason := identity.Contradicts(request.UserAgent()); reason != "" {
+		if config.hints == core.ClientHintsForce {
+			s.logger.Debug("Replacing User-Agent for proxy-tls-setup %q: %s", config.tlsSetup, reason)
+		} else {
+			s.logger.Warning("User-Agent contradicts proxy-tls-setup %q: %s", config.tlsSetup, reason)
+		}
+	}
+
+	core.ApplyClientHints(request, identity, config.hints, config.scheme == "https")
+	return request.UserAgent()
+}
+
+// consistencyMode parses the proxy-consistency header, a client can tighten the configured
+// mode but not loosen it
+func (s *ProxyHandler) consistencyMode(header string) core.ConsistencyMode {
+	if header == "" {
+		return s.config.Consistency
+	}
+
+	mode, err := core.ParseConsistencyMode(header)
+	if err != nil {
+		s.logger.Warning("Ignoring proxy-consistency header: %v", err)
+		return s.config.Consistency
 	}
+
+	return max(mode, s.config.Consistency)
+}
+
+// checkConsistency scores the fingerprint the request is about to be sent with and logs
+// what contradicts the claimed browser, it returns the report of a request strict mode rejects
+func (s *ProxyHandler) checkConsistency(request *http.Request, config proxyConfig) *core.ConsistencyReport {
+	if config.consistent == core.ConsistencyOff {
+		return nil
+	}
+
+	secure := config.scheme == "https"
+	report, err := core.CheckConsistency(core.Fingerprint{
+		Setup:       config.tlsSetup,
+		JA3:         config.tlsHash,
+		Spec:        config.spec,
+		Identity:    s.config.Profiles.Identity(config.tlsSetup),
+		Header:      request.Header,
+		HeaderOrder: request.HeaderOrder.Order,
+		PseudoOrder: request.PseudoOrder.Order,
+		Secure:      secure,
+		HTTP2:       secure && !config.downgrade && config.http3 != core.HTTP3Force,
+	})
+	if err != nil {
+		// The round tripper reports the same error when it builds the ClientHello
+		s.logger.Debug("Skipping consistency check of %v: %v", request.URL, err)
+		return nil
+	}
+
+	if len(report.Findings) == 0 {
+		return nil
+	}
+
+	summary := strings.TrimSpace(report.String())
+	summary = strings.ReplaceAll(strings.ReplaceAll(summary, "\n  ", ", "), "\n", "; ")
+	if config.consistent == core.ConsistencyStrict && report.Score < s.config.ConsistencyMinScore {
+		s.logger.Warning("Request to %v rejected as inconsistent: %s", request.URL.Host, summary)
+		return report
+	}
+
+	s.logger.Warning("Inconsistent fingerprint for %v: %s", request.URL.Host, summary)
+	return nil
 }
 
 func (s *ProxyHandler) setupRequest(request *http.Request, config proxyConfig) {
 	request.URL.Scheme = config.scheme
 }
 
-func (s *ProxyHandler) createHTTPClient(config proxyConfig) *http.Client {
-	return &http.Client{
-		Transport: core.NewRoundTripper(config.tlsHash, config.tlsSetup, config.userAgent, config.downgrade),
-		Timeout:   s.config.Timeout,
+// createHTTPClient builds the client of a request, a proxy-session reuses the round tripper
+// created by its first request and keeps cookies when its jar is on
+func (s *ProxyHandler) createHTTPClient(config proxyConfig, request *http.Request) (*http.Client, error) {
+	if config.session == "" {
+		if config.cookies {
+			s.logger.Warning("Ignoring proxy-cookies header without proxy-session")
+		}
+
+		return &http.Client{
+			Transport:     s.newRoundTripper(config),
+			CheckRedirect: config.redirect.checkRedirect,
+		}, nil
+	}
+
+	transport, jar, err := s.sticky.transport(config.session, config.client, config.cookies, func() http.RoundTripper {
+		return s.newRoundTripper(config)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: config.redirect.checkRedirect,
+	}
+
+	if jar != nil {
+		client.Jar = jar.Except(request)
+		core.PlaceCookieHeader(request)
+	}
+
+	return client, nil
+}
+
+func (s *ProxyHandler) newRoundTripper(config proxyConfig) http.RoundTripper {
+	return core.NewRoundTripper(core.Options{
+		JA3:       config.tlsHash,
+		Setup:     config.tlsSetup,
+		UserAgent: config.userAgent,
+		Downgrade: config.downgrade,
+		Spec:      config.spec,
+		Shuffle:   config.shuffle,
+		Verify:    s.config.Verify,
+		Insecure:  config.insecure,
+
+		Sessions:     s.sessions,
+		FreshSession: config.fresh,
+
+		ECH:           s.config.ECH,
+		ECHConfigList: config.echConfig,
+		DisableECH:    config.echOff,
+
+		HTTP3: config.http3,
+		QUIC:  config.quic,
+
+		Protocols: s.protocols,
+
+		Resolver: s.config.Resolver,
+		Resolve:  config.resolve,
+		Bind:     config.bind,
+		Upstream: s.upstream(config),
+
+		Breakers: s.breakers,
+		ACL:      s.config.ACL,
+	})
+}
+
+// upstream returns the upstream proxy of a request attempt, nil without upstreams
+func (s *ProxyHandler) upstream(config proxyConfig) *core.Upstream {
+	if len(s.config.Upstreams) == 0 {
+		return nil
+	}
+
+	return s.config.Upstreams[config.upstream%uint64(len(s.config.Upstreams))]
+}
+
+// decorateResponse decodes the upstream response when asked, rewrites its headers by the
+// configured rules and adds the requested service headers
+func (s *ProxyHandler) decorateResponse(resp *http.Response, config proxyConfig) {
+	if config.decompress == core.DecompressDecode {
+		core.DecodeResponse(resp)
+	}
+
+	if resp.Request != nil {
+		s.config.HeaderRules.Response(resp, resp.Request, config.tlsSetup)
+	}
+
+	if config.peerChain {
+		for _, cert := range core.PeerChainSummary(resp.TLS) {
+			resp.Header.Add(PEER_CHAIN_HEADER, cert)
+		}
+	}
+
+	for _, hop := range redirectChain(resp) {
+		resp.Header.Add(REDIRECT_CHAIN_HEADER, hop)
 	}
 }
 
@@ -278,6 +975,24 @@ func (s *ProxyHandler) removeServiceHeaders(request *http.Request, nodeEscape st
 	core.RemoveServiceHeaders(request, additional)
 }
 
+// watchDisconnect cancels the upstream request once the client closes its side of
+// the tunnel, it must not run while the request body is still being read
+func watchDisconnect(reader *bufio.Reader, cancel context.CancelFunc) {
+	if _, err := reader.Peek(1); err != nil {
+		cancel()
+	}
+}
+
+// isEnabled reports whether a service header turns an option on, "false", "0" and "off" turn it off
+func isEnabled(value string) bool {
+	switch strings.ToLower(value) {
+	case "", "false", "0", "off":
+		return false
+	default:
+		return true
+	}
+}
+
 func (s *ProxyHandler) isSchemeAllowed(scheme string) bool {
 	for _, allowed := range s.config.AllowedSchemes {
 		if scheme == allowed {
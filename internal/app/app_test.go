@@ -0,0 +1,147 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/httptest"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+func TestConsistencyModeOnlyTightens(t *testing.T) {
+	tests := []struct {
+		configured core.ConsistencyMode
+		header     string
+		want       core.ConsistencyMode
+	}{
+		{core.ConsistencyOff, "", core.ConsistencyOff},
+		{core.ConsistencyOff, "strict", core.ConsistencyStrict},
+		{core.ConsistencyWarn, "strict", core.ConsistencyStrict},
+		{core.ConsistencyWarn, "off", core.ConsistencyWarn},
+		{core.ConsistencyStrict, "warn", core.ConsistencyStrict},
+		{core.ConsistencyStrict, "off", core.ConsistencyStrict},
+		{core.ConsistencyWarn, "lenient", core.ConsistencyWarn},
+	}
+
+	for _, tt := range tests {
+		s := &ProxyHandler{
+			config: &Config{Consistency: tt.configured},
+			logger: core.NewCondLogger(log.New(io.Discard, "", 0), core.DEBUG),
+		}
+
+		if got := s.consistencyMode(tt.header); got != tt.want {
+			t.Errorf("mode %d with header %q = %d, want %d", tt.configured, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDisconnectStopsStalledHandshake(t *testing.T) {
+	for _, tunnel := range []bool{false, true} {
+		name := "HandleHTTP"
+		if tunnel {
+			name = "tunnel"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Timeout = time.Minute
+
+			proxy := startProxy(t, config)
+			origin := startStalledOrigin(t)
+
+			client, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if tunnel {
+				fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", origin.addr, origin.addr)
+
+				status, err := bufio.NewReader(client).ReadString('\n')
+				if err != nil || !strings.Contains(status, "200") {
+					t.Fatalf("CONNECT status = %q (%v)", status, err)
+				}
+
+				fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", origin.addr)
+			} else {
+				fmt.Fprintf(client, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.addr, origin.addr)
+			}
+
+			// The origin takes the connection but never answers the ClientHello
+			select {
+			case <-origin.accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the proxy never dialed the origin")
+			}
+
+			client.Close()
+			origin.waitClosed(t, 2*time.Second)
+
+			// Retries must not dial again for the client that left
+			select {
+			case <-origin.accepted:
+				t.Fatal("the proxy dialed the origin again after the client went away")
+			case <-time.After(300 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestDecompressModes(t *testing.T) {
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	_, _ = writer.Write([]byte("compressed body"))
+	_ = writer.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(gzipped.Len()))
+		_, _ = w.Write(gzipped.Bytes())
+	}))
+	defer origin.Close()
+
+	proxy := startProxy(t, DefaultConfig())
+
+	for _, mode := range []string{"", "passthrough", "decode"} {
+		client, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		host := strings.TrimPrefix(origin.URL, "http://")
+		fmt.Fprintf(client, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\nProxy-Protocol: http\r\nProxy-Decompress: %s\r\n\r\n", host, host, mode)
+
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mode == "decode" {
+			if string(body) != "compressed body" || resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("decoded response = %q with Content-Encoding %q", body, resp.Header.Get("Content-Encoding"))
+			}
+			continue
+		}
+
+		if !bytes.Equal(body, gzipped.Bytes()) || resp.Header.Get("Content-Encoding") != "gzip" || resp.ContentLength != int64(gzipped.Len()) {
+			t.Errorf("mode %q changed the response: %d bytes, Content-Encoding %q, Content-Length %d",
+				mode, len(body), resp.Header.Get("Content-Encoding"), resp.ContentLength)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http/httptest"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+// startProxy serves a ProxyHandler with the config on a local listener and returns its address
+func startProxy(t *testing.T, config *Config) string {
+	t.Helper()
+
+	handler := NewProxyHandler(config, core.NewCondLogger(log.New(io.Discard, "", 0), core.DEBUG))
+	t.Cleanup(handler.Close)
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// stalledOrigin accepts connections and never answers, closed receives the time every
+// connection was closed by the proxy
+type stalledOrigin struct {
+	addr     string
+	accepted chan struct{}
+	closed   chan time.Time
+}
+
+func startStalledOrigin(t *testing.T) *stalledOrigin {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	origin := &stalledOrigin{
+		addr:     listener.Addr().String(),
+		accepted: make(chan struct{}, 8),
+		closed:   make(chan time.Time, 8),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			origin.accepted <- struct{}{}
+			go func() {
+				defer conn.Close()
+
+				_, _ = io.Copy(io.Discard, conn)
+				origin.closed <- time.Now()
+			}()
+		}
+	}()
+
+	return origin
+}
+
+// waitClosed fails unless the proxy drops its connection to the origin within limit
+func (o *stalledOrigin) waitClosed(t *testing.T, limit time.Duration) {
+	t.Helper()
+
+	select {
+	case <-o.closed:
+	case <-time.After(limit):
+		t.Fatalf("origin connection still open %v after the client went away", limit)
+	}
+}
@@ -0,0 +1,322 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+// Host buckets kept before full ones, then the least recently used one, are dropped
+const MAX_RATE_BUCKETS = 4096
+
+var (
+	errTooManyInFlight = errors.New("too many requests in flight")
+	errTooManyClient   = errors.New("too many connections from client")
+	errHostRate        = errors.New("host request rate exceeded")
+)
+
+// limitError is a refused request with the delay the client is told to wait
+type limitError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string { return e.err.Error() }
+func (e *limitError) Unwrap() error { return e.err }
+
+// status is 503 when the proxy as a whole is full or the origin is cut off by its circuit
+// breaker and 429 when one client or host is over its limit
+func (e *limitError) status() int {
+	var open *core.CircuitOpenError
+	if e.err == errTooManyInFlight || errors.As(e.err, &open) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusTooManyRequests
+}
+
+func (e *limitError) message() string {
+	var open *core.CircuitOpenError
+	if errors.As(e.err, &open) {
+		return CIRCUIT_OPEN_MSG
+	}
+
+	return LIMITED_MSG
+}
+
+// retryAfterSeconds is the Retry-After value, at least one second
+func (e *limitError) retryAfterSeconds() int {
+	return max(1, int(math.Ceil(e.retryAfter.Seconds())))
+}
+
+// limiter holds the in-flight, per-client and per-host limits, a request waits for a slot
+// or a token up to the wait deadline and is refused after it
+type limiter struct {
+	wait time.Duration
+
+	inFlight chan struct{}
+	clients  *keyedSemaphore
+	hosts    *rateBuckets
+}
+
+func newLimiter(config *Config) *limiter {
+	l := &limiter{wait: config.LimitWait}
+
+	if config.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, config.MaxInFlight)
+	}
+
+	if config.MaxClientConns > 0 {
+		l.clients = &keyedSemaphore{max: config.MaxClientConns, active: make(map[string]int), released: make(map[string]chan struct{})}
+	}
+
+	if config.HostRate > 0 {
+		l.hosts = &rateBuckets{rate: config.HostRate, burst: float64(max(1, config.HostBurst)), buckets: make(map[string]*rateBucket)}
+	}
+
+	return l
+}
+
+// acquire takes an in-flight slot and a slot of the client address, release gives both back
+func (l *limiter) acquire(ctx context.Context, remoteAddr string) (release func(), err error) {
+	if l.inFlight == nil && l.clients == nil {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+
+	client := clientIP(remoteAddr)
+
+	if l.clients != nil {
+		if err := l.clients.acquire(ctx, client); err != nil {
+			return nil, &limitError{err: errTooManyClient, retryAfter: l.wait}
+		}
+	}
+
+	if l.inFlight != nil && !take(ctx, l.inFlight) {
+		if l.clients != nil {
+			l.clients.release(client)
+		}
+		return nil, &limitError{err: errTooManyInFlight, retryAfter: l.wait}
+	}
+
+	return func() {
+		if l.inFlight != nil {
+			<-l.inFlight
+		}
+		if l.clients != nil {
+			l.clients.release(client)
+		}
+	}, nil
+}
+
+// throttle waits for a request token of host, a wait beyond the deadline is refused with
+// the time until a token is free
+func (l *limiter) throttle(ctx context.Context, host string) error {
+	if l.hosts == nil {
+		return nil
+	}
+
+	delay, ok := l.hosts.reserve(strings.ToLower(host), l.wait)
+	if !ok {
+		return &limitError{err: errHostRate, retryAfter: delay}
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The request is not sent, its token goes to the next one
+		l.hosts.refund(strings.ToLower(host))
+		return ctx.Err()
+	}
+}
+
+// take puts a token into the semaphore ch, a free slot wins over an ended wait
+func take(ctx context.Context, ch chan struct{}) bool {
+	select {
+	case ch <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case ch <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// writeLimitError answers a refused request with its status and Retry-After, a request whose
+// client went away while waiting gets nothing
+func writeLimitError(wr http.ResponseWriter, err error) {
+	var limited *limitError
+	if !errors.As(err, &limited) {
+		return
+	}
+
+	wr.Header().Set("Retry-After", strconv.Itoa(limited.retryAfterSeconds()))
+	http.Error(wr, limited.message(), limited.status())
+}
+
+// writeRawLimitError is writeLimitError for a hijacked connection
+func writeRawLimitError(w io.Writer, err error) {
+	var limited *limitError
+	if !errors.As(err, &limited) {
+		return
+	}
+
+	fmt.Fprintf(w, HTTP_LIMITED_RESPONSE, limited.status(), http.StatusText(limited.status()), limited.retryAfterSeconds(), limited.message())
+}
+
+// isLimited reports whether err refused a request with a Retry-After
+func isLimited(err error) bool {
+	var limited *limitError
+	return errors.As(err, &limited)
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+
+	return host
+}
+
+// keyedSemaphore allows max holders per key, waiters are woken on every release of their key
+type keyedSemaphore struct {
+	sync.Mutex
+	max      int
+	active   map[string]int
+	released map[string]chan struct{}
+}
+
+func (k *keyedSemaphore) acquire(ctx context.Context, key string) error {
+	for {
+		k.Lock()
+		if k.active[key] < k.max {
+			k.active[key]++
+			k.Unlock()
+			return nil
+		}
+
+		ch, ok := k.released[key]
+		if !ok {
+			ch = make(chan struct{})
+			k.released[key] = ch
+		}
+		k.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (k *keyedSemaphore) release(key string) {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.active[key]--; k.active[key] <= 0 {
+		delete(k.active, key)
+	}
+
+	if ch, ok := k.released[key]; ok {
+		close(ch)
+		delete(k.released, key)
+	}
+}
+
+// rateBuckets are token buckets per host, filled at rate tokens per second up to burst
+type rateBuckets struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token of host, going into debt when none is left; the returned delay is
+// how long the caller waits for its token. A delay above maxWait reserves nothing
+func (r *rateBuckets) reserve(host string, maxWait time.Duration) (time.Duration, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	bucket, ok := r.buckets[host]
+	if !ok {
+		if len(r.buckets) >= MAX_RATE_BUCKETS {
+			r.prune(now)
+		}
+
+		bucket = &rateBucket{tokens: r.burst, last: now}
+		r.buckets[host] = bucket
+	}
+
+	bucket.tokens = math.Min(r.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*r.rate)
+	bucket.last = now
+
+	delay := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+	if delay > maxWait {
+		return delay, false
+	}
+
+	bucket.tokens--
+	return delay, true
+}
+
+// refund gives back the token a request reserved but did not use
+func (r *rateBuckets) refund(host string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if bucket, ok := r.buckets[host]; ok {
+		bucket.tokens = math.Min(r.burst, bucket.tokens+1)
+	}
+}
+
+// prune drops the buckets that are full again, and the least recently used one when that
+// leaves no room; the lock must be held
+func (r *rateBuckets) prune(now time.Time) {
+	var oldest string
+	for host, bucket := range r.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, host)
+			continue
+		}
+
+		if oldest == "" || bucket.last.Before(r.buckets[oldest].last) {
+			oldest = host
+		}
+	}
+
+	if len(r.buckets) >= MAX_RATE_BUCKETS {
+		delete(r.buckets, oldest)
+	}
+}
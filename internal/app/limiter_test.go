@@ -0,0 +1,256 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/httptest"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+func TestKeyedSemaphore(t *testing.T) {
+	sem := &keyedSemaphore{max: 1, active: make(map[string]int), released: make(map[string]chan struct{})}
+
+	if err := sem.acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another key has slots of its own
+	if err := sem.acquire(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sem.acquire(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire over the limit = %v, want the deadline", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- sem.acquire(context.Background(), "a") }()
+
+	select {
+	case <-acquired:
+		t.Fatal("a waiter got a slot before the release")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sem.release("a")
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the release did not wake the waiter")
+	}
+
+	sem.release("a")
+	sem.release("b")
+
+	sem.Lock()
+	defer sem.Unlock()
+	if len(sem.active) != 0 || len(sem.released) != 0 {
+		t.Fatalf("released semaphore keeps %v and %d wait channels", sem.active, len(sem.released))
+	}
+}
+
+func TestTake(t *testing.T) {
+	ch := make(chan struct{}, 1)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A free slot wins over an ended wait
+	if !take(canceled, ch) {
+		t.Fatal("take refused a free slot")
+	}
+	if take(canceled, ch) {
+		t.Fatal("take got a slot of a full semaphore")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-ch
+	}()
+	if !take(context.Background(), ch) {
+		t.Fatal("take did not wait for the slot")
+	}
+}
+
+func TestRateBucketsReserve(t *testing.T) {
+	buckets := &rateBuckets{rate: 2, burst: 3, buckets: make(map[string]*rateBucket)}
+
+	// The burst goes through at once
+	for i := 0; i < 3; i++ {
+		if delay, ok := buckets.reserve("example.com", 0); !ok || delay > 0 {
+			t.Fatalf("request %d of the burst = %v, %t", i, delay, ok)
+		}
+	}
+
+	// Then every request waits for the tokens reserved before it
+	delay, ok := buckets.reserve("example.com", time.Second)
+	if !ok || delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Fatalf("first debt delay = %v, %t, want about 500ms", delay, ok)
+	}
+
+	delay, ok = buckets.reserve("example.com", time.Second)
+	if !ok || delay < 900*time.Millisecond || delay > time.Second {
+		t.Fatalf("second debt delay = %v, %t, want about 1s", delay, ok)
+	}
+
+	// A wait over the limit reserves nothing
+	for i := 0; i < 2; i++ {
+		if delay, ok = buckets.reserve("example.com", time.Second); ok || delay < 1400*time.Millisecond {
+			t.Fatalf("refused delay = %v, %t, want about 1.5s and no token", delay, ok)
+		}
+	}
+
+	if delay, ok := buckets.reserve("other.com", 0); !ok || delay > 0 {
+		t.Fatalf("another host = %v, %t, want a token of its own", delay, ok)
+	}
+}
+
+func TestThrottleRefundsCanceledWait(t *testing.T) {
+	l := newLimiter(&Config{HostRate: 1, HostBurst: 1, LimitWait: 5 * time.Second})
+
+	if err := l.throttle(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.throttle(ctx, "Example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("canceled wait = %v", err)
+	}
+
+	// The next request only waits for its own token
+	delay, ok := l.hosts.reserve("example.com", time.Minute)
+	if !ok || delay > time.Second {
+		t.Fatalf("delay after a canceled wait = %v, want at most 1s", delay)
+	}
+}
+
+func TestRateBucketsPruneOldest(t *testing.T) {
+	buckets := &rateBuckets{rate: 0.001, burst: 1, buckets: make(map[string]*rateBucket)}
+
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < MAX_RATE_BUCKETS; i++ {
+		buckets.buckets[fmt.Sprintf("host%d", i)] = &rateBucket{tokens: -1, last: start.Add(time.Duration(i) * time.Millisecond)}
+	}
+
+	// A bucket that filled up again goes first
+	buckets.buckets["host7"].tokens = 1
+	buckets.reserve("new1.com", 0)
+	if _, ok := buckets.buckets["host7"]; ok || len(buckets.buckets) != MAX_RATE_BUCKETS {
+		t.Fatalf("full bucket kept, %d buckets", len(buckets.buckets))
+	}
+
+	// Without one the least recently used bucket makes room
+	buckets.reserve("new2.com", 0)
+	if _, ok := buckets.buckets["host0"]; ok || len(buckets.buckets) != MAX_RATE_BUCKETS {
+		t.Fatalf("oldest bucket kept, %d buckets", len(buckets.buckets))
+	}
+	if _, ok := buckets.buckets["host1"]; !ok {
+		t.Fatal("a newer bucket was dropped")
+	}
+}
+
+func TestAcquireInFlight(t *testing.T) {
+	l := newLimiter(&Config{MaxInFlight: 1, MaxClientConns: 1, LimitWait: 50 * time.Millisecond})
+
+	release, err := l.acquire(context.Background(), "192.0.2.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.acquire(context.Background(), "192.0.2.1:2000")
+	if !errors.Is(err, errTooManyClient) {
+		t.Fatalf("second request of the client = %v, want %v", err, errTooManyClient)
+	}
+
+	_, err = l.acquire(context.Background(), "192.0.2.2:1000")
+	if !errors.Is(err, errTooManyInFlight) {
+		t.Fatalf("request of another client = %v, want %v", err, errTooManyInFlight)
+	}
+
+	release()
+
+	release, err = l.acquire(context.Background(), "192.0.2.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestWriteLimitError(t *testing.T) {
+	tests := []struct {
+		err        error
+		status     int
+		retryAfter string
+		message    string
+	}{
+		{&limitError{err: errHostRate, retryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests, "2", LIMITED_MSG},
+		{&limitError{err: errTooManyClient, retryAfter: 0}, http.StatusTooManyRequests, "1", LIMITED_MSG},
+		{&limitError{err: errTooManyInFlight, retryAfter: 5 * time.Second}, http.StatusServiceUnavailable, "5", LIMITED_MSG},
+		{&limitError{err: &core.CircuitOpenError{Origin: "https://example.com:443", RetryAfter: 30 * time.Second}, retryAfter: 30 * time.Second}, http.StatusServiceUnavailable, "30", CIRCUIT_OPEN_MSG},
+		{fmt.Errorf("fetch: %w", &limitError{err: errHostRate, retryAfter: time.Second}), http.StatusTooManyRequests, "1", LIMITED_MSG},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		writeLimitError(recorder, tt.err)
+
+		if recorder.Code != tt.status || recorder.Header().Get("Retry-After") != tt.retryAfter || strings.TrimSpace(recorder.Body.String()) != tt.message {
+			t.Errorf("%v = %d, Retry-After %q, %q", tt.err, recorder.Code, recorder.Header().Get("Retry-After"), recorder.Body.String())
+		}
+
+		var raw strings.Builder
+		writeRawLimitError(&raw, tt.err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw.String())), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status || resp.Header.Get("Retry-After") != tt.retryAfter {
+			t.Errorf("raw %v = %d, Retry-After %q", tt.err, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// A client that went away while waiting gets nothing
+	recorder := httptest.NewRecorder()
+	writeLimitError(recorder, context.Canceled)
+	if recorder.Body.Len() != 0 || recorder.Header().Get("Retry-After") != "" {
+		t.Fatal("a canceled wait got an answer")
+	}
+}
+
+func TestHostRateThroughProxy(t *testing.T) {
+	origin := startStreamOrigin(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	config := DefaultConfig()
+	config.HostRate = 1
+	config.HostBurst = 2
+	config.LimitWait = 0
+	proxy := startProxy(t, config)
+
+	// The burst goes through, then both the direct and the tunnel path refuse
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		resp := proxyGet(t, proxy, origin, i == 3, "")
+		resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Fatalf("request %d = %d, want %d", i, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "1" {
+			t.Fatalf("request %d Retry-After = %q, want 1", i, resp.Header.Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Kolosok86/http"
+)
+
+var (
+	errRequestTooLarge  = errors.New("request body too large")
+	errResponseTooLarge = errors.New("response body too large")
+)
+
+// bodyLimit parses a proxy-max-*-body header, a client can lower the configured limit but
+// not raise it; zero means no limit
+func (s *ProxyHandler) bodyLimit(name, header string, limit int64) int64 {
+	if header == "" {
+		return limit
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(header), 10, 64)
+	if err != nil || n <= 0 {
+		s.logger.Warning("Ignoring %s header: invalid size %q", name, header)
+		return limit
+	}
+
+	if limit > 0 && n > limit {
+		return limit
+	}
+
+	return n
+}
+
+// limitRequestBody caps the body of request at limit bytes, an announced length above it is
+// refused right away with errRequestTooLarge; the returned body reports a cut upload
+func limitRequestBody(request *http.Request, limit int64) (*limitedBody, error) {
+	if limit <= 0 || request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+
+	if request.ContentLength > limit {
+		return nil, errRequestTooLarge
+	}
+
+	body := &limitedBody{ReadCloser: request.Body, remaining: limit, err: errRequestTooLarge}
+	request.Body = body
+
+	return body, nil
+}
+
+// limitResponseBody caps the body of resp at limit bytes, an announced length above it is
+// refused with errResponseTooLarge before anything reaches the client and a longer stream
+// fails with it when read
+func limitResponseBody(resp *http.Response, limit int64) error {
+	if limit <= 0 || resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return nil
+	}
+
+	if resp.ContentLength > limit {
+		return errResponseTooLarge
+	}
+
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit, err: errResponseTooLarge}
+
+	// Chunked framing makes a cut body visible to clients of Response.Write
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+
+	return nil
+}
+
+// logCutResponse reports whether err is a response that outgrew its limit while streaming,
+// those get their own log entry with the limit so they are not mistaken for origin failures
+func (s *ProxyHandler) logCutResponse(remoteAddr string, url fmt.Stringer, limit int64, err error) bool {
+	if !errors.Is(err, errResponseTooLarge) {
+		return false
+	}
+
+	s.logger.Warning("Response cut: %v %v reason=response-too-large limit=%d", remoteAddr, url, limit)
+	return true
+}
+
+// limitedBody fails with err once more than remaining bytes were read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+	exceeded  atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded.Load() {
+		return 0, b.err
+	}
+
+	// One byte more than allowed tells a body that ends at the limit from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded.Store(true)
+		return int(b.remaining), b.err
+	}
+
+	b.remaining -= int64(n)
+	return n, err
+}
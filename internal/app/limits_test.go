@@ -0,0 +1,55 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+func TestResponseCutAtLimit(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/stream", nil)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: -1,
+		Body:          io.NopCloser(strings.NewReader(strings.Repeat("x", 64))),
+		Request:       req,
+	}
+
+	if err := limitResponseBody(resp, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err := resp.Write(&out)
+	if !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("write error = %v, want %v", err, errResponseTooLarge)
+	}
+
+	// The cut chunked body never gets its last chunk
+	if strings.HasSuffix(out.String(), "0\r\n\r\n") {
+		t.Fatalf("cut body looks complete: %q", out.String())
+	}
+
+	var logs bytes.Buffer
+	s := &ProxyHandler{logger: core.NewCondLogger(log.New(&logs, "", 0), core.DEBUG)}
+
+	if !s.logCutResponse("192.0.2.1:4000", req.URL, 16, err) {
+		t.Fatal("cut response was not reported")
+	}
+	if want := "[WARNING] Response cut: 192.0.2.1:4000 http://example.com/stream reason=response-too-large limit=16"; strings.TrimSpace(logs.String()) != want {
+		t.Fatalf("log = %q, want %q", logs.String(), want)
+	}
+
+	if s.logCutResponse("192.0.2.1:4000", req.URL, 16, io.ErrUnexpectedEOF) {
+		t.Fatal("an origin failure was reported as a cut response")
+	}
+}
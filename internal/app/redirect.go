@@ -0,0 +1,140 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Kolosok86/http"
+)
+
+// Redirects followed by "follow" and "same-origin" without an explicit limit
+const DEFAULT_MAX_REDIRECTS = 10
+
+type redirectMode int
+
+const (
+	// redirectFollow follows up to max redirects to any origin
+	redirectFollow redirectMode = iota
+	// redirectPassthrough hands every redirect to the client
+	redirectPassthrough
+	// redirectSameOrigin follows redirects while they stay on the origin of the request
+	redirectSameOrigin
+)
+
+type redirectPolicy struct {
+	mode redirectMode
+	max  int
+}
+
+// parseRedirectPolicy reads "passthrough", "follow", "follow=N", "N" or "same-origin[=N]"
+func parseRedirectPolicy(value string) (redirectPolicy, error) {
+	name, limit, hasLimit := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "=")
+	policy := redirectPolicy{max: DEFAULT_MAX_REDIRECTS}
+
+	if n, err := strconv.Atoi(name); err == nil && !hasLimit {
+		name, limit, hasLimit = "follow", strconv.Itoa(n), true
+	}
+
+	switch name {
+	case "", "follow":
+		policy.mode = redirectFollow
+	case "passthrough", "off":
+		return redirectPolicy{mode: redirectPassthrough}, nil
+	case "same-origin":
+		policy.mode = redirectSameOrigin
+	default:
+		return policy, fmt.Errorf("invalid redirect policy %q", value)
+	}
+
+	if hasLimit {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid redirect limit %q", value)
+		}
+		policy.max = n
+	}
+
+	return policy, nil
+}
+
+// ValidateRedirectPolicy reports whether value is a valid proxy-redirect policy
+func ValidateRedirectPolicy(value string) error {
+	_, err := parseRedirectPolicy(value)
+	return err
+}
+
+// checkRedirect decides on every hop, the redirect the policy does not follow is returned
+// to the client as is. Followed hops keep the header order of the client request and send
+// its referrer as a browser would to the new URL, instead of Go's defaults
+func (p redirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	first := via[0]
+
+	if p.mode == redirectPassthrough || len(via) > p.max {
+		return http.ErrUseLastResponse
+	}
+
+	if p.mode == redirectSameOrigin && origin(req.URL) != origin(first.URL) {
+		return http.ErrUseLastResponse
+	}
+
+	req.HeaderOrder.Order = append([]string(nil), first.HeaderOrder.Order...)
+	req.PseudoOrder.Order = append([]string(nil), first.PseudoOrder.Order...)
+
+	if referer := hopReferrer(first.Header.Get("Referer"), req.URL); referer != "" {
+		req.Header.Set("Referer", referer)
+	} else {
+		req.Header.Del("Referer")
+	}
+
+	return nil
+}
+
+// hopReferrer applies the default browser referrer policy, strict-origin-when-cross-origin,
+// to referer for a request to target: the full URL on the same origin, only the origin on
+// another one and nothing from https to http
+func hopReferrer(referer string, target *url.URL) string {
+	ref, err := url.Parse(referer)
+	if err != nil || ref.Host == "" {
+		return ""
+	}
+
+	if strings.EqualFold(ref.Scheme, "https") && !strings.EqualFold(target.Scheme, "https") {
+		return ""
+	}
+
+	if origin(ref) != origin(target) {
+		return (&url.URL{Scheme: ref.Scheme, Host: ref.Host, Path: "/"}).String()
+	}
+
+	ref.User, ref.Fragment, ref.RawFragment = nil, "", ""
+	return ref.String()
+}
+
+func origin(u *url.URL) string {
+	scheme, port := strings.ToLower(u.Scheme), u.Port()
+	if port == "" && scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// redirectChain lists the followed redirects of a response as "status url", oldest first
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		hop := req.Response
+		if hop.Request == nil {
+			break
+		}
+
+		chain = append([]string{fmt.Sprintf("%d %s", hop.StatusCode, hop.Request.URL)}, chain...)
+	}
+
+	return chain
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+// Upper bound of proxy-retries
+const MAX_RETRIES = 10
+
+// doWithRetries sends request and retries transient connection failures of idempotent
+// requests with exponential backoff and jitter, every retry moves to the next upstream
+// proxy unless a sticky session pins it
+func (s *ProxyHandler) doWithRetries(ctx context.Context, request *http.Request, config proxyConfig) (*http.Response, error) {
+	retries := config.retries
+	if retries > 0 && (!isIdempotent(request) || !replayableBody(request, s.config.RetryBodyLimit)) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		client, err := s.createHTTPClient(config, request)
+		if err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := client.Do(request.WithContext(ctx))
+		if err == nil || attempt >= retries || ctx.Err() != nil || !core.IsRetryable(err) {
+			return resp, err
+		}
+
+		delay := s.backoff(attempt)
+		s.logger.Warning("Retrying %v %v in %v (%d of %d): %v", request.Method, request.URL, delay, attempt+1, retries, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+
+		config.upstream++
+	}
+}
+
+// backoff doubles the base delay per attempt up to the maximum, half of it is random
+func (s *ProxyHandler) backoff(attempt int) time.Duration {
+	delay := s.config.RetryBackoff << attempt
+	if delay <= 0 || delay > s.config.RetryMaxBackoff {
+		delay = s.config.RetryMaxBackoff
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retries parses the proxy-retries header, "0" or "off" disables retries
+func (s *ProxyHandler) retries(header string) int {
+	if header == "" {
+		return s.config.Retries
+	}
+
+	if !isEnabled(header) {
+		return 0
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || n < 0 {
+		s.logger.Warning("Ignoring proxy-retries header: invalid value %q", header)
+		return s.config.Retries
+	}
+
+	return min(n, MAX_RETRIES)
+}
+
+// isIdempotent reports whether sending request twice is safe by method or by an idempotency key
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return request.Header.Get("Idempotency-Key") != "" || request.Header.Get("X-Idempotency-Key") != ""
+}
+
+// replayableBody buffers a request body of up to limit bytes so it can be sent again,
+// a larger body is streamed as is and makes the request not replayable
+func replayableBody(request *http.Request, limit int64) bool {
+	if request.Body == nil || request.Body == http.NoBody || request.GetBody != nil {
+		return true
+	}
+
+	if limit <= 0 || request.ContentLength > limit {
+		return false
+	}
+
+	body := request.Body
+	buf, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+		return false
+	}
+
+	_ = body.Close()
+
+	request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	request.Body, _ = request.GetBody()
+
+	return true
+}
@@ -0,0 +1,311 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+const MAX_SESSION_ID_LENGTH = 128
+
+// STICKY_SWEEP_INTERVAL is how often expired sessions are dropped and idle connections of
+// unused sessions closed
+const STICKY_SWEEP_INTERVAL = 30 * time.Second
+
+var (
+	errTooManySessions  = errors.New("too many sticky sessions")
+	errInvalidSessionID = errors.New("invalid proxy-session id")
+)
+
+// stickySessions pins client chosen session ids to one round tripper, so requests of a
+// session share upstream connections, source address, TLS sessions and optionally cookies.
+// Sessions are keyed by id and client, see sessionKey, so clients cannot use each other's
+type stickySessions struct {
+	sync.Mutex
+
+	ttl      time.Duration
+	max      int
+	sessions map[string]*stickySession
+
+	// done stops the sweep
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type stickySession struct {
+	id     string
+	client string
+	// transport is nil for a session created by a cookie import until its first request
+	transport http.RoundTripper
+	jar       *core.CookieJar
+	created   time.Time
+	lastUsed  time.Time
+	requests  int
+}
+
+// SessionInfo describes a sticky session in the admin API, which addresses it by Key
+type SessionInfo struct {
+	Key      string    `json:"key"`
+	ID       string    `json:"id"`
+	Client   string    `json:"client"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Expires  time.Time `json:"expires"`
+	Requests int       `json:"requests"`
+	Cookies  int       `json:"cookies"`
+}
+
+func newStickySessions(ttl time.Duration, max int) *stickySessions {
+	return &stickySessions{
+		ttl:      ttl,
+		max:      max,
+		sessions: make(map[string]*stickySession),
+		done:     make(chan struct{}),
+	}
+}
+
+// sessionClient identifies the client a proxy-session id belongs to: its Proxy-Authorization
+// credentials, or its address without them
+func sessionClient(req *http.Request) string {
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "auth:" + hex.EncodeToString(sum[:8])
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// sessionKey is the key of session id of client, "id@client"
+func sessionKey(id, client string) string {
+	return id + "@" + client
+}
+
+// parseSessionKey splits a session key, the client never contains "@"
+func parseSessionKey(key string) (string, string, error) {
+	i := strings.LastIndexByte(key, '@')
+	if i < 0 || !validSessionID(key[:i]) || i == len(key)-1 {
+		return "", "", errInvalidSessionID
+	}
+
+	return key[:i], key[i+1:], nil
+}
+
+func validSessionID(id string) bool {
+	return id != "" && len(id) <= MAX_SESSION_ID_LENGTH
+}
+
+// transport returns the round tripper and cookie jar of session id of client, creating the
+// round tripper with create on the first request, which turns the jar on with cookies
+func (s *stickySessions) transport(id, client string, cookies bool, create func() http.RoundTripper) (http.RoundTripper, *core.CookieJar, error) {
+	if !validSessionID(id) {
+		return nil, nil, errInvalidSessionID
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	session, err := s.session(id, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first request decides, like for the fingerprint
+	if session.transport == nil {
+		session.transport = create()
+
+		if cookies && session.jar == nil {
+			session.jar = core.NewCookieJar()
+		}
+	}
+
+	session.requests++
+
+	return session.transport, session.jar, nil
+}
+
+// cookieJar returns the jar of the session with key, with create it turns the jar on and starts
+// the session when needed so cookies can be imported before the first request
+func (s *stickySessions) cookieJar(key string, create bool) (*core.CookieJar, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !create {
+		session, ok := s.sessions[key]
+		if !ok || s.expired(session, time.Now()) || session.jar == nil {
+			return nil, nil
+		}
+
+		return session.jar, nil
+	}
+
+	id, client, err := parseSessionKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.session(id, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.jar == nil {
+		session.jar = core.NewCookieJar()
+	}
+
+	return session.jar, nil
+}
+
+// session returns the live session id of client and marks it used, starting it when the
+// cap allows; the lock must be held
+func (s *stickySessions) session(id, client string) (*stickySession, error) {
+	key := sessionKey(id, client)
+
+	now := time.Now()
+	session, ok := s.sessions[key]
+	if ok && s.expired(session, now) {
+		s.remove(key)
+		ok = false
+	}
+
+	if !ok {
+		if s.max > 0 && len(s.sessions) >= s.max {
+			s.prune(now)
+		}
+
+		if s.max > 0 && len(s.sessions) >= s.max {
+			return nil, errTooManySessions
+		}
+
+		session = &stickySession{id: id, client: client, created: now}
+		s.sessions[key] = session
+	}
+
+	session.lastUsed = now
+	return session, nil
+}
+
+// delete ends the session with key, reporting whether it existed
+func (s *stickySessions) delete(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.sessions[key]
+	if ok {
+		s.remove(key)
+	}
+
+	return ok
+}
+
+// list returns the live sessions ordered by creation
+func (s *stickySessions) list() []SessionInfo {
+	s.Lock()
+	defer s.Unlock()
+
+	s.prune(time.Now())
+
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for key, session := range s.sessions {
+		info := SessionInfo{
+			Key:      key,
+			ID:       session.id,
+			Client:   session.client,
+			Created:  session.created,
+			LastUsed: session.lastUsed,
+			Expires:  session.lastUsed.Add(s.ttl),
+			Requests: session.requests,
+		}
+
+		if session.jar != nil {
+			info.Cookies = len(session.jar.Export())
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+
+	return infos
+}
+
+// expired reports whether session was idle longer than the ttl; the lock must be held
+func (s *stickySessions) expired(session *stickySession, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(session.lastUsed) > s.ttl
+}
+
+// prune removes every expired session; the lock must be held
+func (s *stickySessions) prune(now time.Time) {
+	for key, session := range s.sessions {
+		if s.expired(session, now) {
+			s.remove(key)
+		}
+	}
+}
+
+// sweep drops expired sessions every interval and closes the idle connections of sessions
+// unused for core.IDLE_CONN_TIMEOUT, HTTP/2 transports have no idle timeout of their own
+func (s *stickySessions) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweepOnce(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// stop ends the sweep and closes the idle connections of every session
+func (s *stickySessions) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, session := range s.sessions {
+		closeIdleConnections(session.transport)
+	}
+}
+
+func (s *stickySessions) sweepOnce(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.prune(now)
+
+	for _, session := range s.sessions {
+		if now.Sub(session.lastUsed) > core.IDLE_CONN_TIMEOUT {
+			closeIdleConnections(session.transport)
+		}
+	}
+}
+
+// remove drops the session with key and closes its idle connections; the lock must be held
+func (s *stickySessions) remove(key string) {
+	closeIdleConnections(s.sessions[key].transport)
+	delete(s.sessions, key)
+}
+
+func closeIdleConnections(transport http.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+)
+
+// idleTransport counts CloseIdleConnections calls
+type idleTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestSessionClient(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.7:51234"
+
+	if got := sessionClient(req); got != "192.0.2.7" {
+		t.Fatalf("client = %q, want the address", got)
+	}
+
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	auth := sessionClient(req)
+	if !strings.HasPrefix(auth, "auth:") || strings.Contains(auth, "dXNlcjpwYXNz") {
+		t.Fatalf("client = %q, want a hash of the credentials", auth)
+	}
+
+	// The same credentials from another address are the same client
+	req.RemoteAddr = "198.51.100.1:40000"
+	if got := sessionClient(req); got != auth {
+		t.Fatalf("client = %q, want %q", got, auth)
+	}
+}
+
+func TestStickySessionsScopedByClient(t *testing.T) {
+	sessions := newStickySessions(time.Minute, 0)
+
+	create := func() http.RoundTripper { return &idleTransport{} }
+
+	first, _, err := sessions.transport("shared-id", "192.0.2.1", false, create)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, _, _ := sessions.transport("shared-id", "192.0.2.1", false, create)
+	other, _, _ := sessions.transport("shared-id", "192.0.2.2", false, create)
+
+	if first != again {
+		t.Fatal("requests of one client got different sessions")
+	}
+	if first == other {
+		t.Fatal("another client got the session of the same id")
+	}
+
+	infos := sessions.list()
+	if len(infos) != 2 || infos[0].ID != "shared-id" || infos[0].Key != sessionKey("shared-id", infos[0].Client) {
+		t.Fatalf("sessions = %+v", infos)
+	}
+}
+
+func TestStickySessionsRejectInvalidID(t *testing.T) {
+	sessions := newStickySessions(time.Minute, 0)
+
+	for _, id := range []string{"", strings.Repeat("a", MAX_SESSION_ID_LENGTH+1)} {
+		if _, _, err := sessions.transport(id, "192.0.2.1", false, nil); err != errInvalidSessionID {
+			t.Errorf("transport(%q) error = %v, want %v", id, err, errInvalidSessionID)
+		}
+	}
+
+	for _, key := range []string{"no-client", "id@", "@192.0.2.1"} {
+		if _, err := sessions.cookieJar(key, true); err != errInvalidSessionID {
+			t.Errorf("cookieJar(%q) error = %v, want %v", key, err, errInvalidSessionID)
+		}
+	}
+
+	// Ids may contain "@", the client part never does
+	if _, err := sessions.cookieJar("user@example.com@192.0.2.1", true); err != nil {
+		t.Fatal(err)
+	}
+	if infos := sessions.list(); len(infos) != 1 || infos[0].ID != "user@example.com" || infos[0].Client != "192.0.2.1" {
+		t.Fatalf("sessions = %+v", infos)
+	}
+}
+
+func TestStickySessionsSweep(t *testing.T) {
+	sessions := newStickySessions(10*time.Minute, 0)
+
+	transports := map[string]*idleTransport{}
+	for _, id := range []string{"active", "idle", "expired"} {
+		transport := &idleTransport{}
+		transports[id] = transport
+
+		if _, _, err := sessions.transport(id, "192.0.2.1", false, func() http.RoundTripper { return transport }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	sessions.Lock()
+	sessions.sessions[sessionKey("idle", "192.0.2.1")].lastUsed = now.Add(-5 * time.Minute)
+	sessions.sessions[sessionKey("expired", "192.0.2.1")].lastUsed = now.Add(-time.Hour)
+	sessions.Unlock()
+
+	sessions.sweepOnce(now)
+
+	if transports["active"].closed != 0 {
+		t.Error("idle connections of an active session were closed")
+	}
+	if transports["idle"].closed != 1 {
+		t.Errorf("idle session closed its connections %d times, want 1", transports["idle"].closed)
+	}
+	if transports["expired"].closed != 1 {
+		t.Errorf("expired session closed its connections %d times, want 1", transports["expired"].closed)
+	}
+
+	if infos := sessions.list(); len(infos) != 2 {
+		t.Fatalf("sessions after the sweep = %+v, want active and idle", infos)
+	}
+}
+
+func TestStickySessionsStop(t *testing.T) {
+	sessions := newStickySessions(10*time.Minute, 0)
+
+	transport := &idleTransport{}
+	if _, _, err := sessions.transport("session", "192.0.2.1", false, func() http.RoundTripper { return transport }); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sessions.sweep(time.Millisecond)
+		close(done)
+	}()
+
+	sessions.stop()
+	sessions.stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sweep kept running after stop")
+	}
+
+	if transport.closed == 0 {
+		t.Fatal("stop left the idle connections of a session open")
+	}
+}
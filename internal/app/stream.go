@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+var (
+	errResponseTimeout = errors.New("upstream response timeout")
+	errIdleTimeout     = errors.New("upstream idle read timeout")
+)
+
+// fetch sends request bounded by the response timeout until the headers arrive, the body is
+// bounded by the idle-read timeout instead so long streams are not cut; stop releases the request
+func (s *ProxyHandler) fetch(parent context.Context, request *http.Request, config proxyConfig) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stop := func() { cancel(nil) }
+
+	timer := time.AfterFunc(s.config.Timeout, func() { cancel(errResponseTimeout) })
+	resp, err := s.doWithRetries(ctx, request, config)
+	timer.Stop()
+
+	if err != nil {
+		stop()
+		if cause := context.Cause(ctx); cause == errResponseTimeout {
+			err = cause
+		}
+
+		var open *core.CircuitOpenError
+		if errors.As(err, &open) {
+			err = &limitError{err: open, retryAfter: open.RetryAfter}
+		}
+		return nil, nil, err
+	}
+
+	// A switched protocol has its own idle timeout in the relay
+	if s.config.IdleReadTimeout > 0 && resp.StatusCode != http.StatusSwitchingProtocols {
+		expire := time.AfterFunc(s.config.IdleReadTimeout, func() { cancel(errIdleTimeout) })
+		expire.Stop()
+
+		resp.Body = &idleReader{ReadCloser: resp.Body, ctx: ctx, timer: expire, timeout: s.config.IdleReadTimeout}
+	}
+
+	return resp, stop, nil
+}
+
+// idleReader cancels the request when the upstream sends nothing for timeout, the time
+// spent writing to a slow client does not count
+type idleReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.ReadCloser.Read(p)
+	r.timer.Stop()
+
+	if err != nil && err != io.EOF && context.Cause(r.ctx) == errIdleTimeout {
+		err = errIdleTimeout
+	}
+
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.ReadCloser.Close()
+}
+
+// isStream reports whether a response has to reach the client as it arrives: event
+// streams and bodies of unknown length like chunked long polls
+func isStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.ContentLength < 0
+}
+
+// copyBody writes the response body to the client, streams are flushed after every read
+func copyBody(wr http.ResponseWriter, resp *http.Response) error {
+	flusher, ok := wr.(http.Flusher)
+	if !ok || !isStream(resp) {
+		_, err := io.Copy(wr, resp.Body)
+		return err
+	}
+
+	// Headers go out before the first event
+	flusher.Flush()
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := wr.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// announceTrailers declares the trailers the upstream announced, it must run before WriteHeader
+func announceTrailers(wr http.ResponseWriter, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(resp.Trailer))
+	for key := range resp.Trailer {
+		keys = append(keys, key)
+	}
+
+	wr.Header().Add("Trailer", strings.Join(keys, ", "))
+}
+
+// copyTrailers sends the trailers received with the body, including undeclared ones
+func copyTrailers(wr http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			wr.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// chunkTrailers makes a response written with Response.Write carry its trailers, which
+// needs chunked framing when the length is unknown
+func chunkTrailers(resp *http.Response) {
+	if len(resp.Trailer) > 0 && resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+}
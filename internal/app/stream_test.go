@@ -0,0 +1,198 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/httptest"
+)
+
+// proxyGet sends a plain http GET for origin through the proxy, directly or inside a CONNECT
+// tunnel, header holds extra "Name: value\r\n" lines
+func proxyGet(t *testing.T, proxy, origin string, tunnel bool, header string) *http.Response {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	reader := bufio.NewReader(conn)
+	target := "http://" + origin + "/"
+
+	if tunnel {
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", origin, origin)
+
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT = %v (%v)", resp, err)
+		}
+		target = "/"
+	}
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nProxy-Protocol: http\r\n%s\r\n", target, origin, header)
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func startStreamOrigin(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	origin := httptest.NewServer(handler)
+	t.Cleanup(origin.Close)
+
+	return strings.TrimPrefix(origin.URL, "http://")
+}
+
+func pathName(tunnel bool) string {
+	if tunnel {
+		return "tunnel"
+	}
+
+	return "HandleHTTP"
+}
+
+func TestEventStreamFlushed(t *testing.T) {
+	for _, tunnel := range []bool{false, true} {
+		t.Run(pathName(tunnel), func(t *testing.T) {
+			release := make(chan struct{})
+			origin := startStreamOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = io.WriteString(w, "data: first\n\n")
+				w.(http.Flusher).Flush()
+
+				<-release
+				_, _ = io.WriteString(w, "data: second\n\n")
+			})
+
+			resp := proxyGet(t, startProxy(t, DefaultConfig()), origin, tunnel, "")
+			defer resp.Body.Close()
+
+			// The first event arrives while the origin still holds the response open
+			first := make(chan string, 1)
+			go func() {
+				event := make([]byte, len("data: first\n\n"))
+				n, _ := io.ReadFull(resp.Body, event)
+				first <- string(event[:n])
+			}()
+
+			select {
+			case line := <-first:
+				if line != "data: first\n\n" {
+					t.Fatalf("first event = %q", line)
+				}
+			case <-time.After(5 * time.Second):
+				close(release)
+				t.Fatal("the first event was held back until the response ended")
+			}
+
+			close(release)
+
+			rest, err := io.ReadAll(resp.Body)
+			if err != nil || string(rest) != "data: second\n\n" {
+				t.Fatalf("rest of the stream = %q (%v)", rest, err)
+			}
+		})
+	}
+}
+
+func TestTrailersForwarded(t *testing.T) {
+	for _, tunnel := range []bool{false, true} {
+		t.Run(pathName(tunnel), func(t *testing.T) {
+			origin := startStreamOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				_, _ = io.WriteString(w, "body")
+				w.(http.Flusher).Flush()
+
+				w.Header().Set("X-Checksum", "abc")
+				w.Header().Set(http.TrailerPrefix+"X-Undeclared", "late")
+			})
+
+			resp := proxyGet(t, startProxy(t, DefaultConfig()), origin, tunnel, "")
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || string(body) != "body" {
+				t.Fatalf("body = %q (%v)", body, err)
+			}
+
+			if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+				t.Errorf("X-Checksum trailer = %q, want abc (trailers %v)", got, resp.Trailer)
+			}
+			if got := resp.Trailer.Get("X-Undeclared"); got != "late" {
+				t.Errorf("X-Undeclared trailer = %q, want late (trailers %v)", got, resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestIdleReadTimeout(t *testing.T) {
+	for _, tunnel := range []bool{false, true} {
+		t.Run(pathName(tunnel), func(t *testing.T) {
+			config := DefaultConfig()
+			config.IdleReadTimeout = 300 * time.Millisecond
+
+			stalled := make(chan struct{})
+			t.Cleanup(func() { close(stalled) })
+
+			origin := startStreamOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Stall") == "" {
+					// A stream lasting several timeouts with a chunk well within each
+					for i := 0; i < 8; i++ {
+						fmt.Fprintf(w, "chunk %d\n", i)
+						w.(http.Flusher).Flush()
+						time.Sleep(100 * time.Millisecond)
+					}
+					return
+				}
+
+				_, _ = io.WriteString(w, "partial\n")
+				w.(http.Flusher).Flush()
+
+				select {
+				case <-stalled:
+				case <-r.Context().Done():
+				}
+			})
+
+			proxy := startProxy(t, config)
+
+			active := proxyGet(t, proxy, origin, tunnel, "")
+			body, err := io.ReadAll(active.Body)
+			active.Body.Close()
+			if err != nil || strings.Count(string(body), "chunk") != 8 {
+				t.Fatalf("active stream = %q (%v), want 8 chunks", body, err)
+			}
+
+			stalledResp := proxyGet(t, proxy, origin, tunnel, "X-Stall: 1\r\n")
+			defer stalledResp.Body.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := io.ReadAll(stalledResp.Body)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("a stalled stream looked complete")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("a stalled stream was not ended by the idle timeout")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/kolosok86/proxy/internal/core"
+)
+
+// webSocketStats counts relayed WebSockets, bytes are added while they flow
+type webSocketStats struct {
+	active   atomic.Int64
+	total    atomic.Int64
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// WebSocketStats describes relayed WebSockets in the admin API
+type WebSocketStats struct {
+	Active        int64 `json:"active"`
+	Total         int64 `json:"total"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+func (w *webSocketStats) snapshot() WebSocketStats {
+	return WebSocketStats{
+		Active:        w.active.Load(),
+		Total:         w.total.Load(),
+		BytesSent:     w.sent.Load(),
+		BytesReceived: w.received.Load(),
+	}
+}
+
+// isUpgrade reports whether the client asks to switch protocols, the tunnel of such a request
+// is not watched for a disconnect since the connection is handed over to the relay
+func isUpgrade(request *http.Request) bool {
+	return request.Header.Get("Upgrade") != ""
+}
+
+// upgradeWebSocket answers an HTTP request switched to a WebSocket by taking over the client
+// connection and relaying frames until either side ends
+func (s *ProxyHandler) upgradeWebSocket(wr http.ResponseWriter, req *http.Request, resp *http.Response) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.logger.Error("Switched response of %v has no writable body", req.URL)
+		http.Error(wr, SERVER_REQUEST_ERROR_MSG, http.StatusInternalServerError)
+		return
+	}
+
+	local, reader, err := core.Hijack(wr)
+	if err != nil {
+		s.logger.Error("Can't hijack client connection: %v", err)
+		http.Error(wr, HIJACK_ERROR_MSG, http.StatusInternalServerError)
+		return
+	}
+	defer local.Close()
+
+	if err := writeResponseHead(local, resp); err != nil {
+		s.logger.Error("Error writing response: %v", err)
+		return
+	}
+
+	s.relayWebSocket(local, reader.Reader, upstream, req.RemoteAddr, req.URL.String())
+}
+
+// writeResponseHead writes the status line and headers of resp, the body is relayed on its own
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if err := resp.Header.Write(&head); err != nil {
+		return err
+	}
+	head.WriteString("\r\n")
+
+	_, err := w.Write(head.Bytes())
+	return err
+}
+
+// relayWebSocket copies frames both ways until both sides are done, a side that ends closes
+// the writing half of the other and a connection without traffic for the idle timeout is closed
+func (s *ProxyHandler) relayWebSocket(local net.Conn, reader io.Reader, upstream io.ReadWriteCloser, remote, target string) {
+	started := time.Now()
+	s.websockets.active.Add(1)
+	s.websockets.total.Add(1)
+	defer s.websockets.active.Add(-1)
+
+	// The client connection belongs to the caller, a deadline unblocks it
+	closeBoth := func() {
+		_ = local.SetDeadline(time.Now())
+		_ = upstream.Close()
+	}
+
+	touch := func() {}
+	if idle := s.config.WebSocketIdleTimeout; idle > 0 {
+		timer := time.AfterFunc(idle, closeBoth)
+		defer timer.Stop()
+
+		touch = func() { timer.Reset(idle) }
+	}
+
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, &countingReader{Reader: reader, counter: &s.websockets.sent, touch: touch})
+		closeWrite(upstream)
+		done <- n
+	}()
+
+	received, _ := io.Copy(local, &countingReader{Reader: upstream, counter: &s.websockets.received, touch: touch})
+	closeWrite(local)
+	sent := <-done
+
+	closeBoth()
+
+	s.logger.Info("WebSocket closed: %v %v sent %d received %d bytes in %v", remote, target, sent, received, time.Since(started).Round(time.Millisecond))
+}
+
+// closeWrite half-closes c when it supports it, otherwise closes it
+func closeWrite(c io.Closer) {
+	if closer, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = closer.CloseWrite()
+		return
+	}
+
+	_ = c.Close()
+}
+
+// countingReader adds the bytes read to counter and reports activity to touch
+type countingReader struct {
+	io.Reader
+	counter *atomic.Int64
+	touch   func()
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.counter.Add(int64(n))
+		r.touch()
+	}
+
+	return n, err
+}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrDestinationDenied refuses a dial to a host, address or port the ACL does not allow
+var ErrDestinationDenied = errors.New("destination not allowed")
+
+// Ranges of -deny-private: loopback, private, link-local (cloud metadata), CGNAT, IETF
+// protocol assignments, benchmarking, unspecified and multicast addresses, and NAT64
+// addresses that reach any of them through a translator
+var privateRanges = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// ACL decides which destinations upstream connections may go to. A destination matching a
+// deny rule is refused, with allow rules it must also match one of them. Host rules see the
+// requested name, address rules every resolved address right before it is dialed
+type ACL struct {
+	allow []aclRule
+	deny  []aclRule
+}
+
+// aclRule matches a host glob or an address prefix, and a port range; empty parts match anything
+type aclRule struct {
+	host   string
+	prefix netip.Prefix
+	ports  [2]uint16
+}
+
+// Allow adds an allow rule, see parseACLRule for the syntax
+func (a *ACL) Allow(rule string) error {
+	parsed, err := parseACLRule(rule)
+	if err != nil {
+		return err
+	}
+
+	a.allow = append(a.allow, parsed)
+	return nil
+}
+
+// Deny adds a deny rule
+func (a *ACL) Deny(rule string) error {
+	parsed, err := parseACLRule(rule)
+	if err != nil {
+		return err
+	}
+
+	a.deny = append(a.deny, parsed)
+	return nil
+}
+
+// DenyPrivate denies loopback, private, link-local and other non-public ranges
+func (a *ACL) DenyPrivate() {
+	for _, cidr := range privateRanges {
+		a.deny = append(a.deny, aclRule{prefix: netip.MustParsePrefix(cidr)})
+	}
+}
+
+// Empty reports whether the ACL has no rules and allows everything
+func (a *ACL) Empty() bool {
+	return a == nil || len(a.allow) == 0 && len(a.deny) == 0
+}
+
+// parseACLRule parses "host[:ports]" where host is a glob like "*.example.com", an address
+// or a CIDR and ports is "443" or "8000-9000"; ":ports" alone matches every host and an IPv6
+// address with ports is written in brackets
+func parseACLRule(value string) (aclRule, error) {
+	var rule aclRule
+
+	target, ports := value, ""
+	switch {
+	case strings.HasPrefix(value, "["):
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("invalid rule %q: missing ]", value)
+		}
+
+		target, ports = value[1:end], strings.TrimPrefix(value[end+1:], ":")
+		if value[end+1:] != "" && !strings.HasPrefix(value[end+1:], ":") {
+			return rule, fmt.Errorf("invalid rule %q", value)
+		}
+	case strings.Count(value, ":") == 1:
+		target, ports, _ = strings.Cut(value, ":")
+	}
+
+	if ports != "" {
+		low, high, isRange := strings.Cut(ports, "-")
+		from, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return rule, fmt.Errorf("invalid port in rule %q", value)
+		}
+
+		to := from
+		if isRange {
+			if to, err = strconv.ParseUint(high, 10, 16); err != nil || to < from {
+				return rule, fmt.Errorf("invalid port range in rule %q", value)
+			}
+		}
+
+		rule.ports = [2]uint16{uint16(from), uint16(to)}
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	if prefix, err := netip.ParsePrefix(target); err == nil {
+		rule.prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(target); err == nil {
+		rule.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	} else if target != "" {
+		if _, err := path.Match(target, ""); err != nil || strings.ContainsAny(target, "/ ") {
+			return rule, fmt.Errorf("invalid host in rule %q", value)
+		}
+		rule.host = target
+	}
+
+	if target == "" && ports == "" {
+		return rule, fmt.Errorf("empty rule %q", value)
+	}
+
+	return rule, nil
+}
+
+// matches reports whether the rule covers host or ip at port, ip is invalid before resolution
+func (r aclRule) matches(host string, ip netip.Addr, port uint16) bool {
+	if r.ports != [2]uint16{} && (port < r.ports[0] || port > r.ports[1]) {
+		return false
+	}
+
+	switch {
+	case r.prefix.IsValid():
+		return ip.IsValid() && r.prefix.Contains(ip)
+	case r.host != "":
+		ok, _ := path.Match(r.host, host)
+		return ok
+	default:
+		return true
+	}
+}
+
+// check refuses host at port when dialed at ip, an invalid ip checks the name alone
+func (a *ACL) check(host string, ip netip.Addr, port uint16) error {
+	if a.Empty() {
+		return nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !ip.IsValid() {
+		ip, _ = netip.ParseAddr(strings.Trim(host, "[]"))
+	}
+	ip = ip.Unmap()
+
+	for _, rule := range a.deny {
+		if rule.matches(host, ip, port) {
+			return a.denied(host, ip, port)
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range a.allow {
+		if rule.matches(host, ip, port) {
+			return nil
+		}
+	}
+
+	return a.denied(host, ip, port)
+}
+
+func (a *ACL) denied(host string, ip netip.Addr, port uint16) error {
+	dest := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if ip.IsValid() && ip.String() != host {
+		dest += " (" + ip.String() + ")"
+	}
+
+	return fmt.Errorf("%w: %s", ErrDestinationDenied, dest)
+}
+
+// CheckAddr checks a "host:port" target by name before it is resolved, the addresses it
+// resolves to are checked again when dialed
+func (a *ACL) CheckAddr(addr string) error {
+	if a.Empty() {
+		return nil
+	}
+
+	host, port, err := splitPort(addr)
+	if err != nil {
+		return err
+	}
+
+	return a.checkName(host, port)
+}
+
+// checkName applies the deny rules and, for an address literal, the allow rules
+func (a *ACL) checkName(host string, port uint16) error {
+	if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return a.check(host, netip.Addr{}, port)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range a.deny {
+		if rule.matches(host, netip.Addr{}, port) {
+			return a.denied(host, netip.Addr{}, port)
+		}
+	}
+
+	return nil
+}
+
+// checkForward checks a "host:port" target an upstream proxy resolves, address rules only
+// match an address literal there so allow rules by address refuse names
+func (a *ACL) checkForward(addr string) error {
+	if a.Empty() {
+		return nil
+	}
+
+	host, port, err := splitPort(addr)
+	if err != nil {
+		return err
+	}
+
+	return a.check(host, netip.Addr{}, port)
+}
+
+// filter returns the addresses of host allowed at port, in order
+func (a *ACL) filter(host, port string, ips []net.IP) ([]net.IP, error) {
+	if a.Empty() {
+		return ips, nil
+	}
+
+	n, err := parsePort(port)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make([]net.IP, 0, len(ips))
+	var firstErr error
+
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+
+		if err := a.check(host, addr, n); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		allowed = append(allowed, ip)
+	}
+
+	if len(allowed) == 0 {
+		if firstErr == nil {
+			firstErr = a.denied(host, netip.Addr{}, n)
+		}
+		return nil, firstErr
+	}
+
+	return allowed, nil
+}
+
+func splitPort(addr string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := parsePort(port)
+	return host, n, err
+}
+
+func parsePort(port string) (uint16, error) {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+
+	return uint16(n), nil
+}
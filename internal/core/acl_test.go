@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestACL(t *testing.T, allow, deny []string, private bool) *ACL {
+	t.Helper()
+
+	acl := &ACL{}
+	for _, rule := range allow {
+		if err := acl.Allow(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rule := range deny {
+		if err := acl.Deny(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if private {
+		acl.DenyPrivate()
+	}
+
+	return acl
+}
+
+func TestACLCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		private bool
+		// addr is checked by name, ip is the address it resolved to when set
+		addr    string
+		ip      string
+		allowed bool
+	}{
+		{"empty allows everything", nil, nil, false, "example.com:443", "10.0.0.1", true},
+
+		{"bracketed address", nil, []string{"[2001:db8::1]:8080"}, false, "[2001:db8::1]:8080", "", false},
+		{"bracketed address other port", nil, []string{"[2001:db8::1]:8080"}, false, "[2001:db8::1]:443", "", true},
+		{"bracketed prefix with range", nil, []string{"[2001:db8::/32]:8000-9000"}, false, "[2001:db8::5]:8500", "", false},
+		{"bracketed prefix outside range", nil, []string{"[2001:db8::/32]:8000-9000"}, false, "[2001:db8::5]:9001", "", true},
+		{"bracketed address without port", nil, []string{"[2001:db8::1]"}, false, "[2001:db8::1]:22", "", false},
+		{"mapped address matches v4 rule", nil, []string{"192.0.2.0/24"}, false, "[::ffff:192.0.2.1]:80", "", false},
+
+		{"port alone", nil, []string{":25"}, false, "mail.example.com:25", "", false},
+		{"port range", nil, []string{":8000-9000"}, false, "example.com:8000", "", false},
+		{"port range end", nil, []string{":8000-9000"}, false, "example.com:9000", "", false},
+		{"port range outside", nil, []string{":8000-9000"}, false, "example.com:9001", "", true},
+		{"host glob with port", nil, []string{"*.corp.example:22"}, false, "db.corp.example:22", "", false},
+		{"host glob other port", nil, []string{"*.corp.example:22"}, false, "db.corp.example:443", "", true},
+
+		{"deny wins over allow", []string{"*.example.com"}, []string{"admin.example.com"}, false, "admin.example.com:443", "", false},
+		{"deny address wins over allowed name", []string{"*.example.com"}, []string{"10.0.0.0/8"}, false, "www.example.com:443", "10.1.2.3", false},
+		{"deny wins over allowed address", []string{"192.0.2.0/24"}, []string{"192.0.2.7"}, false, "192.0.2.7:443", "", false},
+
+		{"allow only match", []string{"*.example.com:443"}, nil, false, "www.example.com:443", "", true},
+		{"allow only wrong port", []string{"*.example.com:443"}, nil, false, "www.example.com:80", "", false},
+		{"allow only other host", []string{"*.example.com:443"}, nil, false, "example.org:443", "", false},
+		{"allow only address", []string{"192.0.2.0/24"}, nil, false, "example.org:443", "192.0.2.10", true},
+		{"allow only address elsewhere", []string{"192.0.2.0/24"}, nil, false, "example.org:443", "198.51.100.1", false},
+
+		{"private loopback", nil, nil, true, "127.0.0.1:80", "", false},
+		{"private metadata", nil, nil, true, "169.254.169.254:80", "", false},
+		{"private benchmarking", nil, nil, true, "198.19.0.1:80", "", false},
+		{"private protocol assignments", nil, nil, true, "192.0.0.8:80", "", false},
+		{"private nat64", nil, nil, true, "[64:ff9b::a00:1]:80", "", false},
+		{"private unique local", nil, nil, true, "[fd00::1]:80", "", false},
+		{"public address", nil, nil, true, "93.184.215.14:443", "", true},
+		{"public v6 address", nil, nil, true, "[2606:4700::1]:443", "", true},
+		{"name resolving to private", nil, nil, true, "internal.example.com:443", "10.0.0.5", false},
+		{"name resolving to public", nil, nil, true, "www.example.com:443", "93.184.215.14", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := newTestACL(t, tt.allow, tt.deny, tt.private)
+
+			host, port, err := splitPort(tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ip netip.Addr
+			if tt.ip != "" {
+				ip = netip.MustParseAddr(tt.ip)
+			}
+
+			err = acl.check(host, ip, port)
+			if (err == nil) != tt.allowed || err != nil && !errors.Is(err, ErrDestinationDenied) {
+				t.Fatalf("check(%s, %v) = %v, want allowed %t", tt.addr, ip, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestParseACLRule(t *testing.T) {
+	for _, rule := range []string{"", "[2001:db8::1", "[2001:db8::1]x", ":abc", ":9000-8000", ":70000", "bad host", "[[]"} {
+		if _, err := parseACLRule(rule); err == nil {
+			t.Errorf("parseACLRule(%q) accepted the rule", rule)
+		}
+	}
+}
+
+func TestACLResolvedPrivateAddress(t *testing.T) {
+	// internal.test resolves to a private address, mixed.test to a private and a public one
+	dns := startStubDNS(t, false, func(q dnsmessage.Question) []dnsmessage.Resource {
+		if q.Type != dnsmessage.TypeA {
+			return nil
+		}
+
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+		answers := []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 5}}}}
+		if q.Name.String() == "mixed.test." {
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		}
+
+		return answers
+	})
+
+	// The name alone passes, the address it resolves to does not
+	acl := newTestACL(t, nil, nil, true)
+	if err := acl.CheckAddr("internal.test:443"); err != nil {
+		t.Fatalf("name check = %v, want it left to the resolved address", err)
+	}
+
+	dialer := &resolvingDialer{resolver: newTestResolver(t, dns, PreferNone), acl: acl}
+
+	if _, err := dialer.resolve(context.Background(), "internal.test", "443"); !errors.Is(err, ErrDestinationDenied) {
+		t.Fatalf("resolve = %v, want %v", err, ErrDestinationDenied)
+	}
+
+	_, err := dialer.DialContext(context.Background(), "tcp", "internal.test:443")
+	if !errors.Is(err, ErrDestinationDenied) {
+		t.Fatalf("dial = %v, want %v", err, ErrDestinationDenied)
+	}
+
+	ips, err := dialer.resolve(context.Background(), "mixed.test", "443")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("mixed addresses = %v (%v), want only the public one", ips, err)
+	}
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+var errNoSourceAddress = errors.New("no source address for the address family of the host")
+
+// BindMode selects how the source address of a request is picked
+type BindMode int
+
+const (
+	// BindOff leaves the source address to the system
+	BindOff BindMode = iota
+	// BindAddr uses one fixed address
+	BindAddr
+	// BindRotate walks through the pool, one step per request
+	BindRotate
+	// BindRandom picks a random pool entry per request
+	BindRandom
+	// BindSticky derives the address from a key, so a session keeps its source address
+	BindSticky
+)
+
+// BindPool holds the local addresses and prefixes outbound connections may use
+type BindPool struct {
+	addrs4, addrs6 []net.IP
+	nets4, nets6   []*net.IPNet
+
+	next atomic.Uint64
+}
+
+// Add registers an address like 192.0.2.10 or a prefix like 2001:db8:1::/64,
+// every connection from a prefix gets an address of its own
+func (p *BindPool) Add(value string) error {
+	if ip := net.ParseIP(value); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			p.addrs4 = append(p.addrs4, ip4)
+		} else {
+			p.addrs6 = append(p.addrs6, ip)
+		}
+		return nil
+	}
+
+	_, prefix, err := net.ParseCIDR(value)
+	if err != nil {
+		return fmt.Errorf("invalid bind %q: expected an address or a prefix", value)
+	}
+
+	if prefix.IP.To4() != nil {
+		p.nets4 = append(p.nets4, prefix)
+	} else {
+		p.nets6 = append(p.nets6, prefix)
+	}
+
+	return nil
+}
+
+// Empty reports whether the pool has no address at all
+func (p *BindPool) Empty() bool {
+	return p == nil || len(p.addrs4)+len(p.addrs6)+len(p.nets4)+len(p.nets6) == 0
+}
+
+// contains reports whether ip is a pool address or lies in a pool prefix
+func (p *BindPool) contains(ip net.IP) bool {
+	for _, addr := range append(append([]net.IP(nil), p.addrs4...), p.addrs6...) {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+
+	for _, prefix := range append(append([]*net.IPNet(nil), p.nets4...), p.nets6...) {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Bind describes the source address selection of one request
+type Bind struct {
+	Pool *BindPool
+	Mode BindMode
+	// Addr is the address of BindAddr
+	Addr net.IP
+	// Key seeds the choice of BindSticky
+	Key string
+}
+
+// ParseBind reads a proxy-bind value: "rotate", "random", "off", an address or prefix member
+// of the pool, or any other token that keeps a stable address per token
+func ParseBind(value string, pool *BindPool) (Bind, error) {
+	value = strings.TrimSpace(value)
+
+	switch strings.ToLower(value) {
+	case "", "off":
+		return Bind{}, nil
+	case "rotate":
+		return Bind{Pool: pool, Mode: BindRotate}, pool.check()
+	case "random":
+		return Bind{Pool: pool, Mode: BindRandom}, pool.check()
+	}
+
+	// A client may only pick among the configured addresses
+	if ip := net.ParseIP(value); ip != nil {
+		if pool.Empty() || !pool.contains(ip) {
+			return Bind{}, fmt.Errorf("bind address %s is not configured", ip)
+		}
+
+		return Bind{Mode: BindAddr, Addr: ip}, nil
+	}
+
+	return Bind{Pool: pool, Mode: BindSticky, Key: value}, pool.check()
+}
+
+func (p *BindPool) check() error {
+	if p.Empty() {
+		return errors.New("no bind addresses configured")
+	}
+
+	return nil
+}
+
+// sources returns the IPv4 and IPv6 source addresses of one request, nil when a family has none
+func (b Bind) sources() (net.IP, net.IP) {
+	switch b.Mode {
+	case BindAddr:
+		if ip4 := b.Addr.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		return nil, b.Addr
+	case BindRotate:
+		n := b.Pool.next.Add(1) - 1
+		return pickSource(b.Pool.addrs4, b.Pool.nets4, n, nil), pickSource(b.Pool.addrs6, b.Pool.nets6, n, nil)
+	case BindRandom:
+		n := mrand.Uint64()
+		return pickSource(b.Pool.addrs4, b.Pool.nets4, n, nil), pickSource(b.Pool.addrs6, b.Pool.nets6, n, nil)
+	case BindSticky:
+		seed := sha256.Sum256([]byte(b.Key))
+		n := binary.BigEndian.Uint64(seed[:8])
+		return pickSource(b.Pool.addrs4, b.Pool.nets4, n, seed[8:]), pickSource(b.Pool.addrs6, b.Pool.nets6, n, seed[8:])
+	default:
+		return nil, nil
+	}
+}
+
+// pickSource takes entry n of addrs followed by prefixes, a prefix yields an address with
+// host bits from seed, or random ones without a seed
+func pickSource(addrs []net.IP, prefixes []*net.IPNet, n uint64, seed []byte) net.IP {
+	total := uint64(len(addrs) + len(prefixes))
+	if total == 0 {
+		return nil
+	}
+
+	i := n % total
+	if i < uint64(len(addrs)) {
+		return addrs[i]
+	}
+
+	prefix := prefixes[i-uint64(len(addrs))]
+	host := make([]byte, len(prefix.IP))
+	if seed != nil {
+		copy(host, seed)
+	} else {
+		_, _ = rand.Read(host)
+	}
+
+	ip := make(net.IP, len(prefix.IP))
+	for j := range ip {
+		ip[j] = prefix.IP[j] | host[j]&^prefix.Mask[j]
+	}
+
+	return ip
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package core
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// freebind lets a socket use a source address no interface carries, so addresses of a
+// bind prefix work as long as the prefix is routed to the host
+func freebind(network, _ string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_FREEBIND, 1)
+		} else {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_FREEBIND, 1)
+		}
+	})
+
+	if controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
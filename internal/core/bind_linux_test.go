@@ -0,0 +1,18 @@
+package core
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestFreebindUnassignedAddress(t *testing.T) {
+	// 192.0.2.0/24 is documentation space no interface of the test host carries
+	config := net.ListenConfig{Control: freebind}
+
+	conn, err := config.ListenPacket(context.Background(), "udp", "192.0.2.55:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package core
+
+import "syscall"
+
+// freebind is a no-op outside Linux, addresses of a bind prefix have to be assigned to the
+// host (or made bindable another way) there
+func freebind(string, string, syscall.RawConn) error {
+	return nil
+}
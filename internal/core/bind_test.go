@@ -0,0 +1,59 @@
+package core
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseBindLiteralNeedsPool(t *testing.T) {
+	pool := &BindPool{}
+	for _, value := range []string{"192.0.2.10", "2001:db8:1::/64"} {
+		if err := pool.Add(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		value string
+		pool  *BindPool
+		err   bool
+	}{
+		{"192.0.2.10", pool, false},
+		{"2001:db8:1::42", pool, false},
+		{"192.0.2.11", pool, true},
+		{"2001:db8:2::1", pool, true},
+		{"192.0.2.10", &BindPool{}, true},
+		{"192.0.2.10", nil, true},
+	}
+
+	for _, tt := range tests {
+		bind, err := ParseBind(tt.value, tt.pool)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseBind(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+
+		if err == nil && (bind.Mode != BindAddr || !bind.Addr.Equal(net.ParseIP(tt.value))) {
+			t.Errorf("ParseBind(%q) = %+v, want the fixed address", tt.value, bind)
+		}
+	}
+}
+
+func TestBindStickyKeepsAddress(t *testing.T) {
+	pool := &BindPool{}
+	if err := pool.Add("2001:db8:1::/64"); err != nil {
+		t.Fatal(err)
+	}
+
+	bind, err := ParseBind("session-1", pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, first := bind.sources()
+	_, second := bind.sources()
+
+	if !first.Equal(second) || !pool.contains(first) {
+		t.Fatalf("sticky sources %v and %v, want one address of the prefix", first, second)
+	}
+}
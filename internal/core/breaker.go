@@ -0,0 +1,315 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/http2"
+)
+
+// Origins tracked before healthy ones are dropped
+const MAX_BREAKERS = 4096
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// How long requests wait behind the probe of a half-open origin
+const halfOpenRetryAfter = time.Second
+
+// CircuitOpenError refuses a request to an origin whose breaker is open
+type CircuitOpenError struct {
+	Origin     string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s", e.Origin)
+}
+
+// Breakers trip per origin after threshold failures in a row: connection errors and the
+// configured statuses. An open origin is refused for cooldown, then a single probe request
+// decides whether it closes again or stays open for another cooldown
+type Breakers struct {
+	sync.Mutex
+
+	threshold int
+	cooldown  time.Duration
+	statuses  map[int]bool
+	origins   map[string]*breaker
+}
+
+type breaker struct {
+	state    string
+	failures int
+	trips    int
+	opened   time.Time
+	probing  bool
+	lastErr  string
+}
+
+// BreakerInfo describes the breaker of an origin in the admin API
+type BreakerInfo struct {
+	Origin    string    `json:"origin"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	Trips     int       `json:"trips"`
+	Opened    time.Time `json:"opened,omitzero"`
+	RetryAt   time.Time `json:"retry_at,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// NewBreakers creates the breakers, a threshold of zero returns nil which never trips
+func NewBreakers(threshold int, cooldown time.Duration, statuses []int) *Breakers {
+	if threshold <= 0 {
+		return nil
+	}
+
+	b := &Breakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		statuses:  make(map[int]bool, len(statuses)),
+		origins:   make(map[string]*breaker),
+	}
+
+	for _, status := range statuses {
+		b.statuses[status] = true
+	}
+
+	return b
+}
+
+// ParseStatusCodes parses a comma separated list of statuses and ranges like "403,500-599"
+func ParseStatusCodes(value string) ([]int, error) {
+	var statuses []int
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(part, "-")
+		low, err := strconv.Atoi(from)
+		if err != nil || low < 100 || low > 599 {
+			return nil, fmt.Errorf("invalid status %q", part)
+		}
+
+		high := low
+		if isRange {
+			if high, err = strconv.Atoi(to); err != nil || high < low || high > 599 {
+				return nil, fmt.Errorf("invalid status range %q", part)
+			}
+		}
+
+		for status := low; status <= high; status++ {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses, nil
+}
+
+// allow admits a request to origin, probe is set when it is the one request that tests a
+// half-open origin and must be followed by record
+func (b *Breakers) allow(origin string) (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	entry, ok := b.origins[origin]
+	if !ok {
+		return false, nil
+	}
+
+	switch entry.state {
+	case BreakerOpen:
+		if wait := time.Until(entry.opened.Add(b.cooldown)); wait > 0 {
+			return false, &CircuitOpenError{Origin: origin, RetryAfter: wait}
+		}
+
+		entry.state = BreakerHalfOpen
+		entry.probing = true
+		return true, nil
+	case BreakerHalfOpen:
+		if entry.probing {
+			return false, &CircuitOpenError{Origin: origin, RetryAfter: halfOpenRetryAfter}
+		}
+
+		entry.probing = true
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// record counts the outcome of a request to origin; a request the client canceled or one
+// that failed on its own settings says nothing about the origin and only hands the probe on
+func (b *Breakers) record(origin string, probe bool, req *http.Request, resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+
+	failure := err != nil
+	if err == nil {
+		failure = b.statuses[resp.StatusCode]
+	} else if errors.Is(context.Cause(req.Context()), context.Canceled) || !originFailure(err) {
+		b.Lock()
+		if entry, ok := b.origins[origin]; ok && probe {
+			entry.probing = false
+		}
+		b.Unlock()
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	entry, ok := b.origins[origin]
+	if !failure {
+		// A healthy origin needs no entry
+		if ok && (entry.state != BreakerOpen || probe) {
+			delete(b.origins, origin)
+		}
+		return
+	}
+
+	if !ok {
+		if len(b.origins) >= MAX_BREAKERS {
+			b.prune()
+		}
+
+		entry = &breaker{state: BreakerClosed}
+		b.origins[origin] = entry
+
+		// Another request closed the breaker while the probe was out
+		probe = false
+	}
+
+	entry.failures++
+	if err != nil {
+		entry.lastErr = err.Error()
+	} else {
+		entry.lastErr = resp.Status
+	}
+
+	if probe || entry.state == BreakerHalfOpen || entry.state == BreakerClosed && entry.failures >= b.threshold {
+		if entry.state != BreakerOpen {
+			entry.trips++
+		}
+
+		entry.state = BreakerOpen
+		entry.opened = time.Now()
+		entry.probing = false
+	}
+}
+
+// originFailure reports whether err is the origin's doing: it refused, reset or closed the
+// connection, timed out or broke HTTP/2. Failures of the request's own settings such as its
+// JA3, curves, pins, bind address, upstream proxy or the ACL would trip the breaker of an
+// origin for every client
+func originFailure(err error) bool {
+	var upstream *upstreamError
+	if errors.As(err, &upstream) || errors.Is(err, ErrDestinationDenied) || errors.Is(err, errNoSourceAddress) ||
+		errors.Is(err, errUnsupportedCurve) || errors.Is(err, errPinMismatch) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return true
+	}
+
+	var goAway http2.GoAwayError
+	var stream http2.StreamError
+	var conn http2.ConnectionError
+	if errors.As(err, &goAway) || errors.As(err, &stream) || errors.As(err, &conn) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// prune drops the origins that are not open; the lock must be held
+func (b *Breakers) prune() {
+	for origin, entry := range b.origins {
+		if entry.state == BreakerClosed {
+			delete(b.origins, origin)
+		}
+	}
+}
+
+// Snapshot lists the origins with failures or an open breaker
+func (b *Breakers) Snapshot() []BreakerInfo {
+	list := []BreakerInfo{}
+	if b == nil {
+		return list
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for origin, entry := range b.origins {
+		info := BreakerInfo{
+			Origin:    origin,
+			State:     entry.state,
+			Failures:  entry.failures,
+			Trips:     entry.trips,
+			LastError: entry.lastErr,
+		}
+
+		if entry.state != BreakerClosed {
+			info.Opened = entry.opened
+			info.RetryAt = entry.opened.Add(b.cooldown)
+		}
+
+		list = append(list, info)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Origin < list[j].Origin })
+	return list
+}
+
+// breakerOrigin is the scheme, host and port a breaker is kept for, a request to a resolve
+// override gets a breaker of its own so a dead override address does not block the origin
+func breakerOrigin(req *http.Request, overrides map[string]string) string {
+	scheme := strings.ToLower(req.URL.Scheme)
+
+	port := req.URL.Port()
+	if port == "" {
+		port = "443"
+		if scheme == "http" {
+			port = "80"
+		}
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	origin := scheme + "://" + net.JoinHostPort(host, port)
+
+	if addr, ok := resolveOverride(overrides, host, port); ok {
+		origin += " via " + addr
+	}
+
+	return origin
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/http2"
+)
+
+func TestOriginFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{fmt.Errorf("uTlsConn.HandshakeContext() error: %w", io.EOF), true},
+		{io.ErrUnexpectedEOF, true},
+		{context.DeadlineExceeded, true},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeProtocol}, true},
+		{http2.StreamError{StreamID: 1, Code: http2.ErrCodeInternal}, true},
+		{fmt.Errorf("conn.HandshakeContext() error for tls 1.3 (please retry request): %w", errUnsupportedCurve), false},
+		{fmt.Errorf("uTlsConn.HandshakeContext() error: %w", errPinMismatch), false},
+		{errNoSourceAddress, false},
+		{fmt.Errorf("dial: %w", ErrDestinationDenied), false},
+		{&upstreamError{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, false},
+		{&upstreamError{err: errors.New("upstream proxy: CONNECT example.com:443: 502 Bad Gateway")}, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.EADDRNOTAVAIL}, false},
+		{&net.DNSError{Err: "no such host", Name: "example.test", IsNotFound: true}, false},
+		{errors.New("invalid JA3 string: expected 5 components, got 3"), false},
+	}
+
+	for _, tt := range tests {
+		if got := originFailure(tt.err); got != tt.want {
+			t.Errorf("originFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBreakersCountOnlyOriginFailures(t *testing.T) {
+	b := NewBreakers(2, time.Minute, []int{http.StatusBadGateway})
+	req, _ := http.NewRequest("GET", "https://example.test/", nil)
+	origin := breakerOrigin(req, nil)
+
+	for i := 0; i < 3; i++ {
+		b.record(origin, false, req, nil, fmt.Errorf("uTlsConn.HandshakeContext() error: %w", errPinMismatch))
+		b.record(origin, false, req, nil, &upstreamError{err: syscall.ECONNREFUSED})
+	}
+
+	if _, err := b.allow(origin); err != nil || len(b.Snapshot()) != 0 {
+		t.Fatalf("setup failures were counted: %+v", b.Snapshot())
+	}
+
+	b.record(origin, false, req, nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})
+	b.record(origin, false, req, &http.Response{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}, nil)
+
+	var open *CircuitOpenError
+	if _, err := b.allow(origin); !errors.As(err, &open) {
+		t.Fatalf("allow error = %v, want the breaker open", err)
+	}
+}
+
+func TestBreakerOriginResolveOverride(t *testing.T) {
+	overrides := map[string]string{"example.test": "192.0.2.1"}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://Example.TEST/", "https://example.test:443 via 192.0.2.1"},
+		{"http://example.test:8080/", "http://example.test:8080 via 192.0.2.1"},
+		{"https://other.test/", "https://other.test:443"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		if got := breakerOrigin(req, overrides); got != tt.want {
+			t.Errorf("breakerOrigin(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
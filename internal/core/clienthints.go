@@ -0,0 +1,314 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/textproto"
+	utls "github.com/refraction-networking/utls"
+)
+
+// ClientHintsMode selects how the browser headers of a profile are added to requests
+type ClientHintsMode int
+
+const (
+	// ClientHintsFill adds the headers the client did not send
+	ClientHintsFill ClientHintsMode = iota
+	// ClientHintsForce replaces the client's values
+	ClientHintsForce
+	// ClientHintsOff leaves the headers alone
+	ClientHintsOff
+)
+
+// ParseClientHintsMode parses "fill", "force" or "off", empty is fill
+func ParseClientHintsMode(value string) (ClientHintsMode, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "fill":
+		return ClientHintsFill, nil
+	case "force":
+		return ClientHintsForce, nil
+	case "off", "false", "0":
+		return ClientHintsOff, nil
+	default:
+		return ClientHintsFill, fmt.Errorf("unknown client hints mode %q", value)
+	}
+}
+
+// ClientIdentity is the browser a profile claims to be in its headers
+type ClientIdentity struct {
+	// Browser is chrome, edge, firefox or safari
+	Browser string `json:"browser"`
+	// Version is the major version, it has to match the ClientHello
+	Version int `json:"version"`
+	// Platform is Windows, macOS, Linux, Android or iOS
+	Platform string `json:"platform"`
+	Mobile   bool   `json:"mobile,omitempty"`
+
+	// UserAgent replaces the generated User-Agent
+	UserAgent      string `json:"user_agent,omitempty"`
+	AcceptLanguage string `json:"accept_language,omitempty"`
+}
+
+// Identities of the built in setups, versioned after their ClientHello presets; android is
+// OkHttp, not a browser
+var builtinIdentities = map[string]*ClientIdentity{
+	"chrome":  helloIdentity(builtinHellos["chrome"], "chrome", "Windows", false),
+	"firefox": helloIdentity(builtinHellos["firefox"], "firefox", "Windows", false),
+	"ios":     helloIdentity(builtinHellos["ios"], "safari", "iOS", true),
+}
+
+// helloIdentity is the browser that sends the preset hello, its version is the preset's
+func helloIdentity(hello utls.ClientHelloID, browser, platform string, mobile bool) *ClientIdentity {
+	version, err := strconv.Atoi(hello.Version)
+	if err != nil {
+		panic(fmt.Sprintf("ClientHello preset %s has no major version", hello.Str()))
+	}
+
+	return &ClientIdentity{Browser: browser, Version: version, Platform: platform, Mobile: mobile}
+}
+
+// Platforms as sec-ch-ua-platform names them
+var clientPlatforms = map[string]string{
+	"windows": "Windows",
+	"macos":   "macOS",
+	"linux":   "Linux",
+	"android": "Android",
+	"ios":     "iOS",
+}
+
+// Validate checks the browser and platform and normalizes their spelling
+func (c *ClientIdentity) Validate() error {
+	c.Browser = strings.ToLower(c.Browser)
+	switch c.Browser {
+	case "chrome", "edge", "firefox", "safari":
+	default:
+		return fmt.Errorf("unknown browser %q", c.Browser)
+	}
+
+	if c.Version <= 0 {
+		return fmt.Errorf("invalid %s version %d", c.Browser, c.Version)
+	}
+
+	platform, ok := clientPlatforms[strings.ToLower(c.Platform)]
+	if !ok {
+		return fmt.Errorf("unknown platform %q", c.Platform)
+	}
+	c.Platform = platform
+
+	if c.Browser == "safari" && c.Platform != "macOS" && c.Platform != "iOS" {
+		return fmt.Errorf("safari does not run on %s", c.Platform)
+	}
+
+	return nil
+}
+
+// Identity returns the browser identity of the proxy-tls-setup value setup, nil when it has none
+func (p Profiles) Identity(setup string) *ClientIdentity {
+	if profile := p.Lookup(setup); profile != nil {
+		return profile.Client
+	}
+
+	return builtinIdentities[strings.ToLower(setup)]
+}
+
+// chromium reports whether the browser sends User-Agent Client Hints, on iOS it runs on WebKit
+func (c *ClientIdentity) chromium() bool {
+	return (c.Browser == "chrome" || c.Browser == "edge") && c.Platform != "iOS"
+}
+
+// UserAgentString returns the reduced User-Agent the browser sends
+func (c *ClientIdentity) UserAgentString() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+
+	v := strconv.Itoa(c.Version)
+
+	switch c.Browser {
+	case "firefox":
+		switch c.Platform {
+		case "Android":
+			return "Mozilla/5.0 (Android 10; Mobile; rv:" + v + ".0) Gecko/" + v + ".0 Firefox/" + v + ".0"
+		case "iOS":
+			return "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) FxiOS/" + v + ".0 Mobile/15E148 Safari/605.1.15"
+		}
+		return "Mozilla/5.0 (" + geckoPlatform(c.Platform) + "; rv:" + v + ".0) Gecko/20100101 Firefox/" + v + ".0"
+	case "safari":
+		if c.Platform == "iOS" {
+			return "Mozilla/5.0 (iPhone; CPU iPhone OS " + v + "_8 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/" + v + ".1.2 Mobile/15E148 Safari/604.1"
+		}
+		return "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/" + v + ".0 Safari/605.1.15"
+	}
+
+	ua := "Mozilla/5.0 (" + chromiumPlatform(c.Platform) + ") AppleWebKit/537.36 (KHTML, like Gecko) Chrome/" + v + ".0.0.0 "
+	if c.Mobile {
+		ua += "Mobile "
+	}
+	ua += "Safari/537.36"
+
+	if c.Browser == "edge" {
+		ua += " Edg/" + v + ".0.0.0"
+	}
+
+	return ua
+}
+
+func chromiumPlatform(platform string) string {
+	switch platform {
+	case "macOS":
+		return "Macintosh; Intel Mac OS X 10_15_7"
+	case "Linux":
+		return "X11; Linux x86_64"
+	case "Android":
+		return "Linux; Android 10; K"
+	case "iOS":
+		return "iPhone; CPU iPhone OS 17_1 like Mac OS X"
+	default:
+		return "Windows NT 10.0; Win64; x64"
+	}
+}
+
+func geckoPlatform(platform string) string {
+	switch platform {
+	case "macOS":
+		return "Macintosh; Intel Mac OS X 10.15"
+	case "Linux":
+		return "X11; Linux x86_64"
+	default:
+		return "Windows NT 10.0; Win64; x64"
+	}
+}
+
+// SecCHUA returns the sec-ch-ua brand list with the GREASE brand Chromium derives from
+// the major version, in the same order
+func (c *ClientIdentity) SecCHUA() string {
+	seed := c.Version
+	chars := []string{" ", "(", ":", "-", ".", "/", ")", ";", "=", "?", "_"}
+	greaseVersions := []string{"8", "99", "24"}
+
+	brand := "Google Chrome"
+	if c.Browser == "edge" {
+		brand = "Microsoft Edge"
+	}
+
+	v := strconv.Itoa(c.Version)
+	brands := []string{
+		`"Not` + chars[seed%len(chars)] + `A` + chars[(seed+1)%len(chars)] + `Brand";v="` + greaseVersions[seed%len(greaseVersions)] + `"`,
+		`"Chromium";v="` + v + `"`,
+		`"` + brand + `";v="` + v + `"`,
+	}
+
+	orders := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	order := orders[seed%len(orders)]
+
+	shuffled := make([]string, len(brands))
+	for i, position := range order {
+		shuffled[position] = brands[i]
+	}
+
+	return strings.Join(shuffled, ", ")
+}
+
+func (c *ClientIdentity) acceptLanguage() string {
+	if c.AcceptLanguage != "" {
+		return c.AcceptLanguage
+	}
+
+	if c.Browser == "firefox" {
+		return "en-US,en;q=0.5"
+	}
+
+	return "en-US,en;q=0.9"
+}
+
+// ApplyClientHints adds the User-Agent, Accept-Language and, for Chromium over https, the
+// low entropy client hints of the identity to req; force replaces the client's values and
+// fill adds no hints next to a User-Agent of another browser or version
+func ApplyClientHints(req *http.Request, id *ClientIdentity, mode ClientHintsMode, secure bool) {
+	if id == nil || mode == ClientHintsOff {
+		return
+	}
+
+	set := func(key, value, before string) {
+		if mode != ClientHintsForce && req.Header.Get(key) != "" {
+			return
+		}
+
+		req.Header.Set(key, value)
+		insertOrder(&req.HeaderOrder, key, before)
+	}
+
+	// Chromium sends client hints to secure origins only, ahead of the User-Agent; hints of the
+	// profile would contradict the User-Agent the client keeps
+	hints := id.chromium() && secure
+	if mode != ClientHintsForce && id.Contradicts(req.UserAgent()) != "" {
+		hints = false
+	}
+
+	if hints {
+		mobile := "?0"
+		if id.Mobile {
+			mobile = "?1"
+		}
+
+		set("sec-ch-ua", id.SecCHUA(), "user-agent")
+		set("sec-ch-ua-mobile", mobile, "user-agent")
+		set("sec-ch-ua-platform", strconv.Quote(id.Platform), "user-agent")
+	}
+
+	set("user-agent", id.UserAgentString(), "")
+	set("accept-language", id.acceptLanguage(), "")
+}
+
+// insertOrder adds key to the header order before the header before, or at the end
+func insertOrder(order *textproto.HeaderOrder, key, before string) {
+	key = strings.ToLower(key)
+	if order.FindIndex(key) >= 0 {
+		return
+	}
+
+	i := order.FindIndex(before)
+	if before == "" || i < 0 {
+		order.Add(key)
+		return
+	}
+
+	order.Order = append(order.Order[:i], append([]string{key}, order.Order[i:]...)...)
+}
+
+var userAgentBrowsers = []struct {
+	browser string
+	re      *regexp.Regexp
+}{
+	{"edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+	{"firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+	{"chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+	{"safari", regexp.MustCompile(`Version/(\d+)[.\d]* (?:Mobile/\w+ )?Safari/`)},
+}
+
+// Contradicts describes how userAgent differs from the identity in browser or major
+// version, empty when it agrees
+func (c *ClientIdentity) Contradicts(userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+
+	for _, candidate := range userAgentBrowsers {
+		match := candidate.re.FindStringSubmatch(userAgent)
+		if match == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		if candidate.browser != c.Browser || version != c.Version {
+			return fmt.Sprintf("User-Agent is %s %d, the profile is %s %d", candidate.browser, version, c.Browser, c.Version)
+		}
+
+		return ""
+	}
+
+	return fmt.Sprintf("User-Agent %q is not a browser, the profile is %s %d", userAgent, c.Browser, c.Version)
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/Kolosok86/http"
+)
+
+func TestBuiltinIdentitiesMatchPresets(t *testing.T) {
+	for setup, identity := range builtinIdentities {
+		hello := getClientHello(setup, "")
+		if strconv.Itoa(identity.Version) != hello.Version {
+			t.Errorf("%s claims version %d, its ClientHello is %s", setup, identity.Version, hello.Str())
+		}
+	}
+
+	if id := builtinIdentities["chrome"]; id.Version != 120 || id.Contradicts(id.UserAgentString()) != "" {
+		t.Fatalf("chrome identity = %+v", id)
+	}
+}
+
+func TestApplyClientHints(t *testing.T) {
+	chrome := builtinIdentities["chrome"]
+	firefoxUA := builtinIdentities["firefox"].UserAgentString()
+	chrome131UA := (&ClientIdentity{Browser: "chrome", Version: 131, Platform: "Windows"}).UserAgentString()
+
+	tests := []struct {
+		name      string
+		userAgent string
+		mode      ClientHintsMode
+		wantUA    string
+		wantHints bool
+	}{
+		{"fill without a user agent", "", ClientHintsFill, chrome.UserAgentString(), true},
+		{"fill with a matching user agent", chrome.UserAgentString(), ClientHintsFill, chrome.UserAgentString(), true},
+		{"fill with a contradicting user agent", firefoxUA, ClientHintsFill, firefoxUA, false},
+		{"fill with another chrome version", chrome131UA, ClientHintsFill, chrome131UA, false},
+		{"force", firefoxUA, ClientHintsForce, chrome.UserAgentString(), true},
+		{"off", "", ClientHintsOff, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "https://example.test/", nil)
+			if tt.userAgent != "" {
+				req.Header.Set("User-Agent", tt.userAgent)
+			}
+
+			ApplyClientHints(req, chrome, tt.mode, true)
+
+			if got := req.Header.Get("User-Agent"); got != tt.wantUA {
+				t.Errorf("User-Agent = %q, want %q", got, tt.wantUA)
+			}
+			if got := req.Header.Get("sec-ch-ua") != ""; got != tt.wantHints {
+				t.Errorf("sec-ch-ua sent = %v, want %v", got, tt.wantHints)
+			}
+			if tt.wantHints && req.Header.Get("sec-ch-ua") != chrome.SecCHUA() {
+				t.Errorf("sec-ch-ua = %q, want %q", req.Header.Get("sec-ch-ua"), chrome.SecCHUA())
+			}
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Kolosok86/http"
+	utls "github.com/refraction-networking/utls"
+)
+
+// ConsistencyMode selects what happens to requests whose fingerprint contradicts itself,
+// a higher mode is stricter
+type ConsistencyMode int
+
+const (
+	// ConsistencyOff skips the check
+	ConsistencyOff ConsistencyMode = iota
+	// ConsistencyWarn logs the findings
+	ConsistencyWarn
+	// ConsistencyStrict rejects requests scoring below the minimum
+	ConsistencyStrict
+)
+
+// ParseConsistencyMode parses "off", "warn" or "strict", empty is off
+func ParseConsistencyMode(value string) (ConsistencyMode, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "off", "false", "0":
+		return ConsistencyOff, nil
+	case "warn":
+		return ConsistencyWarn, nil
+	case "strict":
+		return ConsistencyStrict, nil
+	default:
+		return ConsistencyOff, fmt.Errorf("unknown consistency mode %q", value)
+	}
+}
+
+// Points a check costs when it contradicts the claimed browser, they add up to 100
+const (
+	TLS_CONSISTENCY_WEIGHT        = 40
+	H2_CONSISTENCY_WEIGHT         = 25
+	HEADERS_CONSISTENCY_WEIGHT    = 15
+	USER_AGENT_CONSISTENCY_WEIGHT = 20
+)
+
+// DEFAULT_CONSISTENCY_SCORE is the lowest score strict mode lets through
+const DEFAULT_CONSISTENCY_SCORE = 70
+
+// families is a set of browser families, a fingerprint detail narrows it to those sending it
+type families uint8
+
+const (
+	familyChromium families = 1 << iota
+	familyFirefox
+	familySafari
+	familyOkHttp
+
+	familyBrowsers = familyChromium | familyFirefox | familySafari
+)
+
+var familyNames = []struct {
+	family families
+	name   string
+}{
+	{familyChromium, "chromium"},
+	{familyFirefox, "firefox"},
+	{familySafari, "safari"},
+	{familyOkHttp, "okhttp"},
+}
+
+func (f families) String() string {
+	var names []string
+	for _, family := range familyNames {
+		if f&family.family != 0 {
+			names = append(names, family.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "no known client"
+	}
+
+	return strings.Join(names, " or ")
+}
+
+// marker is a fingerprint detail and the families that send it
+type marker struct {
+	name     string
+	families families
+}
+
+// Fingerprint is what a request looks like upstream, the input of CheckConsistency
+type Fingerprint struct {
+	// Setup and JA3 select the ClientHello as proxy-tls-setup and proxy-tls do
+	Setup string
+	JA3   string
+	Spec  SpecOptions
+	// Identity is the browser the profile claims to be, nil for none
+	Identity *ClientIdentity
+
+	Header      http.Header
+	HeaderOrder []string
+	PseudoOrder []string
+
+	// Secure requests go over TLS, HTTP2 ones offer h2 in ALPN
+	Secure bool
+	HTTP2  bool
+}
+
+// ConsistencyFinding is a check that contradicts the claimed browser
+type ConsistencyFinding struct {
+	Check    string   `json:"check"`
+	Message  string   `json:"message"`
+	Detected string   `json:"detected,omitempty"`
+	Details  []string `json:"details,omitempty"`
+	Penalty  int      `json:"penalty"`
+}
+
+// ConsistencyReport scores a fingerprint from 100, consistent, down to 0
+type ConsistencyReport struct {
+	// Family is the browser family the User-Agent or profile claims
+	Family   string               `json:"family"`
+	Score    int                  `json:"score"`
+	Findings []ConsistencyFinding `json:"findings"`
+
+	claimed families
+}
+
+// CheckConsistency compares the ClientHello, HTTP/2 frames, header order and User-Agent of
+// fp with the browser families sending them
+func CheckConsistency(fp Fingerprint) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{Score: 100, Findings: []ConsistencyFinding{}}
+
+	userAgent := fp.Header.Get("User-Agent")
+	report.checkUserAgent(userAgent, fp.Identity)
+
+	if fp.Secure {
+		proto := []string{"h2", "http/1.1"}
+		if !fp.HTTP2 {
+			proto = proto[1:]
+		}
+
+		spec, err := BuildClientHelloSpec(fp.Setup, fp.JA3, userAgent, proto, fp.Spec)
+		if err != nil {
+			return nil, err
+		}
+
+		tls := tlsMarkers(spec)
+		if report.claimed == 0 {
+			report.claimed = intersect(tls)
+		}
+		report.compare("tls", TLS_CONSISTENCY_WEIGHT, tls)
+
+		if fp.HTTP2 {
+			report.compare("h2", H2_CONSISTENCY_WEIGHT, h2Markers(fp.PseudoOrder))
+		}
+	}
+
+	report.compare("headers", HEADERS_CONSISTENCY_WEIGHT, headerMarkers(fp.Header, fp.HeaderOrder, fp.Secure))
+
+	report.Family = "unknown"
+	if report.claimed != 0 {
+		report.Family = report.claimed.String()
+	}
+
+	if report.Score < 0 {
+		report.Score = 0
+	}
+
+	return report, nil
+}
+
+// String describes the report a finding per line
+func (r *ConsistencyReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "family %s, score %d/100\n", r.Family, r.Score)
+
+	for _, finding := range r.Findings {
+		fmt.Fprintf(&b, "%s (-%d): %s\n", finding.Check, finding.Penalty, finding.Message)
+		for _, detail := range finding.Details {
+			fmt.Fprintf(&b, "  %s\n", detail)
+		}
+	}
+
+	return b.String()
+}
+
+func (r *ConsistencyReport) add(finding ConsistencyFinding) {
+	r.Findings = append(r.Findings, finding)
+	r.Score -= finding.Penalty
+}
+
+// Browsers on iOS all run on WebKit and send the hello of Safari
+var userAgentIOS = regexp.MustCompile(`\((?:iPhone|iPad|iPod);`)
+
+var userAgentOkHttp = regexp.MustCompile(`^okhttp/\d+`)
+
+// checkUserAgent sets the claimed family from the User-Agent, or from the profile without a
+// browser one, and reports a User-Agent that is missing or gives the profile away
+func (r *ConsistencyReport) checkUserAgent(userAgent string, identity *ClientIdentity) {
+	r.claimed = userAgentFamily(userAgent)
+	if identity != nil {
+		if r.claimed == 0 {
+			r.claimed = identityFamily(identity)
+		}
+
+		if reason := identity.Contradicts(userAgent); reason != "" {
+			r.add(ConsistencyFinding{Check: "user-agent", Message: reason, Penalty: USER_AGENT_CONSISTENCY_WEIGHT})
+			return
+		}
+	}
+
+	switch {
+	case userAgent == "":
+		r.add(ConsistencyFinding{Check: "user-agent", Message: "no User-Agent, every browser sends one", Penalty: USER_AGENT_CONSISTENCY_WEIGHT})
+	case userAgentFamily(userAgent) == 0:
+		r.add(ConsistencyFinding{Check: "user-agent", Message: fmt.Sprintf("User-Agent %q names no known client", userAgent), Penalty: USER_AGENT_CONSISTENCY_WEIGHT})
+	}
+}
+
+func userAgentFamily(userAgent string) families {
+	if userAgentOkHttp.MatchString(userAgent) {
+		return familyOkHttp
+	}
+
+	for _, candidate := range userAgentBrowsers {
+		if !candidate.re.MatchString(userAgent) {
+			continue
+		}
+
+		if userAgentIOS.MatchString(userAgent) {
+			return familySafari
+		}
+
+		return browserFamily(candidate.browser)
+	}
+
+	return 0
+}
+
+func identityFamily(identity *ClientIdentity) families {
+	if identity.Platform == "iOS" {
+		return familySafari
+	}
+
+	return browserFamily(identity.Browser)
+}
+
+func browserFamily(browser string) families {
+	switch browser {
+	case "chrome", "edge":
+		return familyChromium
+	case "firefox":
+		return familyFirefox
+	case "safari":
+		return familySafari
+	default:
+		return 0
+	}
+}
+
+func intersect(markers []marker) families {
+	all := familyBrowsers | familyOkHttp
+	for _, m := range markers {
+		all &= m.families
+	}
+
+	return all
+}
+
+// compare reports the markers of a check that no single family sends together, or that
+// the claimed family does not send
+func (r *ConsistencyReport) compare(check string, weight int, markers []marker) {
+	if len(markers) == 0 {
+		return
+	}
+
+	detected := intersect(markers)
+	switch {
+	case detected == 0:
+		finding := ConsistencyFinding{Check: check, Message: "no known client sends this combination", Penalty: weight}
+		for _, m := range markers {
+			finding.Details = append(finding.Details, m.name+": "+m.families.String())
+		}
+		r.add(finding)
+	case r.claimed != 0 && detected&r.claimed == 0:
+		finding := ConsistencyFinding{
+			Check:    check,
+			Message:  fmt.Sprintf("looks like %s, the client claims %s", detected, r.claimed),
+			Penalty:  weight,
+			Detected: detected.String(),
+		}
+		for _, m := range markers {
+			if m.families&r.claimed == 0 {
+				finding.Details = append(finding.Details, m.name+": "+m.families.String())
+			}
+		}
+		r.add(finding)
+	}
+}
+
+func greaseMarker(part string, present bool) marker {
+	if present {
+		return marker{"GREASE in " + part, familyChromium | familySafari}
+	}
+
+	return marker{"no GREASE in " + part, familyFirefox | familyOkHttp}
+}
+
+// tlsMarkers lists the parts of a ClientHello that tell browser families apart. GREASE is
+// added to the suites and extensions of a JA3 hello by the User-Agent alone, so a Chrome
+// User-Agent with a Firefox JA3 shows up here as GREASE next to Firefox only extensions.
+// Every JA3 hello offers a GREASE group, so supported groups tell nothing
+func tlsMarkers(spec *utls.ClientHelloSpec) []marker {
+	var markers []marker
+
+	var greaseSuites, greaseExtension bool
+	var tls13 []uint16
+
+	for _, suite := range spec.CipherSuites {
+		if isGREASE(suite) {
+			greaseSuites = true
+		} else if suite>>8 == 0x13 {
+			tls13 = append(tls13, suite)
+		}
+	}
+
+	for _, ext := range spec.Extensions {
+		switch e := ext.(type) {
+		case *utls.UtlsGREASEExtension:
+			greaseExtension = true
+		case *utls.ApplicationSettingsExtension, *utls.ApplicationSettingsExtensionNew:
+			markers = append(markers, marker{"application_settings extension", familyChromium})
+		case *utls.FakeRecordSizeLimitExtension:
+			markers = append(markers, marker{"record_size_limit extension", familyFirefox})
+		case *utls.DelegatedCredentialsExtension:
+			markers = append(markers, marker{"delegated_credentials extension", familyFirefox})
+		case *utls.UtlsCompressCertExtension:
+			brotli := false
+			for _, algo := range e.Algorithms {
+				brotli = brotli || algo == utls.CertCompressionBrotli
+			}
+
+			if brotli {
+				markers = append(markers, marker{"brotli certificate compression", familyChromium | familyFirefox})
+			} else {
+				markers = append(markers, marker{"certificate compression without brotli", familySafari})
+			}
+		}
+	}
+
+	markers = append(markers,
+		greaseMarker("cipher suites", greaseSuites),
+		greaseMarker("extensions", greaseExtension),
+	)
+
+	// Firefox prefers ChaCha20 over AES-256 in TLS 1.3
+	if len(tls13) >= 3 {
+		if tls13[1] == utls.TLS_CHACHA20_POLY1305_SHA256 {
+			markers = append(markers, marker{"TLS 1.3 ChaCha20 before AES-256", familyFirefox})
+		} else {
+			markers = append(markers, marker{"TLS 1.3 AES-256 before ChaCha20", familyChromium | familySafari | familyOkHttp})
+		}
+	}
+
+	return markers
+}
+
+// SETTINGS_INITIAL_WINDOW_SIZE of each family
+var h2Windows = map[uint32]families{
+	6291456:  familyChromium,
+	131072:   familyFirefox,
+	2097152:  familySafari,
+	4194304:  familySafari,
+	16777216: familyOkHttp,
+}
+
+// Pseudo-header orders of each family, by their first letters
+var h2PseudoOrders = map[string]families{
+	"masp": familyChromium,
+	"mpas": familyFirefox | familyOkHttp,
+	"mspa": familySafari,
+	"msap": familySafari,
+}
+
+// h2Markers lists the SETTINGS the transports send and the pseudo-header order of the request
+func h2Markers(pseudoOrder []string) []marker {
+	window := uint32(H2_INITIAL_WINDOW_SIZE)
+	markers := []marker{{fmt.Sprintf("SETTINGS_INITIAL_WINDOW_SIZE %d", window), h2Windows[window]}}
+
+	// The transport falls back to the order of Chrome
+	if len(pseudoOrder) == 0 {
+		pseudoOrder = []string{":method", ":authority", ":scheme", ":path"}
+	}
+
+	var key strings.Builder
+	for _, name := range pseudoOrder {
+		if name = strings.TrimPrefix(name, ":"); name != "" {
+			key.WriteByte(name[0])
+		}
+	}
+
+	markers = append(markers, marker{"pseudo-header order " + strings.Join(pseudoOrder, ","), h2PseudoOrders[key.String()]})
+	return markers
+}
+
+// Header pairs browsers send in a fixed order and the families sending first before then
+var headerPairs = []struct {
+	first, then string
+	families    families
+}{
+	{"user-agent", "accept", familyChromium | familyFirefox},
+	{"accept-encoding", "accept-language", familyChromium},
+	{"sec-fetch-site", "sec-fetch-dest", familyChromium | familySafari},
+	{"sec-fetch-mode", "sec-fetch-dest", familyChromium},
+}
+
+// headerMarkers lists the headers only some families send and the order of header pairs
+// as they go on the wire
+func headerMarkers(header http.Header, order []string, secure bool) []marker {
+	var markers []marker
+
+	if header.Get("sec-ch-ua") != "" {
+		markers = append(markers, marker{"sec-ch-ua header", familyChromium})
+		if !secure {
+			markers = append(markers, marker{"sec-ch-ua header over http", 0})
+		}
+	}
+
+	if header.Get("te") == "trailers" {
+		markers = append(markers, marker{"te: trailers header", familyFirefox})
+	}
+
+	wire := wireOrder(header, order)
+	for _, pair := range headerPairs {
+		first, then := slices.Index(wire, pair.first), slices.Index(wire, pair.then)
+		switch {
+		case first < 0 || then < 0:
+		case first < then:
+			markers = append(markers, marker{pair.first + " before " + pair.then, pair.families})
+		default:
+			markers = append(markers, marker{pair.then + " before " + pair.first, familyBrowsers &^ pair.families})
+		}
+	}
+
+	return markers
+}
+
+// wireOrder returns the lower case header names in the order they are written, those in
+// order first and the rest sorted
+func wireOrder(header http.Header, order []string) []string {
+	var ordered, rest []string
+	for key := range header {
+		if slices.Contains(order, strings.ToLower(key)) {
+			ordered = append(ordered, strings.ToLower(key))
+		} else {
+			rest = append(rest, key)
+		}
+	}
+
+	sort.Slice(ordered, func(i, j int) bool { return slices.Index(order, ordered[i]) < slices.Index(order, ordered[j]) })
+	sort.Strings(rest)
+
+	for _, key := range rest {
+		ordered = append(ordered, strings.ToLower(key))
+	}
+
+	return ordered
+}
@@ -0,0 +1,300 @@
+package core
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Kolosok86/http"
+	utls "github.com/refraction-networking/utls"
+)
+
+const testFirefoxJA3 = "771,4865-4867-4866-49195-49199-52393-52392-49196-49200-49162-49161-49171-49172-156-157-47-53,0-23-65281-10-11-16-5-34-51-43-13-45-28-65037,29-23-24-25-256-257,0"
+
+const (
+	testSafariUA = "Mozilla/5.0 (iPhone; CPU iPhone OS 14_8 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.2 Mobile/15E148 Safari/604.1"
+	testOkHttpUA = "okhttp/4.12.0"
+)
+
+// testHeaders builds a header and its order from name, value pairs in the order sent
+func testHeaders(pairs ...string) (http.Header, []string) {
+	header := make(http.Header)
+	var order []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		header.Add(pairs[i], pairs[i+1])
+		order = append(order, strings.ToLower(pairs[i]))
+	}
+
+	return header, order
+}
+
+// onlyUserAgent sends the User-Agent and nothing else
+func onlyUserAgent(userAgent string) (http.Header, []string) {
+	if userAgent == "" {
+		return make(http.Header), nil
+	}
+
+	return testHeaders("User-Agent", userAgent)
+}
+
+func chromeHeaders(userAgent string) (http.Header, []string) {
+	return testHeaders(
+		"sec-ch-ua", `"Chromium";v="120", "Google Chrome";v="120", "Not?A_Brand";v="99"`,
+		"sec-ch-ua-mobile", "?0",
+		"sec-ch-ua-platform", `"Windows"`,
+		"User-Agent", userAgent,
+		"Accept", "*/*",
+		"Sec-Fetch-Site", "none",
+		"Sec-Fetch-Mode", "navigate",
+		"Sec-Fetch-Dest", "document",
+		"Accept-Encoding", "gzip, deflate, br",
+		"Accept-Language", "en-US,en;q=0.9",
+	)
+}
+
+func firefoxHeaders(userAgent string) (http.Header, []string) {
+	return testHeaders(
+		"User-Agent", userAgent,
+		"Accept", "*/*",
+		"Accept-Language", "en-US,en;q=0.5",
+		"Accept-Encoding", "gzip, deflate, br",
+		"Sec-Fetch-Dest", "document",
+		"Sec-Fetch-Mode", "navigate",
+		"Sec-Fetch-Site", "none",
+		"TE", "trailers",
+	)
+}
+
+func safariHeaders(userAgent string) (http.Header, []string) {
+	return testHeaders(
+		"Sec-Fetch-Site", "none",
+		"Sec-Fetch-Dest", "document",
+		"Accept", "*/*",
+		"Sec-Fetch-Mode", "navigate",
+		"User-Agent", userAgent,
+		"Accept-Language", "en-US,en;q=0.9",
+		"Accept-Encoding", "gzip, deflate, br",
+	)
+}
+
+func TestCheckConsistency(t *testing.T) {
+	firefoxPseudo := []string{":method", ":path", ":authority", ":scheme"}
+	safariPseudo := []string{":method", ":scheme", ":path", ":authority"}
+
+	tests := []struct {
+		name        string
+		setup, ja3  string
+		identity    *ClientIdentity
+		headers     func(string) (http.Header, []string)
+		userAgent   string
+		pseudoOrder []string
+		secure      bool
+		http2       bool
+
+		family string
+		score  int
+		// checks are the findings in the order reported
+		checks []string
+	}{
+		{"chrome", "chrome", "", builtinIdentities["chrome"], chromeHeaders, testChromeUA, nil, true, true, "chromium", 100, nil},
+		{"chrome ja3", "", testChromeJA3, nil, chromeHeaders, testChromeUA, nil, true, true, "chromium", 100, nil},
+		{"firefox http/1.1", "firefox", "", builtinIdentities["firefox"], firefoxHeaders, testFirefoxUA, nil, true, false, "firefox", 100, nil},
+		{"firefox ja3 http/1.1", "", testFirefoxJA3, nil, firefoxHeaders, testFirefoxUA, nil, true, false, "firefox", 100, nil},
+		// The transport sends the HTTP/2 SETTINGS of Chrome whatever the setup
+		{"firefox h2", "firefox", "", builtinIdentities["firefox"], firefoxHeaders, testFirefoxUA, firefoxPseudo, true, true, "firefox", 75, []string{"h2"}},
+		{"ios http/1.1", "ios", "", builtinIdentities["ios"], safariHeaders, testSafariUA, nil, true, false, "safari", 100, nil},
+		{"ios h2", "ios", "", builtinIdentities["ios"], safariHeaders, testSafariUA, safariPseudo, true, true, "safari", 75, []string{"h2"}},
+		{"android http/1.1", "android", "", nil, onlyUserAgent, testOkHttpUA, nil, true, false, "okhttp", 100, nil},
+		{"plain http", "", "", nil, firefoxHeaders, testFirefoxUA, nil, false, false, "firefox", 100, nil},
+
+		{"chrome user agent firefox ja3", "", testFirefoxJA3, nil, chromeHeaders, testChromeUA, nil, true, true, "chromium", 60, []string{"tls"}},
+		{"chrome user agent firefox setup", "firefox", "", nil, chromeHeaders, testChromeUA, nil, true, true, "chromium", 60, []string{"tls"}},
+		{"firefox user agent chrome setup", "chrome", "", nil, firefoxHeaders, testFirefoxUA, firefoxPseudo, true, true, "firefox", 35, []string{"tls", "h2"}},
+		{"chrome pseudo order on firefox", "firefox", "", builtinIdentities["firefox"], firefoxHeaders, testFirefoxUA, nil, true, true, "firefox", 75, []string{"h2"}},
+		{"firefox headers on chrome", "chrome", "", builtinIdentities["chrome"], firefoxHeaders, testChromeUA, nil, true, true, "chromium", 85, []string{"headers"}},
+		{"sec-ch-ua over http", "", "", nil, chromeHeaders, testChromeUA, nil, false, false, "chromium", 85, []string{"headers"}},
+		{"profile contradicts user agent", "chrome", "", builtinIdentities["firefox"], chromeHeaders, testChromeUA, nil, true, true, "chromium", 80, []string{"user-agent"}},
+
+		// Without a User-Agent the ClientHello names the family
+		{"no user agent", "chrome", "", nil, onlyUserAgent, "", nil, true, true, "chromium", 80, []string{"user-agent"}},
+		{"unknown user agent", "", "", nil, onlyUserAgent, "curl/8.4.0", nil, false, false, "unknown", 80, []string{"user-agent"}},
+		{"everything contradicts", "firefox", "", builtinIdentities["firefox"], firefoxHeaders, testChromeUA, firefoxPseudo, true, true, "chromium", 0, []string{"user-agent", "tls", "h2", "headers"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, order := tt.headers(tt.userAgent)
+			report, err := CheckConsistency(Fingerprint{
+				Setup:       tt.setup,
+				JA3:         tt.ja3,
+				Identity:    tt.identity,
+				Header:      header,
+				HeaderOrder: order,
+				PseudoOrder: tt.pseudoOrder,
+				Secure:      tt.secure,
+				HTTP2:       tt.http2,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var checks []string
+			for _, finding := range report.Findings {
+				checks = append(checks, finding.Check)
+			}
+
+			if report.Family != tt.family || report.Score != tt.score || !slices.Equal(checks, tt.checks) {
+				t.Fatalf("report = %s, %d, %v, want %s, %d, %v\n%s", report.Family, report.Score, checks, tt.family, tt.score, tt.checks, report)
+			}
+			if report.Score < 0 || report.Score > 100 {
+				t.Fatalf("score %d out of range", report.Score)
+			}
+		})
+	}
+}
+
+func markerNames(markers []marker) []string {
+	var names []string
+	for _, m := range markers {
+		names = append(names, m.name)
+	}
+
+	return names
+}
+
+func TestTLSMarkers(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup, ja3 string
+		userAgent  string
+		// detected is the families sending every marker, want lists markers that must be there
+		detected families
+		want     []string
+	}{
+		{"chrome", "chrome", "", testChromeUA, familyChromium, []string{"application_settings extension", "brotli certificate compression", "GREASE in cipher suites", "GREASE in extensions", "TLS 1.3 AES-256 before ChaCha20"}},
+		{"firefox", "firefox", "", testFirefoxUA, familyFirefox, []string{"record_size_limit extension", "delegated_credentials extension", "no GREASE in cipher suites", "no GREASE in extensions", "TLS 1.3 ChaCha20 before AES-256"}},
+		// Safari and OkHttp hellos have no marker of their own
+		{"ios", "ios", "", testSafariUA, familyChromium | familySafari, []string{"GREASE in cipher suites", "GREASE in extensions"}},
+		{"android", "android", "", testOkHttpUA, familyFirefox | familyOkHttp, []string{"no GREASE in cipher suites", "no GREASE in extensions"}},
+		{"chrome ja3", "", testChromeJA3, testChromeUA, familyChromium, []string{"application_settings extension", "GREASE in extensions"}},
+		{"firefox ja3", "", testFirefoxJA3, testFirefoxUA, familyFirefox, []string{"record_size_limit extension", "no GREASE in extensions"}},
+		// The User-Agent adds GREASE to the Firefox extensions, no browser sends both
+		{"chrome user agent firefox ja3", "", testFirefoxJA3, testChromeUA, 0, []string{"record_size_limit extension", "GREASE in extensions"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := BuildClientHelloSpec(tt.setup, tt.ja3, tt.userAgent, []string{"h2", "http/1.1"}, SpecOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			markers := tlsMarkers(spec)
+			names := markerNames(markers)
+			for _, name := range tt.want {
+				if !slices.Contains(names, name) {
+					t.Errorf("marker %q missing from %v", name, names)
+				}
+			}
+
+			if got := intersect(markers); got != tt.detected {
+				t.Errorf("detected %s, want %s (%v)", got, tt.detected, names)
+			}
+		})
+	}
+
+	// Certificate compression without brotli is what Safari offers
+	spec := &utls.ClientHelloSpec{Extensions: []utls.TLSExtension{
+		&utls.UtlsCompressCertExtension{Algorithms: []utls.CertCompressionAlgo{utls.CertCompressionZlib}},
+	}}
+	if names := markerNames(tlsMarkers(spec)); !slices.Contains(names, "certificate compression without brotli") {
+		t.Errorf("zlib compression markers = %v", names)
+	}
+}
+
+func TestH2Markers(t *testing.T) {
+	tests := []struct {
+		pseudoOrder []string
+		// pseudo is the families of the pseudo-header order, detected those of every marker
+		pseudo   families
+		detected families
+	}{
+		{nil, familyChromium, familyChromium},
+		{[]string{":method", ":authority", ":scheme", ":path"}, familyChromium, familyChromium},
+		{[]string{":method", ":path", ":authority", ":scheme"}, familyFirefox | familyOkHttp, 0},
+		{[]string{":method", ":scheme", ":path", ":authority"}, familySafari, 0},
+		{[]string{"method", "scheme", "authority", "path"}, familySafari, 0},
+		{[]string{":path", ":method", ":authority", ":scheme"}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		markers := h2Markers(tt.pseudoOrder)
+		if len(markers) != 2 || markers[0].families != familyChromium {
+			t.Fatalf("%v markers = %v", tt.pseudoOrder, markerNames(markers))
+		}
+
+		if markers[1].families != tt.pseudo || intersect(markers) != tt.detected {
+			t.Errorf("%v = %s, detected %s, want %s, %s", tt.pseudoOrder, markers[1].families, intersect(markers), tt.pseudo, tt.detected)
+		}
+	}
+}
+
+func TestHeaderMarkers(t *testing.T) {
+	chrome, chromeOrder := chromeHeaders(testChromeUA)
+	firefox, firefoxOrder := firefoxHeaders(testFirefoxUA)
+	safari, safariOrder := safariHeaders(testSafariUA)
+
+	// Headers outside the order go out sorted after it
+	unordered, _ := testHeaders("User-Agent", testChromeUA, "Accept", "*/*", "Accept-Encoding", "br", "Accept-Language", "en")
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		order    []string
+		secure   bool
+		detected families
+		want     []string
+	}{
+		{"chrome", chrome, chromeOrder, true, familyChromium, []string{"sec-ch-ua header", "user-agent before accept", "accept-encoding before accept-language", "sec-fetch-mode before sec-fetch-dest"}},
+		{"firefox", firefox, firefoxOrder, true, familyFirefox, []string{"te: trailers header", "accept-language before accept-encoding", "sec-fetch-dest before sec-fetch-site"}},
+		{"safari", safari, safariOrder, true, familySafari, []string{"accept before user-agent", "sec-fetch-site before sec-fetch-dest", "sec-fetch-dest before sec-fetch-mode"}},
+		{"sec-ch-ua over http", chrome, chromeOrder, false, 0, []string{"sec-ch-ua header over http"}},
+		{"chrome order over firefox headers", firefox, chromeOrder, true, 0, []string{"te: trailers header", "accept-encoding before accept-language"}},
+		{"sorted", unordered, nil, true, 0, []string{"accept before user-agent", "accept-encoding before accept-language"}},
+		{"no headers", make(http.Header), nil, true, familyBrowsers | familyOkHttp, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			markers := headerMarkers(tt.header, tt.order, tt.secure)
+			names := markerNames(markers)
+			for _, name := range tt.want {
+				if !slices.Contains(names, name) {
+					t.Errorf("marker %q missing from %v", name, names)
+				}
+			}
+
+			if got := intersect(markers); got != tt.detected {
+				t.Errorf("detected %s, want %s (%v)", got, tt.detected, names)
+			}
+		})
+	}
+}
+
+func TestParseConsistencyMode(t *testing.T) {
+	for value, want := range map[string]ConsistencyMode{
+		"":       ConsistencyOff,
+		"off":    ConsistencyOff,
+		"0":      ConsistencyOff,
+		" Warn ": ConsistencyWarn,
+		"STRICT": ConsistencyStrict,
+	} {
+		if got, err := ParseConsistencyMode(value); err != nil || got != want {
+			t.Errorf("ParseConsistencyMode(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+
+	if _, err := ParseConsistencyMode("loud"); err == nil {
+		t.Error("ParseConsistencyMode accepted an unknown mode")
+	}
+}
@@ -0,0 +1,396 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Cookies a jar keeps per site (registrable domain) and in total, like a browser the oldest
+// cookies are dropped to make room
+const (
+	MAX_SITE_COOKIES = 180
+	MAX_JAR_COOKIES  = 3000
+)
+
+// JarCookie is a stored cookie as exported and imported through JSON
+type JarCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain"`
+	Path     string     `json:"path"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"httpOnly,omitempty"`
+	HostOnly bool       `json:"hostOnly,omitempty"`
+	SameSite string     `json:"sameSite,omitempty"`
+}
+
+// CookieJar is an RFC 6265 cookie store that can be exported and imported
+type CookieJar struct {
+	sync.Mutex
+
+	entries map[string]*jarEntry
+	seq     uint64
+}
+
+type jarEntry struct {
+	JarCookie
+	// created orders cookies of the same path length like a browser
+	created uint64
+	// site is the registrable domain the cookie counts against
+	site string
+}
+
+// NewCookieJar creates an empty jar
+func NewCookieJar() *CookieJar {
+	return &CookieJar{entries: make(map[string]*jarEntry)}
+}
+
+func jarKey(domain, path, name string) string {
+	return domain + ";" + path + ";" + name
+}
+
+// SetCookies stores the Set-Cookie values of a response to u
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := canonicalHost(u.Hostname())
+	now := time.Now()
+
+	j.Lock()
+	defer j.Unlock()
+
+	for _, cookie := range cookies {
+		entry := JarCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   host,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			HostOnly: true,
+			SameSite: sameSiteName(cookie.SameSite),
+		}
+
+		if cookie.Domain != "" {
+			domain := canonicalHost(strings.TrimPrefix(cookie.Domain, "."))
+			if !domainMatch(host, domain) {
+				continue
+			}
+
+			// Like a browser, no cookie for a whole public suffix (co.uk, github.io), one set by
+			// the suffix itself stays host-only
+			if suffix, _ := publicsuffix.PublicSuffix(domain); suffix == domain {
+				if domain != host {
+					continue
+				}
+			} else {
+				// An address only matches itself
+				entry.Domain, entry.HostOnly = domain, net.ParseIP(host) != nil
+			}
+		}
+
+		if !strings.HasPrefix(entry.Path, "/") {
+			entry.Path = defaultCookiePath(u.Path)
+		}
+
+		key := jarKey(entry.Domain, entry.Path, entry.Name)
+
+		switch {
+		case cookie.MaxAge < 0:
+			delete(j.entries, key)
+			continue
+		case cookie.MaxAge > 0:
+			expires := now.Add(time.Duration(cookie.MaxAge) * time.Second)
+			entry.Expires = &expires
+		case !cookie.Expires.IsZero():
+			if !cookie.Expires.After(now) {
+				delete(j.entries, key)
+				continue
+			}
+			expires := cookie.Expires
+			entry.Expires = &expires
+		}
+
+		j.store(key, entry)
+	}
+}
+
+// store saves entry under key, keeping the creation order of a replaced cookie; the lock must be held
+func (j *CookieJar) store(key string, entry JarCookie) {
+	if old, ok := j.entries[key]; ok {
+		j.entries[key] = &jarEntry{JarCookie: entry, created: old.created, site: old.site}
+		return
+	}
+
+	j.seq++
+	j.entries[key] = &jarEntry{JarCookie: entry, created: j.seq, site: cookieSite(entry.Domain)}
+
+	j.evict(j.entries[key].site)
+}
+
+// evict drops expired cookies, then the oldest ones of site and of the jar while they are
+// over their caps; the lock must be held
+func (j *CookieJar) evict(site string) {
+	now := time.Now()
+
+	count := 0
+	for key, entry := range j.entries {
+		if entry.Expires != nil && !entry.Expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+
+		if entry.site == site {
+			count++
+		}
+	}
+
+	for ; count > MAX_SITE_COOKIES; count-- {
+		j.removeOldest(func(entry *jarEntry) bool { return entry.site == site })
+	}
+
+	for len(j.entries) > MAX_JAR_COOKIES {
+		j.removeOldest(func(*jarEntry) bool { return true })
+	}
+}
+
+// removeOldest deletes the first created cookie match accepts; the lock must be held
+func (j *CookieJar) removeOldest(match func(*jarEntry) bool) {
+	var oldest string
+	var created uint64
+
+	for key, entry := range j.entries {
+		if match(entry) && (oldest == "" || entry.created < created) {
+			oldest, created = key, entry.created
+		}
+	}
+
+	delete(j.entries, oldest)
+}
+
+// cookieSite groups cookies of subdomains by their registrable domain, an address or a
+// public suffix is a site of its own
+func cookieSite(domain string) string {
+	if site, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return site
+	}
+
+	return domain
+}
+
+// Cookies returns the cookies to send to u, longer paths first
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := canonicalHost(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	now := time.Now()
+
+	j.Lock()
+	defer j.Unlock()
+
+	var matched []*jarEntry
+	for key, entry := range j.entries {
+		if entry.Expires != nil && !entry.Expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+
+		if entry.HostOnly && host != entry.Domain || !entry.HostOnly && !domainMatch(host, entry.Domain) {
+			continue
+		}
+
+		if !pathMatch(path, entry.Path) || entry.Secure && !secure {
+			continue
+		}
+
+		matched = append(matched, entry)
+	}
+
+	sort.Slice(matched, func(a, b int) bool {
+		if len(matched[a].Path) != len(matched[b].Path) {
+			return len(matched[a].Path) > len(matched[b].Path)
+		}
+		return matched[a].created < matched[b].created
+	})
+
+	cookies := make([]*http.Cookie, 0, len(matched))
+	for _, entry := range matched {
+		cookies = append(cookies, &http.Cookie{Name: entry.Name, Value: entry.Value})
+	}
+
+	return cookies
+}
+
+// Export returns every live cookie ordered by domain, path and name
+func (j *CookieJar) Export() []JarCookie {
+	now := time.Now()
+
+	j.Lock()
+	defer j.Unlock()
+
+	cookies := make([]JarCookie, 0, len(j.entries))
+	for _, entry := range j.entries {
+		if entry.Expires == nil || entry.Expires.After(now) {
+			cookies = append(cookies, entry.JarCookie)
+		}
+	}
+
+	sort.Slice(cookies, func(a, b int) bool {
+		if cookies[a].Domain != cookies[b].Domain {
+			return cookies[a].Domain < cookies[b].Domain
+		}
+		if cookies[a].Path != cookies[b].Path {
+			return cookies[a].Path < cookies[b].Path
+		}
+		return cookies[a].Name < cookies[b].Name
+	})
+
+	return cookies
+}
+
+// Import replaces the content of the jar with cookies
+func (j *CookieJar) Import(cookies []JarCookie) error {
+	entries := make([]JarCookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name == "" || cookie.Domain == "" {
+			return fmt.Errorf("invalid cookie %q: name and domain are required", cookie.Name)
+		}
+
+		cookie.Domain = canonicalHost(strings.TrimPrefix(cookie.Domain, "."))
+		if !strings.HasPrefix(cookie.Path, "/") {
+			cookie.Path = "/"
+		}
+
+		entries = append(entries, cookie)
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.entries = make(map[string]*jarEntry, len(entries))
+	for _, entry := range entries {
+		j.store(jarKey(entry.Domain, entry.Path, entry.Name), entry)
+	}
+
+	return nil
+}
+
+// Except returns a view of the jar that leaves out cookies the request already carries,
+// so the client's own Cookie header wins over stored values
+func (j *CookieJar) Except(req *http.Request) http.CookieJar {
+	names := make(map[string]bool)
+	for _, cookie := range req.Cookies() {
+		names[cookie.Name] = true
+	}
+
+	return &jarView{jar: j, except: names}
+}
+
+type jarView struct {
+	jar    *CookieJar
+	except map[string]bool
+}
+
+func (v *jarView) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	v.jar.SetCookies(u, cookies)
+}
+
+func (v *jarView) Cookies(u *url.URL) []*http.Cookie {
+	cookies := v.jar.Cookies(u)
+	if len(v.except) == 0 {
+		return cookies
+	}
+
+	kept := cookies[:0]
+	for _, cookie := range cookies {
+		if !v.except[cookie.Name] {
+			kept = append(kept, cookie)
+		}
+	}
+
+	return kept
+}
+
+// PlaceCookieHeader puts the cookie header where browsers send it, after accept-language,
+// when the request keeps a header order that has none
+func PlaceCookieHeader(req *http.Request) {
+	order := req.HeaderOrder.Order
+	if len(order) == 0 || req.HeaderOrder.FindIndex("cookie") != -1 {
+		return
+	}
+
+	at := len(order)
+	for _, anchor := range []string{"accept-language", "accept-encoding"} {
+		if i := req.HeaderOrder.FindIndex(anchor); i != -1 {
+			at = i + 1
+			break
+		}
+	}
+
+	order = append(order[:at:at], append([]string{"cookie"}, order[at:]...)...)
+	req.HeaderOrder.Order = order
+}
+
+func canonicalHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// domainMatch implements the domain-match of RFC 6265 section 5.1.3
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+
+	return net.ParseIP(host) == nil && strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatch implements the path-match of RFC 6265 section 5.1.4
+func pathMatch(path, cookiePath string) bool {
+	if path == cookiePath {
+		return true
+	}
+
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+
+	return strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+// defaultCookiePath implements the default-path of RFC 6265 section 5.1.4
+func defaultCookiePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/"
+	}
+
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+
+	return path[:i]
+}
+
+func sameSiteName(mode http.SameSite) string {
+	switch mode {
+	case http.SameSiteLaxMode:
+		return "lax"
+	case http.SameSiteStrictMode:
+		return "strict"
+	case http.SameSiteNoneMode:
+		return "none"
+	default:
+		return ""
+	}
+}
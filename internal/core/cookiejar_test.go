@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+)
+
+func TestCookieJarDomainAttribute(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		domain   string
+		stored   bool
+		hostOnly bool
+		// sent lists hosts that get the cookie back, other lists hosts that do not
+		sent, other []string
+	}{
+		{"parent domain", "www.example.co.uk", ".example.co.uk", true, false, []string{"example.co.uk", "a.example.co.uk"}, []string{"other.co.uk"}},
+		{"public suffix", "www.example.co.uk", "co.uk", false, false, nil, []string{"other.co.uk"}},
+		{"private suffix", "user.github.io", "github.io", false, false, nil, []string{"other.github.io"}},
+		{"top level domain", "www.example.com", "com", false, false, nil, nil},
+		{"suffix setting itself", "github.io", "github.io", true, true, []string{"github.io"}, []string{"user.github.io"}},
+		{"foreign domain", "www.example.com", "example.org", false, false, nil, nil},
+		{"address", "192.0.2.1", "192.0.2.1", true, true, []string{"192.0.2.1"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jar := NewCookieJar()
+			jar.SetCookies(&url.URL{Scheme: "https", Host: tt.host, Path: "/"}, []*http.Cookie{
+				{Name: "id", Value: "1", Domain: tt.domain, Path: "/"},
+			})
+
+			cookies := jar.Export()
+			if (len(cookies) != 0) != tt.stored {
+				t.Fatalf("stored cookies = %+v, want stored %v", cookies, tt.stored)
+			}
+			if tt.stored && cookies[0].HostOnly != tt.hostOnly {
+				t.Fatalf("hostOnly = %v, want %v", cookies[0].HostOnly, tt.hostOnly)
+			}
+
+			for _, host := range tt.sent {
+				if len(jar.Cookies(&url.URL{Scheme: "https", Host: host, Path: "/"})) != 1 {
+					t.Errorf("cookie not sent to %s", host)
+				}
+			}
+			for _, host := range tt.other {
+				if len(jar.Cookies(&url.URL{Scheme: "https", Host: host, Path: "/"})) != 0 {
+					t.Errorf("cookie sent to %s", host)
+				}
+			}
+		})
+	}
+}
+
+func TestCookieJarSiteCap(t *testing.T) {
+	jar := NewCookieJar()
+
+	// Subdomains count against the same site
+	for i := 0; i < MAX_SITE_COOKIES+5; i++ {
+		host := "www.example.com"
+		if i%2 == 1 {
+			host = "api.example.com"
+		}
+
+		jar.SetCookies(&url.URL{Scheme: "https", Host: host, Path: "/"}, []*http.Cookie{
+			{Name: fmt.Sprintf("c%d", i), Value: "1", Path: "/"},
+		})
+	}
+	jar.SetCookies(&url.URL{Scheme: "https", Host: "example.org", Path: "/"}, []*http.Cookie{{Name: "other", Value: "1"}})
+
+	// Replacing a cookie keeps its place and does not evict
+	jar.SetCookies(&url.URL{Scheme: "https", Host: "www.example.com", Path: "/"}, []*http.Cookie{{Name: "c6", Value: "2", Path: "/"}})
+
+	names := map[string]bool{}
+	for _, cookie := range jar.Export() {
+		names[cookie.Name] = true
+	}
+
+	if len(names) != MAX_SITE_COOKIES+1 {
+		t.Fatalf("jar keeps %d cookies, want %d", len(names), MAX_SITE_COOKIES+1)
+	}
+	for i := 0; i < 5; i++ {
+		if names[fmt.Sprintf("c%d", i)] {
+			t.Errorf("oldest cookie c%d was kept", i)
+		}
+	}
+	if !names["c5"] || !names["c6"] || !names[fmt.Sprintf("c%d", MAX_SITE_COOKIES+4)] || !names["other"] {
+		t.Fatal("newer cookies or another site's cookie were dropped")
+	}
+}
+
+func TestCookieJarTotalCap(t *testing.T) {
+	jar := NewCookieJar()
+
+	var cookies []JarCookie
+	for i := 0; i < MAX_JAR_COOKIES+10; i++ {
+		cookies = append(cookies, JarCookie{Name: "id", Value: "1", Domain: fmt.Sprintf("site%d.example", i), Path: "/"})
+	}
+
+	if err := jar.Import(cookies); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := jar.Export()
+	if len(exported) != MAX_JAR_COOKIES {
+		t.Fatalf("jar keeps %d cookies, want %d", len(exported), MAX_JAR_COOKIES)
+	}
+
+	for _, cookie := range exported {
+		var n int
+		fmt.Sscanf(cookie.Domain, "site%d.example", &n)
+		if n < 10 {
+			t.Fatalf("oldest cookie of %s was kept", cookie.Domain)
+		}
+	}
+}
+
+func TestCookieJarEvictsExpiredFirst(t *testing.T) {
+	jar := NewCookieJar()
+	u := &url.URL{Scheme: "https", Host: "example.com", Path: "/"}
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "oldest", Value: "1", Path: "/"}})
+
+	var cookies []*http.Cookie
+	for i := 0; i < MAX_SITE_COOKIES-1; i++ {
+		cookies = append(cookies, &http.Cookie{Name: fmt.Sprintf("c%d", i), Value: "1", Path: "/"})
+	}
+	jar.SetCookies(u, cookies)
+
+	// The last one expires, the new cookie takes its place instead of the oldest one
+	jar.Lock()
+	past := time.Now().Add(-time.Second)
+	jar.entries[jarKey("example.com", "/", fmt.Sprintf("c%d", MAX_SITE_COOKIES-2))].Expires = &past
+	jar.Unlock()
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "new", Value: "1", Path: "/"}})
+
+	names := map[string]bool{}
+	for _, cookie := range jar.Export() {
+		names[cookie.Name] = true
+	}
+	if !names["oldest"] || !names["new"] || len(names) != MAX_SITE_COOKIES {
+		t.Fatalf("jar keeps %d cookies, oldest %v, new %v", len(names), names["oldest"], names["new"])
+	}
+}
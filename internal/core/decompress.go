@@ -0,0 +1,177 @@
+package core
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Kolosok86/http"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DecompressMode decides what happens to compressed upstream responses
+type DecompressMode int
+
+const (
+	// DecompressPassthrough relays the body and its Content-Encoding byte for byte
+	DecompressPassthrough DecompressMode = iota
+	// DecompressDecode decodes the body and drops Content-Encoding and Content-Length
+	DecompressDecode
+)
+
+// ParseDecompressMode reads "passthrough" (or "off") and "decode"
+func ParseDecompressMode(value string) (DecompressMode, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "passthrough", "off":
+		return DecompressPassthrough, nil
+	case "decode":
+		return DecompressDecode, nil
+	default:
+		return DecompressPassthrough, fmt.Errorf("invalid decompress mode %q", value)
+	}
+}
+
+// DecodeResponse replaces a gzip, br, zstd or deflate encoded body with the decoded stream,
+// stacked encodings are undone in reverse order. Responses with an unknown coding and
+// partial content are left as they are, decoding errors surface when the body is read
+func DecodeResponse(resp *http.Response) {
+	encodings := contentEncodings(resp.Header.Get("Content-Encoding"))
+	if len(encodings) == 0 || resp.StatusCode == http.StatusPartialContent {
+		return
+	}
+
+	for _, encoding := range encodings {
+		if !supportedEncoding(encoding) {
+			return
+		}
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+
+	// A bodyless response only describes the decoded representation
+	if resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 {
+		resp.ContentLength = -1
+		return
+	}
+
+	body := &decodedBody{body: resp.Body, Reader: resp.Body}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		dec := &decoder{encoding: encodings[i], src: body.Reader}
+		body.decoders = append(body.decoders, dec)
+		body.Reader = dec
+	}
+
+	resp.Body = body
+	resp.ContentLength = -1
+}
+
+// contentEncodings lists the codings of a Content-Encoding value in applied order, identity skipped
+func contentEncodings(value string) []string {
+	var encodings []string
+	for _, encoding := range strings.Split(value, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding != "" && encoding != "identity" {
+			encodings = append(encodings, encoding)
+		}
+	}
+
+	return encodings
+}
+
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case "gzip", "x-gzip", "deflate", "br", "zstd":
+		return true
+	}
+
+	return false
+}
+
+// decodedBody reads through a chain of decoders and closes them with the upstream body
+type decodedBody struct {
+	io.Reader
+	body     io.ReadCloser
+	decoders []*decoder
+}
+
+func (b *decodedBody) Close() error {
+	for _, dec := range b.decoders {
+		dec.Close()
+	}
+
+	return b.body.Close()
+}
+
+// decoder opens its decompressor on the first read, so headers are sent before the body arrives
+type decoder struct {
+	encoding string
+	src      io.Reader
+	reader   io.Reader
+	close    func()
+	err      error
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	if d.reader == nil && d.err == nil {
+		d.reader, d.close, d.err = newDecompressor(d.encoding, d.src)
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return d.reader.Read(p)
+}
+
+func (d *decoder) Close() {
+	if d.close != nil {
+		d.close()
+	}
+}
+
+func newDecompressor(encoding string, src io.Reader) (io.Reader, func(), error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { _ = reader.Close() }, nil
+	case "deflate":
+		return newDeflateReader(src)
+	case "br":
+		return brotli.NewReader(src), nil, nil
+	case "zstd":
+		reader, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, reader.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// newDeflateReader accepts the zlib stream RFC 9110 calls deflate and the raw
+// deflate stream some servers send instead
+func newDeflateReader(src io.Reader) (io.Reader, func(), error) {
+	buffered := bufio.NewReader(src)
+
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		reader, err := zlib.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { _ = reader.Close() }, nil
+	}
+
+	reader := flate.NewReader(buffered)
+	return reader, func() { _ = reader.Close() }, nil
+}
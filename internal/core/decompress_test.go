@@ -0,0 +1,181 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/Kolosok86/http"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const testPlainBody = "Hello, decoded world! Hello, decoded world! Hello, decoded world!"
+
+// encodeBody applies the codings in order like a server writing Content-Encoding
+func encodeBody(t *testing.T, data []byte, encodings ...string) []byte {
+	t.Helper()
+
+	for _, encoding := range encodings {
+		var buf bytes.Buffer
+		var writer io.WriteCloser
+
+		switch encoding {
+		case "gzip":
+			writer = gzip.NewWriter(&buf)
+		case "br":
+			writer = brotli.NewWriter(&buf)
+		case "zstd":
+			writer, _ = zstd.NewWriter(&buf)
+		case "zlib":
+			writer = zlib.NewWriter(&buf)
+		case "raw deflate":
+			writer, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		default:
+			t.Fatalf("unknown test encoding %q", encoding)
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data = buf.Bytes()
+	}
+
+	return data
+}
+
+func encodedResponse(status int, contentEncoding string, body []byte) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Encoding", contentEncoding)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentEncoding string
+		applied         []string
+	}{
+		{"gzip", "gzip", []string{"gzip"}},
+		{"x-gzip", "x-gzip", []string{"gzip"}},
+		{"brotli", "br", []string{"br"}},
+		{"zstd", "zstd", []string{"zstd"}},
+		{"zlib deflate", "deflate", []string{"zlib"}},
+		{"raw deflate", "deflate", []string{"raw deflate"}},
+		{"stacked", "gzip, br", []string{"gzip", "br"}},
+		{"identity skipped", "identity, GZIP", []string{"gzip"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := encodedResponse(http.StatusOK, tt.contentEncoding, encodeBody(t, []byte(testPlainBody), tt.applied...))
+			DecodeResponse(resp)
+
+			if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" {
+				t.Fatalf("headers kept after decoding: %v", resp.Header)
+			}
+			if resp.ContentLength != -1 {
+				t.Fatalf("ContentLength = %d, want -1", resp.ContentLength)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != testPlainBody {
+				t.Fatalf("body = %q, want %q", body, testPlainBody)
+			}
+
+			if err := resp.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseLeavesUntouched(t *testing.T) {
+	gzipped := encodeBody(t, []byte(testPlainBody), "gzip")
+
+	tests := []struct {
+		name            string
+		status          int
+		contentEncoding string
+	}{
+		{"partial content", http.StatusPartialContent, "gzip"},
+		{"unknown coding", http.StatusOK, "compress"},
+		{"unknown coding stacked", http.StatusOK, "gzip, custom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := encodedResponse(tt.status, tt.contentEncoding, gzipped)
+			DecodeResponse(resp)
+
+			if got := resp.Header.Get("Content-Encoding"); got != tt.contentEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.contentEncoding)
+			}
+			if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(gzipped)) || resp.ContentLength != int64(len(gzipped)) {
+				t.Fatalf("Content-Length = %q (%d), want %d", got, resp.ContentLength, len(gzipped))
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(body, gzipped) {
+				t.Fatal("body changed")
+			}
+		})
+	}
+}
+
+func TestDecodeResponseErrors(t *testing.T) {
+	resp := encodedResponse(http.StatusOK, "gzip", []byte("not gzip"))
+	DecodeResponse(resp)
+
+	// Headers go out before the body, a broken stream fails on read
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal("Content-Encoding kept")
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatal("a broken gzip body read without error")
+	}
+
+	// A bodyless response only loses the headers
+	head := encodedResponse(http.StatusOK, "br", nil)
+	head.Body = http.NoBody
+	DecodeResponse(head)
+
+	if head.Body != http.NoBody || head.ContentLength != -1 || head.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("bodyless response = %+v", head)
+	}
+}
+
+func TestParseDecompressMode(t *testing.T) {
+	for value, want := range map[string]DecompressMode{
+		"":            DecompressPassthrough,
+		"passthrough": DecompressPassthrough,
+		"OFF":         DecompressPassthrough,
+		" decode ":    DecompressDecode,
+	} {
+		if got, err := ParseDecompressMode(value); err != nil || got != want {
+			t.Errorf("ParseDecompressMode(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+
+	if _, err := ParseDecompressMode("gunzip"); err == nil {
+		t.Error("ParseDecompressMode accepted an unknown mode")
+	}
+}
@@ -0,0 +1,310 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTypeHTTPS   = dnsmessage.Type(65)
+	svcParamKeyECH = 5
+
+	echLookupTimeout  = 3 * time.Second
+	echNegativeTTL    = 5 * time.Minute
+	defaultNameserver = "127.0.0.1:53"
+)
+
+// Hosts whose looked up ECH config is cached, expired entries and then arbitrary ones make
+// room beyond it
+const MAX_ECH_HOSTS = 4096
+
+var errNoECHConfig = errors.New("no ech config in HTTPS record")
+
+// ECHConfig supplies Encrypted Client Hello configurations for upstream hosts
+type ECHConfig struct {
+	sync.Mutex
+
+	// Hosts maps a host to its ECHConfigList
+	Hosts map[string][]byte
+	// LookupDNS fetches the ECHConfigList from the HTTPS record of a host
+	LookupDNS bool
+	// Nameserver answers HTTPS record queries, empty means the server of Resolver or the
+	// first resolv.conf entry
+	Nameserver string
+	// Resolver sends the HTTPS record queries over its DNS, DoT or DoH server
+	Resolver *Resolver
+
+	cache map[string]echCacheEntry
+}
+
+type echCacheEntry struct {
+	configList []byte
+	expires    time.Time
+}
+
+// ParseECHConfigList decodes a base64 ECHConfigList as found in HTTPS records
+func ParseECHConfigList(value string) ([]byte, error) {
+	configList, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(configList) < 2 {
+		return nil, fmt.Errorf("invalid ECHConfigList %q", value)
+	}
+
+	return configList, nil
+}
+
+// AddHost parses a "host=base64" value and registers the ECHConfigList of host
+func (ec *ECHConfig) AddHost(value string) error {
+	host, encoded, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return fmt.Errorf("invalid ech config %q: expected host=base64", value)
+	}
+
+	configList, err := ParseECHConfigList(encoded)
+	if err != nil {
+		return err
+	}
+
+	if ec.Hosts == nil {
+		ec.Hosts = make(map[string][]byte)
+	}
+
+	ec.Hosts[strings.ToLower(host)] = configList
+	return nil
+}
+
+// configList returns the ECHConfigList for host, or nil when only GREASE ECH applies
+func (ec *ECHConfig) configList(ctx context.Context, host string) []byte {
+	if ec == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	if configList, ok := ec.Hosts[host]; ok {
+		return configList
+	}
+
+	if !ec.LookupDNS || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ec.Lock()
+	entry, ok := ec.cache[host]
+	ec.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.configList
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, echLookupTimeout)
+	defer cancel()
+
+	configList, ttl, err := ec.resolver().lookupECHConfigList(lookupCtx, host)
+	if err != nil {
+		// A request that ended during the lookup says nothing about the host
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			return nil
+		}
+
+		configList, ttl = nil, echNegativeTTL
+	}
+
+	ec.Lock()
+	if ec.cache == nil {
+		ec.cache = make(map[string]echCacheEntry)
+	}
+	if _, ok := ec.cache[host]; !ok && len(ec.cache) >= MAX_ECH_HOSTS {
+		ec.prune()
+	}
+	ec.cache[host] = echCacheEntry{configList: configList, expires: time.Now().Add(ttl)}
+	ec.Unlock()
+
+	return configList
+}
+
+// prune drops expired entries, then arbitrary ones until there is room; the lock must be held
+func (ec *ECHConfig) prune() {
+	now := time.Now()
+	for host, entry := range ec.cache {
+		if now.After(entry.expires) {
+			delete(ec.cache, host)
+		}
+	}
+
+	for host := range ec.cache {
+		if len(ec.cache) < MAX_ECH_HOSTS {
+			break
+		}
+		delete(ec.cache, host)
+	}
+}
+
+// resolver returns the resolver of HTTPS record queries, plain DNS unless a configured
+// resolver has its own server
+func (ec *ECHConfig) resolver() *Resolver {
+	if ec.Nameserver == "" && ec.Resolver != nil && ec.Resolver.upstream != nil {
+		return ec.Resolver
+	}
+
+	return &Resolver{upstream: &url.URL{Scheme: "udp", Host: ec.nameserver()}}
+}
+
+func (ec *ECHConfig) nameserver() string {
+	if ec.Nameserver != "" {
+		return withDefaultPort(ec.Nameserver, "53")
+	}
+
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return defaultNameserver
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+
+	return defaultNameserver
+}
+
+// lookupECHConfigList queries the HTTPS record of host and extracts its ech parameter,
+// a truncated UDP answer is retried over TCP
+func (r *Resolver) lookupECHConfigList(ctx context.Context, host string) ([]byte, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsTypeHTTPS, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	// DoH uses ID 0 so answers stay cacheable by HTTP caches
+	if r.upstream.Scheme == "https" {
+		query.Header.ID = 0
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := r.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if header.ID != query.Header.ID {
+		return nil, 0, errors.New("dns response id mismatch")
+	}
+
+	if err = parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return nil, 0, errNoECHConfig
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if answer.Type != dnsTypeHTTPS {
+			if err = parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		resource, err := parser.UnknownResource()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if configList := parseSVCBECH(resource.Data); configList != nil {
+			return configList, time.Duration(answer.TTL) * time.Second, nil
+		}
+	}
+}
+
+// parseSVCBECH returns the ech SvcParam of a SVCB / HTTPS record (RFC 9460)
+func parseSVCBECH(data []byte) []byte {
+	if len(data) < 3 {
+		return nil
+	}
+
+	// Skip SvcPriority and the uncompressed TargetName
+	off := 2
+	for off < len(data) && data[off] != 0 {
+		off += int(data[off]) + 1
+	}
+	off++
+
+	for off+4 <= len(data) {
+		key := binary.BigEndian.Uint16(data[off:])
+		length := int(binary.BigEndian.Uint16(data[off+2:]))
+		off += 4
+
+		if off+length > len(data) {
+			return nil
+		}
+
+		if key == svcParamKeyECH {
+			return data[off : off+length]
+		}
+
+		off += length
+	}
+
+	return nil
+}
+
+func hasECHExtension(spec *utls.ClientHelloSpec) bool {
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(utls.EncryptedClientHelloExtension); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeECHExtension(spec *utls.ClientHelloSpec) {
+	exts := spec.Extensions[:0]
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(utls.EncryptedClientHelloExtension); !ok {
+			exts = append(exts, ext)
+		}
+	}
+
+	spec.Extensions = exts
+}
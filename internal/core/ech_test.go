@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Chrome 120 with GREASE ECH (65037)
+const testChromeJA3 = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-65037-21,29-23-24,0"
+
+const testChromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// newECHKey returns an ECHConfigList with a single X25519 config for publicName and its server key
+func newECHKey(t *testing.T, publicName string) ([]byte, tls.EncryptedClientHelloKey) {
+	t.Helper()
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var contents []byte
+	contents = append(contents, 1)          // config_id
+	contents = append(contents, 0x00, 0x20) // DHKEM(X25519, HKDF-SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(key.PublicKey().Bytes())))
+	contents = append(contents, key.PublicKey().Bytes()...)
+	contents = append(contents, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01) // HKDF-SHA256, AES-128-GCM
+	contents = append(contents, 0)                                  // maximum_name_length
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0x00, 0x00) // extensions
+
+	config := []byte{0xfe, 0x0d}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+
+	return list, tls.EncryptedClientHelloKey{Config: config, PrivateKey: key.Bytes(), SendAsRetry: true}
+}
+
+// startECHServer accepts TLS connections with the ECH keys and reports the state of each handshake
+func startECHServer(t *testing.T, keys []tls.EncryptedClientHelloKey) (string, <-chan tls.ConnectionState) {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:             []tls.Certificate{testCertificate(t)},
+		EncryptedClientHelloKeys: keys,
+		NextProtos:               []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	states := make(chan tls.ConnectionState, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					states <- conn.(*tls.Conn).ConnectionState()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), states
+}
+
+func echHandshake(t *testing.T, opts Options, addr string) error {
+	t.Helper()
+
+	_, port, _ := net.SplitHostPort(addr)
+	if opts.Setup == "" {
+		opts.JA3, opts.UserAgent = testChromeJA3, testChromeUA
+	}
+	opts.Insecure = true
+	opts.Resolve = map[string]string{"ech.test": "127.0.0.1"}
+
+	rt := NewRoundTripper(opts).(*roundTripper)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := rt.handshake(ctx, "tcp", net.JoinHostPort("ech.test", port))
+	if err == nil {
+		conn.Close()
+	}
+
+	return err
+}
+
+func TestECHAccepted(t *testing.T) {
+	configList, key := newECHKey(t, "public.test")
+	addr, states := startECHServer(t, []tls.EncryptedClientHelloKey{key})
+
+	if err := echHandshake(t, Options{ECHConfigList: configList}, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	state := <-states
+	if !state.ECHAccepted {
+		t.Fatal("server did not accept ECH")
+	}
+	if state.ServerName != "ech.test" {
+		t.Fatalf("inner server name = %q, want ech.test", state.ServerName)
+	}
+}
+
+func TestECHGrease(t *testing.T) {
+	_, key := newECHKey(t, "public.test")
+	addr, states := startECHServer(t, []tls.EncryptedClientHelloKey{key})
+
+	if err := echHandshake(t, Options{}, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := <-states; state.ECHAccepted {
+		t.Fatal("GREASE ECH was accepted")
+	}
+}
+
+func TestECHBrowserPresets(t *testing.T) {
+	configList, key := newECHKey(t, "public.test")
+	addr, states := startECHServer(t, []tls.EncryptedClientHelloKey{key})
+
+	for _, setup := range []string{"chrome", "firefox"} {
+		spec, err := BuildClientHelloSpec(setup, "", "", []string{"h2", "http/1.1"}, SpecOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasECHExtension(spec) {
+			t.Fatalf("%s sends no GREASE ECH", setup)
+		}
+
+		if err := echHandshake(t, Options{Setup: setup, ECHConfigList: configList}, addr); err != nil {
+			t.Fatalf("%s: %v", setup, err)
+		}
+		if state := <-states; !state.ECHAccepted {
+			t.Fatalf("%s: server did not accept ECH", setup)
+		}
+	}
+}
+
+func TestECHDisabled(t *testing.T) {
+	configList, key := newECHKey(t, "public.test")
+	addr, states := startECHServer(t, []tls.EncryptedClientHelloKey{key})
+
+	if err := echHandshake(t, Options{ECHConfigList: configList, DisableECH: true}, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := <-states; state.ECHAccepted {
+		t.Fatal("ECH was sent while disabled")
+	}
+}
+
+func TestECHLookupRetriesOverTCP(t *testing.T) {
+	configList, _ := newECHKey(t, "public.test")
+
+	// SvcPriority 1, root TargetName and the ech SvcParam
+	record := []byte{0x00, 0x01, 0x00, 0x00, svcParamKeyECH}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(configList)))
+	record = append(record, configList...)
+
+	dns := startStubDNS(t, true, func(q dnsmessage.Question) []dnsmessage.Resource {
+		if q.Type != dnsTypeHTTPS {
+			return nil
+		}
+
+		return []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsTypeHTTPS, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.UnknownResource{Type: dnsTypeHTTPS, Data: record},
+		}}
+	})
+
+	ec := &ECHConfig{LookupDNS: true, Nameserver: dns.addr}
+	if got := ec.configList(context.Background(), "ech.test"); !bytes.Equal(got, configList) {
+		t.Fatalf("config list = %x, want %x", got, configList)
+	}
+
+	if dns.queries("tcp") != 1 {
+		t.Fatalf("tcp queries = %d, want 1", dns.queries("tcp"))
+	}
+}
+
+func TestECHLookupUsesResolver(t *testing.T) {
+	dns := startStubDNS(t, false, func(q dnsmessage.Question) []dnsmessage.Resource { return nil })
+
+	resolver, err := NewResolver("tcp://"+dns.addr, PreferNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec := &ECHConfig{LookupDNS: true, Resolver: resolver}
+	if got := ec.configList(context.Background(), "ech.test"); got != nil {
+		t.Fatalf("config list = %x, want none", got)
+	}
+
+	if dns.queries("tcp") != 1 || dns.queries("udp") != 0 {
+		t.Fatalf("queries tcp %d udp %d, want the resolver's tcp server only", dns.queries("tcp"), dns.queries("udp"))
+	}
+}
+
+func TestECHLookupNotCachedWhenCanceled(t *testing.T) {
+	dns := startStubDNS(t, false, func(q dnsmessage.Question) []dnsmessage.Resource { return nil })
+	ec := &ECHConfig{LookupDNS: true, Nameserver: dns.addr}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if got := ec.configList(ctx, "ech.test"); got != nil {
+		t.Fatalf("config list = %x, want none", got)
+	}
+	if _, ok := ec.cache["ech.test"]; ok {
+		t.Fatal("lookup of a canceled request was cached")
+	}
+
+	// A lookup that finds no record is cached
+	ec.configList(context.Background(), "ech.test")
+	if entry, ok := ec.cache["ech.test"]; !ok || entry.configList != nil {
+		t.Fatal("failed lookup was not cached")
+	}
+}
+
+func TestECHCacheBounded(t *testing.T) {
+	ec := &ECHConfig{cache: make(map[string]echCacheEntry)}
+
+	for i := 0; i < MAX_ECH_HOSTS; i++ {
+		expires := time.Now().Add(time.Hour)
+		if i%2 == 0 {
+			expires = time.Now().Add(-time.Second)
+		}
+		ec.cache[fmt.Sprintf("host%d.test", i)] = echCacheEntry{expires: expires}
+	}
+
+	ec.prune()
+	if len(ec.cache) != MAX_ECH_HOSTS/2 {
+		t.Fatalf("cache holds %d hosts after pruning, want the %d live ones", len(ec.cache), MAX_ECH_HOSTS/2)
+	}
+
+	for i := 0; i < MAX_ECH_HOSTS; i++ {
+		ec.cache[fmt.Sprintf("live%d.test", i)] = echCacheEntry{expires: time.Now().Add(time.Hour)}
+	}
+
+	ec.prune()
+	if len(ec.cache) >= MAX_ECH_HOSTS {
+		t.Fatalf("cache holds %d hosts, want fewer than %d", len(ec.cache), MAX_ECH_HOSTS)
+	}
+}
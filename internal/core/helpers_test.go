@@ -0,0 +1,182 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+	testCertErr  error
+)
+
+// testCertificate returns a self-signed certificate for localhost, 127.0.0.1 and *.test
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	testCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "proxy test"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			DNSNames:     []string{"localhost", "*.test"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+
+		testCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+
+	if testCertErr != nil {
+		t.Fatal(testCertErr)
+	}
+
+	return testCert
+}
+
+// stubDNS answers queries over UDP and TCP on the same port and counts them per network
+type stubDNS struct {
+	addr string
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// startStubDNS serves answer over UDP and TCP, truncateUDP answers UDP queries with TC set
+// and no records
+func startStubDNS(t *testing.T, truncateUDP bool, answer func(q dnsmessage.Question) []dnsmessage.Resource) *stubDNS {
+	t.Helper()
+
+	var udp net.PacketConn
+	var tcp net.Listener
+
+	for i := 0; ; i++ {
+		var err error
+		if udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+
+		if tcp, err = net.Listen("tcp", udp.LocalAddr().String()); err == nil {
+			break
+		}
+
+		udp.Close()
+		if i == 10 {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	dns := &stubDNS{addr: udp.LocalAddr().String(), counts: make(map[string]int)}
+
+	respond := func(query []byte, truncate bool) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil || len(msg.Questions) == 0 {
+			return nil
+		}
+
+		msg.Header.Response = true
+		msg.Header.Truncated = truncate
+		if !truncate {
+			msg.Answers = answer(msg.Questions[0])
+		}
+
+		packed, _ := msg.Pack()
+		return packed
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			dns.count("udp")
+			if response := respond(buf[:n], truncateUDP); response != nil {
+				_, _ = udp.WriteTo(response, from)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				query, err := readDNSStream(conn)
+				if err != nil {
+					return
+				}
+
+				dns.count("tcp")
+				response := respond(query, false)
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}()
+		}
+	}()
+
+	return dns
+}
+
+func (d *stubDNS) count(network string) {
+	d.mu.Lock()
+	d.counts[network]++
+	d.mu.Unlock()
+}
+
+func (d *stubDNS) queries(network string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.counts[network]
+}
+
+// readDNSStream reads a length prefixed DNS message of DNS over TCP
+func readDNSStream(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
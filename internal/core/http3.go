@@ -0,0 +1,339 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	stdhttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	utls "github.com/refraction-networking/utls"
+)
+
+// HTTP3Mode selects when requests are sent over QUIC
+type HTTP3Mode int
+
+const (
+	// HTTP3Off never uses HTTP/3
+	HTTP3Off HTTP3Mode = iota
+	// HTTP3Auto switches to HTTP/3 once the origin advertised h3 in Alt-Svc,
+	// falling back to TCP when the QUIC connection fails
+	HTTP3Auto
+	// HTTP3Force sends every https request over HTTP/3
+	HTTP3Force
+)
+
+// QUICOptions are the QUIC transport parameters sent in the Initial packets
+type QUICOptions struct {
+	InitialStreamReceiveWindow     uint64 `json:"initial_stream_receive_window,omitempty"`
+	MaxStreamReceiveWindow         uint64 `json:"max_stream_receive_window,omitempty"`
+	InitialConnectionReceiveWindow uint64 `json:"initial_connection_receive_window,omitempty"`
+	MaxConnectionReceiveWindow     uint64 `json:"max_connection_receive_window,omitempty"`
+	MaxIncomingStreams             int64  `json:"max_incoming_streams,omitempty"`
+	MaxIncomingUniStreams          int64  `json:"max_incoming_uni_streams,omitempty"`
+	MaxIdleTimeoutMs               int64  `json:"max_idle_timeout_ms,omitempty"`
+	InitialPacketSize              uint16 `json:"initial_packet_size,omitempty"`
+	EnableDatagrams                bool   `json:"enable_datagrams,omitempty"`
+}
+
+// DefaultQUICOptions mirrors the transport parameters of Chrome
+var DefaultQUICOptions = QUICOptions{
+	InitialStreamReceiveWindow:     6291456,
+	MaxStreamReceiveWindow:         6291456,
+	InitialConnectionReceiveWindow: 15728640,
+	MaxConnectionReceiveWindow:     15728640,
+	MaxIncomingStreams:             100,
+	MaxIncomingUniStreams:          103,
+	MaxIdleTimeoutMs:               30000,
+	InitialPacketSize:              1250,
+	EnableDatagrams:                true,
+}
+
+// Curves crypto/tls can offer in a QUIC ClientHello
+var quicCurves = map[utls.CurveID]tls.CurveID{
+	utls.X25519MLKEM768: tls.X25519MLKEM768,
+	utls.X25519:         tls.X25519,
+	utls.CurveP256:      tls.CurveP256,
+	utls.CurveP384:      tls.CurveP384,
+	utls.CurveP521:      tls.CurveP521,
+}
+
+// MAX_HTTP3_TRANSPORTS bounds the shared HTTP/3 transports, the least recently used one
+// is closed together with its QUIC connections when a new profile needs room
+const MAX_HTTP3_TRANSPORTS = 256
+
+// HTTP/3 transports are shared by every request of the same profile so QUIC
+// connections are reused like in a browser
+var http3Transports = &transportCache{
+	size:    MAX_HTTP3_TRANSPORTS,
+	order:   list.New(),
+	entries: make(map[string]*list.Element),
+}
+
+type transportEntry struct {
+	key       string
+	transport *http3.Transport
+}
+
+// transportCache is an LRU of HTTP/3 transports keyed by profile
+type transportCache struct {
+	sync.Mutex
+
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// get returns the transport stored under key, creating it with create when missing
+func (c *transportCache) get(key string, create func() *http3.Transport) *http3.Transport {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*transportEntry).transport
+	}
+
+	transport := create()
+	c.entries[key] = c.order.PushFront(&transportEntry{key: key, transport: transport})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+
+		entry := oldest.Value.(*transportEntry)
+		delete(c.entries, entry.key)
+		_ = entry.transport.Close()
+	}
+
+	return transport
+}
+
+func (o QUICOptions) config() *quic.Config {
+	return &quic.Config{
+		InitialStreamReceiveWindow:     o.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         o.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: o.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     o.MaxConnectionReceiveWindow,
+		MaxIncomingStreams:             o.MaxIncomingStreams,
+		MaxIncomingUniStreams:          o.MaxIncomingUniStreams,
+		MaxIdleTimeout:                 time.Duration(o.MaxIdleTimeoutMs) * time.Millisecond,
+		InitialPacketSize:              o.InitialPacketSize,
+		EnableDatagrams:                o.EnableDatagrams,
+	}
+}
+
+// http3Transport returns the shared HTTP/3 transport of this round tripper's profile
+func (rt *roundTripper) http3Transport() *http3.Transport {
+	opts := DefaultQUICOptions
+	if rt.QUIC != nil {
+		opts = *rt.QUIC
+	}
+
+	dialer, resolving := rt.dialer.(*resolvingDialer)
+
+	// Overrides and source addresses belong to this request, its QUIC connections are not shared
+	if resolving && (len(dialer.overrides) > 0 || dialer.bound) {
+		rt.Lock()
+		defer rt.Unlock()
+
+		if rt.h3 == nil {
+			rt.h3 = rt.newHTTP3Transport(opts)
+			rt.h3.Dial = dialer.dialQUIC
+		}
+
+		return rt.h3
+	}
+
+	key := fmt.Sprintf("%s|%t|%+v|%p|%p", rt.profile(), rt.Insecure, opts, rt.Resolver, rt.ACL)
+
+	return http3Transports.get(key, func() *http3.Transport {
+		transport := rt.newHTTP3Transport(opts)
+		if resolving {
+			transport.Dial = dialer.dialQUIC
+		}
+
+		return transport
+	})
+}
+
+func (rt *roundTripper) newHTTP3Transport(opts QUICOptions) *http3.Transport {
+	return &http3.Transport{
+		TLSClientConfig:    rt.quicTLSConfig(),
+		QUICConfig:         opts.config(),
+		EnableDatagrams:    opts.EnableDatagrams,
+		DisableCompression: true,
+	}
+}
+
+// quicTLSConfig describes the QUIC ClientHello, crypto/tls only lets us choose
+// the curves (and so the key shares) from the profile, the rest is Go's own hello.
+// utls.UQUICClient could send the profile spec, but quic-go opens its handshake with
+// crypto/tls.QUICClient and takes no other TLS stack, that needs a QUIC implementation
+// built on uTLS. Until then no profile can be reproduced over QUIC so the proxy only
+// sends HTTP/3 once the operator accepted that (-http3-go-hello)
+func (rt *roundTripper) quicTLSConfig() *tls.Config {
+	verify := rt.verifyConfig()
+
+	insecure := verify.Insecure || rt.Insecure
+	config := &tls.Config{
+		NextProtos:         []string{http3.NextProtoH3},
+		RootCAs:            verify.RootCAs,
+		InsecureSkipVerify: insecure,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verify.checkPins(state.ServerName, pinCandidates(state.VerifiedChains, state.PeerCertificates, insecure))
+		},
+	}
+
+	if rt.JA3 == "" {
+		return config
+	}
+
+	if tokens := strings.Split(rt.JA3, ","); len(tokens) > 3 {
+		for _, c := range strings.Split(tokens[3], "-") {
+			cid, err := strconv.ParseUint(c, 10, 16)
+			if err != nil {
+				continue
+			}
+
+			if curve, ok := quicCurves[utls.CurveID(cid)]; ok {
+				config.CurvePreferences = append(config.CurvePreferences, curve)
+			}
+		}
+	}
+
+	return config
+}
+
+// dialQUIC opens a QUIC connection to the first reachable address of the host in addr
+func (d *resolvingDialer) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		local, ok := d.source(ip)
+		if !ok {
+			if firstErr == nil {
+				firstErr = errNoSourceAddress
+			}
+			continue
+		}
+
+		conn, err := dialQUICFrom(ctx, local, &net.UDPAddr{IP: ip, Port: udpPort(port)}, tlsCfg, cfg)
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = errNoAddresses
+	}
+
+	return nil, firstErr
+}
+
+// dialQUICFrom dials over a UDP socket of its own bound to local, closed together with the connection
+func dialQUICFrom(ctx context.Context, local net.IP, remote *net.UDPAddr, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	var config net.ListenConfig
+	if local != nil {
+		config.Control = freebind
+	}
+
+	udpConn, err := config.ListenPacket(ctx, "udp", (&net.UDPAddr{IP: local}).String())
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &quic.Transport{Conn: udpConn}
+	conn, err := transport.DialEarly(ctx, remote, tlsCfg, cfg)
+	if err != nil {
+		_ = transport.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-conn.Context().Done()
+		_ = transport.Close()
+	}()
+
+	return conn, nil
+}
+
+func udpPort(port string) int {
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func (rt *roundTripper) roundTripHTTP3(req *http.Request) (*http.Response, error) {
+	outReq, err := stdhttp.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	outReq.Header = stdhttp.Header(req.Header.Clone())
+	outReq.ContentLength = req.ContentLength
+	outReq.Host = req.Host
+
+	outResp, err := rt.http3Transport().RoundTrip(outReq)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        outResp.Status,
+		StatusCode:    outResp.StatusCode,
+		Proto:         outResp.Proto,
+		ProtoMajor:    outResp.ProtoMajor,
+		ProtoMinor:    outResp.ProtoMinor,
+		Header:        http.Header(outResp.Header),
+		Trailer:       http.Header(outResp.Trailer),
+		Body:          outResp.Body,
+		ContentLength: outResp.ContentLength,
+		TLS:           convertConnectionState(outResp.TLS),
+		Request:       req,
+	}, nil
+}
+
+func convertConnectionState(state *tls.ConnectionState) *utls.ConnectionState {
+	if state == nil {
+		return nil
+	}
+
+	return &utls.ConnectionState{
+		Version:                     state.Version,
+		HandshakeComplete:           state.HandshakeComplete,
+		DidResume:                   state.DidResume,
+		CipherSuite:                 state.CipherSuite,
+		NegotiatedProtocol:          state.NegotiatedProtocol,
+		NegotiatedProtocolIsMutual:  true,
+		ServerName:                  state.ServerName,
+		PeerCertificates:            state.PeerCertificates,
+		VerifiedChains:              state.VerifiedChains,
+		SignedCertificateTimestamps: state.SignedCertificateTimestamps,
+		OCSPResponse:                state.OCSPResponse,
+	}
+}
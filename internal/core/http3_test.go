@@ -0,0 +1,112 @@
+package core
+
+import (
+	"container/list"
+	"crypto/tls"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"slices"
+	"testing"
+
+	"github.com/Kolosok86/http"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3Server serves the protocol of each request over QUIC and reports the curves of every ClientHello
+func startHTTP3Server(t *testing.T) (string, <-chan []tls.CurveID) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	curves := make(chan []tls.CurveID, 8)
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t)},
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				curves <- hello.SupportedCurves
+				return nil, nil
+			},
+		}),
+		Handler: stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+			_, _ = io.WriteString(w, r.Proto)
+		}),
+	}
+
+	go func() { _ = server.Serve(conn) }()
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+
+	return conn.LocalAddr().String(), curves
+}
+
+func TestHTTP3Force(t *testing.T) {
+	addr, curves := startHTTP3Server(t)
+	_, port, _ := net.SplitHostPort(addr)
+
+	tests := []struct {
+		name string
+		opts Options
+		url  string
+	}{
+		{"shared", Options{}, "https://" + addr + "/"},
+		{"resolve override", Options{Resolve: map[string]string{"h3.test": "127.0.0.1"}}, "https://h3.test:" + port + "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.JA3, tt.opts.UserAgent = testChromeJA3, testChromeUA
+			tt.opts.Insecure, tt.opts.HTTP3 = true, HTTP3Force
+
+			rt := NewRoundTripper(tt.opts)
+			defer rt.(*roundTripper).CloseIdleConnections()
+
+			req, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "HTTP/3.0" || resp.TLS == nil || resp.TLS.NegotiatedProtocol != http3.NextProtoH3 {
+				t.Fatalf("body %q, TLS %+v, want an HTTP/3 response", body, resp.TLS)
+			}
+
+			// Only the curves of the JA3 make it into Go's QUIC ClientHello
+			want := []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+			if got := <-curves; !slices.Equal(got, want) {
+				t.Fatalf("curves = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHTTP3TransportsEvictLeastRecentlyUsed(t *testing.T) {
+	cache := &transportCache{size: 2, order: list.New(), entries: make(map[string]*list.Element)}
+
+	first := cache.get("a", func() *http3.Transport { return &http3.Transport{} })
+	cache.get("b", func() *http3.Transport { return &http3.Transport{} })
+
+	if cache.get("a", nil) != first {
+		t.Fatal("transport a was not reused")
+	}
+
+	cache.get("c", func() *http3.Transport { return &http3.Transport{} })
+
+	if _, ok := cache.entries["b"]; ok {
+		t.Fatal("least recently used transport b was kept")
+	}
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Fatalf("cache holds %d transports, want 2", len(cache.entries))
+	}
+}
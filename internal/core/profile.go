@@ -0,0 +1,64 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Profile is a named client fingerprint selectable through proxy-tls-setup
+type Profile struct {
+	// JA3 token of the ClientHello
+	JA3 string `json:"ja3"`
+	// Shuffle randomizes the extension order per connection
+	Shuffle bool `json:"shuffle,omitempty"`
+	// QUIC transport parameters used for HTTP/3
+	QUIC *QUICOptions `json:"quic,omitempty"`
+	// Client is the browser the profile claims to be in User-Agent and client hints
+	Client *ClientIdentity `json:"client,omitempty"`
+
+	SpecOptions
+}
+
+// Profiles maps a lower case profile name to its fingerprint
+type Profiles map[string]*Profile
+
+// LoadProfiles reads a JSON object of named profiles from path
+func LoadProfiles(path string) (Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]*Profile
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+
+	profiles := make(Profiles, len(raw))
+	for name, profile := range raw {
+		if profile == nil || profile.JA3 == "" {
+			return nil, fmt.Errorf("profile %q has no ja3", name)
+		}
+
+		if profile.Client != nil {
+			if err := profile.Client.Validate(); err != nil {
+				return nil, fmt.Errorf("profile %q: %w", name, err)
+			}
+		}
+
+		profiles[strings.ToLower(name)] = profile
+	}
+
+	return profiles, nil
+}
+
+// Lookup returns the profile called name, or nil for the built in setups
+func (p Profiles) Lookup(name string) *Profile {
+	if name == "" {
+		return nil
+	}
+
+	return p[strings.ToLower(name)]
+}
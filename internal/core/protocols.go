@@ -0,0 +1,233 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kolosok86/http/http2"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Origins remembered before expired entries are dropped
+const MAX_PROTOCOL_ORIGINS = 4096
+
+const (
+	// Lifetime of an Alt-Svc entry without "ma", as in RFC 7838
+	defaultAltSvcMaxAge = 24 * time.Hour
+	// How long a protocol that failed on an origin is avoided, like Chrome's broken alternative services
+	brokenProtocolTTL = 5 * time.Minute
+)
+
+// ProtocolCache remembers what every origin speaks across requests, so later
+// requests skip the ALPN probe and pick HTTP/3 or HTTP/2 like a returning browser
+type ProtocolCache struct {
+	sync.Mutex
+
+	ttl     time.Duration
+	origins map[string]*originProtocols
+}
+
+type originProtocols struct {
+	// Negotiated protocol by the ALPN list offered, a hello without h2 never learns h2
+	alpn map[string]negotiated
+
+	h3Expires     time.Time
+	h3BrokenUntil time.Time
+	h2BrokenUntil time.Time
+}
+
+type negotiated struct {
+	proto   string
+	expires time.Time
+}
+
+// NewProtocolCache creates a cache that keeps negotiated ALPN results for ttl
+func NewProtocolCache(ttl time.Duration) *ProtocolCache {
+	return &ProtocolCache{
+		ttl:     ttl,
+		origins: make(map[string]*originProtocols),
+	}
+}
+
+// origin returns the entry of origin, creating it when create is set; the lock must be held
+func (c *ProtocolCache) origin(origin string, create bool) *originProtocols {
+	entry, ok := c.origins[origin]
+	if !ok && create {
+		if len(c.origins) >= MAX_PROTOCOL_ORIGINS {
+			c.prune()
+		}
+
+		entry = &originProtocols{alpn: make(map[string]negotiated)}
+		c.origins[origin] = entry
+	}
+
+	return entry
+}
+
+// prune drops the origins with nothing left to remember, then arbitrary ones while the cache is full
+func (c *ProtocolCache) prune() {
+	now := time.Now()
+	for origin, entry := range c.origins {
+		if entry.expired(now) {
+			delete(c.origins, origin)
+		}
+	}
+
+	for origin := range c.origins {
+		if len(c.origins) < MAX_PROTOCOL_ORIGINS {
+			break
+		}
+		delete(c.origins, origin)
+	}
+}
+
+func (e *originProtocols) expired(now time.Time) bool {
+	for offered, result := range e.alpn {
+		if now.After(result.expires) {
+			delete(e.alpn, offered)
+		}
+	}
+
+	return len(e.alpn) == 0 && now.After(e.h3Expires) && now.After(e.h3BrokenUntil) && now.After(e.h2BrokenUntil)
+}
+
+// alpn returns the protocol the origin negotiated last time it was offered the ALPN list offered,
+// empty when unknown
+func (c *ProtocolCache) alpn(origin, offered string) string {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.origin(origin, false)
+	if entry == nil {
+		return ""
+	}
+
+	result, ok := entry.alpn[offered]
+	if !ok || time.Now().After(result.expires) {
+		return ""
+	}
+
+	return result.proto
+}
+
+func (c *ProtocolCache) setALPN(origin, offered, proto string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.origin(origin, true)
+	entry.alpn[offered] = negotiated{proto: proto, expires: time.Now().Add(c.ttl)}
+}
+
+// http3 reports whether the origin advertised h3 and it has not failed recently
+func (c *ProtocolCache) http3(origin string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.origin(origin, false)
+	if entry == nil {
+		return false
+	}
+
+	now := time.Now()
+	return now.Before(entry.h3Expires) && now.After(entry.h3BrokenUntil)
+}
+
+// h2Broken reports whether HTTP/2 failed on the origin recently
+func (c *ProtocolCache) h2Broken(origin string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.origin(origin, false)
+	return entry != nil && time.Now().Before(entry.h2BrokenUntil)
+}
+
+// setAltSvc records the h3 advertisement of an Alt-Svc response header
+func (c *ProtocolCache) setAltSvc(origin, altSvc string) {
+	if altSvc == "" {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.origin(origin, true)
+	if strings.TrimSpace(altSvc) == "clear" {
+		entry.h3Expires = time.Time{}
+		return
+	}
+
+	_, port, _ := net.SplitHostPort(origin)
+	if maxAge, ok := altSvcHTTP3(altSvc, port); ok {
+		entry.h3Expires = time.Now().Add(maxAge)
+	}
+}
+
+// markBroken avoids proto ("h2" or "h3") on the origin for a while
+func (c *ProtocolCache) markBroken(origin, proto string) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.origin(origin, true)
+	until := time.Now().Add(brokenProtocolTTL)
+
+	switch proto {
+	case http2.NextProtoTLS:
+		entry.h2BrokenUntil = until
+		clear(entry.alpn)
+	case http3.NextProtoH3:
+		entry.h3BrokenUntil = until
+	}
+}
+
+// altSvcHTTP3 returns the max age of an h3 alternative on the same host and port
+func altSvcHTTP3(altSvc, port string) (time.Duration, bool) {
+	for _, service := range strings.Split(altSvc, ",") {
+		params := strings.Split(service, ";")
+		protocol, authority, _ := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if protocol != http3.NextProtoH3 {
+			continue
+		}
+
+		host, altPort, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil || host != "" || altPort != port {
+			continue
+		}
+
+		maxAge := defaultAltSvcMaxAge
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); key == "ma" && err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+
+		return maxAge, true
+	}
+
+	return 0, false
+}
+
+// isHTTP2Failure reports whether err shows the origin does not speak HTTP/2 properly: a broken
+// preface or SETTINGS exchange, a connection level protocol error or a GOAWAY blaming the framing.
+// Graceful GOAWAYs and stream resets are part of normal HTTP/2 operation
+func isHTTP2Failure(err error) bool {
+	var goAway http2.GoAwayError
+	if errors.As(err, &goAway) {
+		switch goAway.ErrCode {
+		case http2.ErrCodeProtocol, http2.ErrCodeFrameSize, http2.ErrCodeCompression, http2.ErrCodeHTTP11Required:
+			return true
+		}
+		return false
+	}
+
+	var connErr http2.ConnectionError
+	return errors.As(err, &connErr) || errors.Is(err, http2.ErrFrameTooLarge)
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http/http2"
+)
+
+func TestProtocolCacheKeysByOfferedALPN(t *testing.T) {
+	cache := NewProtocolCache(time.Hour)
+
+	cache.setALPN("example.test:443", "h2,http/1.1", "h2")
+	cache.setALPN("example.test:443", "http/1.1", "http/1.1")
+
+	if got := cache.alpn("example.test:443", "h2,http/1.1"); got != "h2" {
+		t.Fatalf("alpn with h2 offered = %q, want h2", got)
+	}
+	if got := cache.alpn("example.test:443", "http/1.1"); got != "http/1.1" {
+		t.Fatalf("alpn with only http/1.1 offered = %q, want http/1.1", got)
+	}
+	if got := cache.alpn("example.test:443", ""); got != "" {
+		t.Fatalf("alpn without ALPN = %q, want unknown", got)
+	}
+
+	cache.markBroken("example.test:443", http2.NextProtoTLS)
+	if got := cache.alpn("example.test:443", "h2,http/1.1"); got != "" {
+		t.Fatalf("alpn after an HTTP/2 failure = %q, want unknown", got)
+	}
+}
+
+func TestProtocolCacheBounded(t *testing.T) {
+	cache := NewProtocolCache(time.Hour)
+
+	for i := 0; i < MAX_PROTOCOL_ORIGINS+100; i++ {
+		cache.setALPN(fmt.Sprintf("host%d.test:443", i), "h2,http/1.1", "h2")
+	}
+
+	if len(cache.origins) > MAX_PROTOCOL_ORIGINS {
+		t.Fatalf("cache holds %d origins, want at most %d", len(cache.origins), MAX_PROTOCOL_ORIGINS)
+	}
+}
+
+func TestProtocolCachePrunesExpired(t *testing.T) {
+	cache := NewProtocolCache(time.Hour)
+
+	for i := 0; i < MAX_PROTOCOL_ORIGINS; i++ {
+		cache.setALPN(fmt.Sprintf("host%d.test:443", i), "h2,http/1.1", "h2")
+	}
+
+	// Every entry but the first one has expired
+	for origin, entry := range cache.origins {
+		if origin != "host0.test:443" {
+			entry.alpn["h2,http/1.1"] = negotiated{proto: "h2", expires: time.Now().Add(-time.Second)}
+		}
+	}
+
+	cache.setALPN("new.test:443", "h2,http/1.1", "h2")
+
+	if len(cache.origins) != 2 || cache.alpn("host0.test:443", "h2,http/1.1") != "h2" {
+		t.Fatalf("cache holds %d origins after pruning, want the live one and the new one", len(cache.origins))
+	}
+}
+
+func TestIsHTTP2Failure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{http2.ConnectionError(http2.ErrCodeProtocol), true},
+		{fmt.Errorf("read: %w", http2.ErrFrameTooLarge), true},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeProtocol}, true},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeHTTP11Required}, true},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeNo}, false},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeEnhanceYourCalm}, false},
+		{http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}, false},
+		{http2.StreamError{StreamID: 1, Code: http2.ErrCodeProtocol}, false},
+		{errors.New("connection reset by peer"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isHTTP2Failure(tt.err); got != tt.want {
+			t.Errorf("isHTTP2Failure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	stdhttp "net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	resolverTimeout     = 5 * time.Second
+	resolverNegativeTTL = 30 * time.Second
+	resolverCacheSize   = 4096
+	dnsMessageType      = "application/dns-message"
+)
+
+var errNoAddresses = errors.New("dns: no addresses found")
+
+// IPPreference orders the addresses of a host before dialing
+type IPPreference int
+
+const (
+	// PreferNone keeps the order of the answer
+	PreferNone IPPreference = iota
+	// PreferIPv4 dials IPv4 addresses first
+	PreferIPv4
+	// PreferIPv6 dials IPv6 addresses first
+	PreferIPv6
+)
+
+// ParseIPPreference reads "ipv4", "ipv6" or an empty value
+func ParseIPPreference(value string) (IPPreference, error) {
+	switch strings.ToLower(value) {
+	case "", "any":
+		return PreferNone, nil
+	case "ipv4", "4":
+		return PreferIPv4, nil
+	case "ipv6", "6":
+		return PreferIPv6, nil
+	default:
+		return PreferNone, fmt.Errorf("invalid ip preference %q: expected ipv4 or ipv6", value)
+	}
+}
+
+// Resolver looks up upstream hosts through the system resolver, plain DNS,
+// DNS-over-TLS or DNS-over-HTTPS; answers of a configured server are cached for their TTL
+type Resolver struct {
+	sync.Mutex
+
+	upstream *url.URL
+	prefer   IPPreference
+	client   *stdhttp.Client
+	cache    map[string]resolverCacheEntry
+}
+
+type resolverCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// NewResolver creates a resolver for upstream, which is one of
+//
+//	https://host/dns-query  DNS-over-HTTPS (RFC 8484)
+//	tls://host[:853]        DNS-over-TLS (RFC 7858)
+//	udp://host[:53], tcp://host[:53] or host[:53]  plain DNS
+//
+// An empty upstream uses the system resolver
+func NewResolver(upstream string, prefer IPPreference) (*Resolver, error) {
+	r := &Resolver{prefer: prefer, cache: make(map[string]resolverCacheEntry)}
+	if upstream == "" {
+		return r, nil
+	}
+
+	if !strings.Contains(upstream, "://") {
+		upstream = "udp://" + upstream
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid dns server %q", upstream)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		u.Host = withDefaultPort(u.Host, "53")
+	case "tls":
+		u.Host = withDefaultPort(u.Host, "853")
+	case "https":
+		r.client = &stdhttp.Client{Timeout: resolverTimeout}
+	default:
+		return nil, fmt.Errorf("invalid dns server %q: unsupported scheme %s", upstream, u.Scheme)
+	}
+
+	r.upstream = u
+	return r, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// LookupIP returns the addresses of host ordered by the configured preference
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	var err error
+
+	if r.upstream == nil {
+		ips, err = lookupSystem(ctx, host)
+	} else {
+		ips, err = r.lookupCached(ctx, host)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.order(ips), nil
+}
+
+func lookupSystem(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	return ips, nil
+}
+
+func (r *Resolver) lookupCached(ctx context.Context, host string) ([]net.IP, error) {
+	r.Lock()
+	entry, ok := r.cache[host]
+	r.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	ips, ttl, err := r.query(ctx, host)
+	if err != nil {
+		// Failures of our own request are not the answer of the server
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		ttl = resolverNegativeTTL
+	}
+
+	r.Lock()
+	r.prune()
+	r.cache[host] = resolverCacheEntry{ips: ips, err: err, expires: time.Now().Add(ttl)}
+	r.Unlock()
+
+	return ips, err
+}
+
+// prune drops expired entries once the cache is full; the lock must be held
+func (r *Resolver) prune() {
+	if len(r.cache) < resolverCacheSize {
+		return
+	}
+
+	now := time.Now()
+	for host, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+
+	// Still full of live entries, make room at random
+	for host := range r.cache {
+		if len(r.cache) < resolverCacheSize {
+			break
+		}
+		delete(r.cache, host)
+	}
+}
+
+// query asks the upstream server for the A and AAAA records of host,
+// the returned TTL is the lowest of all answers
+func (r *Resolver) query(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := r.queryType(ctx, host, qtype)
+			results <- result{ips, ttl, err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var firstErr error
+
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		ips = append(ips, res.ips...)
+		if len(res.ips) > 0 && (ttl == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = errNoAddresses
+		}
+
+		return nil, 0, fmt.Errorf("lookup %s: %w", host, firstErr)
+	}
+
+	return ips, ttl, nil
+}
+
+func (r *Resolver) queryType(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	// DoH uses ID 0 so answers stay cacheable by HTTP caches
+	if r.upstream.Scheme == "https" {
+		query.Header.ID = 0
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := r.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parseAddressAnswer(response, query.Header.ID, qtype)
+}
+
+// exchange sends a packed query over the upstream transport and returns the packed response
+func (r *Resolver) exchange(ctx context.Context, packed []byte) ([]byte, error) {
+	switch r.upstream.Scheme {
+	case "https":
+		return r.exchangeHTTPS(ctx, packed)
+	case "tls":
+		return r.exchangeStream(ctx, packed, true)
+	case "tcp":
+		return r.exchangeStream(ctx, packed, false)
+	}
+
+	response, err := r.exchangeUDP(ctx, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retry a truncated answer over TCP
+	if len(response) > 2 && response[2]&0x02 != 0 {
+		return r.exchangeStream(ctx, packed, false)
+	}
+
+	return response, nil
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, packed []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", r.upstream.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// exchangeStream sends the query with the two byte length prefix of DNS over TCP and TLS
+func (r *Resolver) exchangeStream(ctx context.Context, packed []byte, useTLS bool) ([]byte, error) {
+	var conn net.Conn
+	var err error
+
+	if useTLS {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: r.upstream.Hostname()}}
+		conn, err = dialer.DialContext(ctx, "tcp", r.upstream.Host)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", r.upstream.Host)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(msg, uint16(len(packed)))
+	copy(msg[2:], packed)
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (r *Resolver) exchangeHTTPS(ctx context.Context, packed []byte) ([]byte, error) {
+	req, err := stdhttp.NewRequestWithContext(ctx, stdhttp.MethodPost, r.upstream.String(), bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != stdhttp.StatusOK {
+		return nil, fmt.Errorf("dns over https: unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// parseAddressAnswer extracts the qtype addresses and their lowest TTL from a response
+func parseAddressAnswer(response []byte, id uint16, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if header.ID != id {
+		return nil, 0, errors.New("dns response id mismatch")
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("dns: server answered %s", header.RCode)
+	}
+
+	if err = parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if answer.Type != qtype {
+			if err = parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		switch qtype {
+		case dnsmessage.TypeA:
+			resource, err := parser.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(resource.A[:]))
+		case dnsmessage.TypeAAAA:
+			resource, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(resource.AAAA[:]))
+		}
+
+		if len(ips) == 1 || answer.TTL < ttl {
+			ttl = answer.TTL
+		}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// order moves the preferred address family to the front, keeping the answer order otherwise
+func (r *Resolver) order(ips []net.IP) []net.IP {
+	if r.prefer == PreferNone {
+		return ips
+	}
+
+	ordered := append([]net.IP(nil), ips...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return r.preferred(ordered[i]) && !r.preferred(ordered[j])
+	})
+
+	return ordered
+}
+
+func (r *Resolver) preferred(ip net.IP) bool {
+	return (ip.To4() != nil) == (r.prefer == PreferIPv4)
+}
+
+// ParseResolveOverride reads a curl --resolve style "host:addr" or "host:port:addr"
+// value and returns the override key with its address
+func ParseResolveOverride(value string) (string, string, error) {
+	host, rest, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok || host == "" {
+		return "", "", fmt.Errorf("invalid resolve %q: expected host:addr or host:port:addr", value)
+	}
+
+	key := strings.ToLower(host)
+	if ip := net.ParseIP(strings.Trim(rest, "[]")); ip != nil {
+		return key, ip.String(), nil
+	}
+
+	port, addr, ok := strings.Cut(rest, ":")
+	if _, err := strconv.ParseUint(port, 10, 16); ok && err == nil {
+		if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+			return net.JoinHostPort(key, port), ip.String(), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("invalid resolve %q: expected host:addr or host:port:addr", value)
+}
+
+// resolvingDialer dials through static overrides and a Resolver instead of the system resolver,
+// from the source address of the matching family when the request is bound
+type resolvingDialer struct {
+	resolver  *Resolver
+	overrides map[string]string
+	dialer    net.Dialer
+
+	// forward tunnels through an upstream proxy, which resolves hosts without an override itself
+	forward proxy.ContextDialer
+
+	// acl checks every address before it is dialed, the name only when forwarding
+	acl *ACL
+
+	bound            bool
+	source4, source6 net.IP
+}
+
+// source returns the local address for dialing ip, ok is false when a bound request has none
+func (d *resolvingDialer) source(ip net.IP) (net.IP, bool) {
+	if !d.bound {
+		return nil, true
+	}
+
+	if ip.To4() != nil {
+		return d.source4, d.source4 != nil
+	}
+
+	return d.source6, d.source6 != nil
+}
+
+// override returns the static address of host, one for host:port wins over one for host
+func (d *resolvingDialer) override(host, port string) (string, bool) {
+	return resolveOverride(d.overrides, host, port)
+}
+
+func resolveOverride(overrides map[string]string, host, port string) (string, bool) {
+	host = strings.ToLower(host)
+	for _, key := range []string{net.JoinHostPort(host, port), host} {
+		if addr, ok := overrides[key]; ok {
+			return addr, true
+		}
+	}
+
+	return "", false
+}
+
+// lookup returns the addresses to dial for host
+func (d *resolvingDialer) lookup(ctx context.Context, host, port string) ([]net.IP, error) {
+	if addr, ok := d.override(host, port); ok {
+		return []net.IP{net.ParseIP(addr)}, nil
+	}
+
+	if d.resolver == nil {
+		return lookupSystem(ctx, host)
+	}
+
+	return d.resolver.LookupIP(ctx, host)
+}
+
+// resolve returns the addresses of host the ACL allows to dial at port
+func (d *resolvingDialer) resolve(ctx context.Context, host, port string) ([]net.IP, error) {
+	if err := d.acl.CheckAddr(net.JoinHostPort(host, port)); err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookup(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.acl.filter(host, port, ips)
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.forward != nil {
+		if ip, ok := d.override(host, port); ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+
+		if err := d.acl.checkForward(addr); err != nil {
+			return nil, err
+		}
+
+		conn, err := d.forward.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, &upstreamError{err: err}
+		}
+
+		return conn, nil
+	}
+
+	ips, err := d.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		local, ok := d.source(ip)
+		if !ok {
+			if firstErr == nil {
+				firstErr = errNoSourceAddress
+			}
+			continue
+		}
+
+		dialer := d.dialer
+		if local != nil {
+			dialer.Control = freebind
+			if strings.HasPrefix(network, "udp") {
+				dialer.LocalAddr = &net.UDPAddr{IP: local}
+			} else {
+				dialer.LocalAddr = &net.TCPAddr{IP: local}
+			}
+		}
+
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = errNoAddresses
+	}
+
+	return nil, firstErr
+}
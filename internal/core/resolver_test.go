@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// addressAnswer answers A queries with 192.0.2.1 and AAAA queries with 2001:db8::1 with the given TTLs
+func addressAnswer(ttlA, ttlAAAA uint32) func(q dnsmessage.Question) []dnsmessage.Resource {
+	return func(q dnsmessage.Question) []dnsmessage.Resource {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET}
+
+		switch q.Type {
+		case dnsmessage.TypeA:
+			header.TTL = ttlA
+			return []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}}
+		case dnsmessage.TypeAAAA:
+			header.TTL = ttlAAAA
+			var ip [16]byte
+			copy(ip[:], net.ParseIP("2001:db8::1"))
+			return []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AAAAResource{AAAA: ip}}}
+		}
+
+		return nil
+	}
+}
+
+func newTestResolver(t *testing.T, dns *stubDNS, prefer IPPreference) *Resolver {
+	t.Helper()
+
+	r, err := NewResolver(dns.addr, prefer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestResolverCachesForLowestTTL(t *testing.T) {
+	dns := startStubDNS(t, false, addressAnswer(300, 60))
+	r := newTestResolver(t, dns, PreferNone)
+
+	for i := 0; i < 3; i++ {
+		ips, err := r.LookupIP(context.Background(), "Example.TEST.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 {
+			t.Fatalf("addresses = %v, want an A and an AAAA record", ips)
+		}
+	}
+
+	// One A and one AAAA query, the later lookups are answered from the cache
+	if dns.queries("udp") != 2 {
+		t.Fatalf("udp queries = %d, want 2", dns.queries("udp"))
+	}
+
+	r.Lock()
+	entry := r.cache["example.test"]
+	r.Unlock()
+
+	if ttl := time.Until(entry.expires); ttl > 60*time.Second || ttl < 50*time.Second {
+		t.Fatalf("entry expires in %v, want the lowest TTL of 60s", ttl)
+	}
+
+	// Expired entries are looked up again
+	r.Lock()
+	entry.expires = time.Now().Add(-time.Second)
+	r.cache["example.test"] = entry
+	r.Unlock()
+
+	if _, err := r.LookupIP(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if dns.queries("udp") != 4 {
+		t.Fatalf("udp queries after expiry = %d, want 4", dns.queries("udp"))
+	}
+}
+
+func TestResolverCachesFailures(t *testing.T) {
+	dns := startStubDNS(t, false, func(dnsmessage.Question) []dnsmessage.Resource { return nil })
+	r := newTestResolver(t, dns, PreferNone)
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIP(context.Background(), "missing.test"); !errors.Is(err, errNoAddresses) {
+			t.Fatalf("lookup error = %v, want %v", err, errNoAddresses)
+		}
+	}
+
+	if dns.queries("udp") != 2 {
+		t.Fatalf("udp queries = %d, want 2", dns.queries("udp"))
+	}
+
+	r.Lock()
+	ttl := time.Until(r.cache["missing.test"].expires)
+	r.Unlock()
+
+	if ttl > resolverNegativeTTL || ttl < resolverNegativeTTL-5*time.Second {
+		t.Fatalf("failure cached for %v, want %v", ttl, resolverNegativeTTL)
+	}
+}
+
+func TestResolverPreference(t *testing.T) {
+	dns := startStubDNS(t, false, addressAnswer(300, 300))
+
+	tests := []struct {
+		prefer IPPreference
+		first  string
+	}{
+		{PreferIPv4, "192.0.2.1"},
+		{PreferIPv6, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		ips, err := newTestResolver(t, dns, tt.prefer).LookupIP(context.Background(), "example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ips) != 2 || ips[0].String() != tt.first {
+			t.Errorf("preference %d: addresses = %v, want %s first", tt.prefer, ips, tt.first)
+		}
+	}
+}
+
+func TestResolverLiteralAddress(t *testing.T) {
+	dns := startStubDNS(t, false, addressAnswer(300, 300))
+	r := newTestResolver(t, dns, PreferNone)
+
+	ips, err := r.LookupIP(context.Background(), "203.0.113.7")
+	if err != nil || len(ips) != 1 || ips[0].String() != "203.0.113.7" {
+		t.Fatalf("addresses = %v (%v), want the literal", ips, err)
+	}
+
+	if dns.queries("udp") != 0 {
+		t.Fatalf("udp queries = %d, want none", dns.queries("udp"))
+	}
+}
+
+func TestParseIPPreference(t *testing.T) {
+	tests := []struct {
+		value string
+		want  IPPreference
+		err   bool
+	}{
+		{"", PreferNone, false},
+		{"any", PreferNone, false},
+		{"IPv4", PreferIPv4, false},
+		{"6", PreferIPv6, false},
+		{"ipv5", PreferNone, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseIPPreference(tt.value)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParseIPPreference(%q) = %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestParseResolveOverride(t *testing.T) {
+	tests := []struct {
+		value string
+		key   string
+		addr  string
+		err   bool
+	}{
+		{"example.com:1.2.3.4", "example.com", "1.2.3.4", false},
+		{" Example.COM:443:1.2.3.4 ", "example.com:443", "1.2.3.4", false},
+		{"example.com:[2001:db8::1]", "example.com", "2001:db8::1", false},
+		{"example.com:2001:db8::1", "example.com", "2001:db8::1", false},
+		{"example.com:8443:[2001:db8::1]", "example.com:8443", "2001:db8::1", false},
+		{"example.com", "", "", true},
+		{":1.2.3.4", "", "", true},
+		{"example.com:not-an-ip", "", "", true},
+		{"example.com:443:not-an-ip", "", "", true},
+		{"example.com:99999:1.2.3.4", "", "", true},
+	}
+
+	for _, tt := range tests {
+		key, addr, err := ParseResolveOverride(tt.value)
+		if key != tt.key || addr != tt.addr || (err != nil) != tt.err {
+			t.Errorf("ParseResolveOverride(%q) = %q, %q, %v", tt.value, key, addr, err)
+		}
+	}
+}
+
+func TestResolveOverridePrecedence(t *testing.T) {
+	d := &resolvingDialer{overrides: map[string]string{
+		"example.com":     "192.0.2.1",
+		"example.com:443": "192.0.2.2",
+	}}
+
+	tests := []struct {
+		host, port, want string
+	}{
+		{"example.com", "443", "192.0.2.2"},
+		{"EXAMPLE.com", "80", "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		ips, err := d.lookup(context.Background(), tt.host, tt.port)
+		if err != nil || len(ips) != 1 || ips[0].String() != tt.want {
+			t.Errorf("lookup(%s, %s) = %v, %v, want %s", tt.host, tt.port, ips, err, tt.want)
+		}
+	}
+}
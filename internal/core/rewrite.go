@@ -0,0 +1,215 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/textproto"
+)
+
+// Profile name matched by header rules for requests without proxy-tls-setup
+const DEFAULT_RULE_PROFILE = "chrome"
+
+// HeaderRules rewrite the headers of matching requests and their responses, every
+// matching rule applies in file order
+type HeaderRules []*HeaderRule
+
+// HeaderRule matches requests by host, path, method and profile; an empty field matches anything
+type HeaderRule struct {
+	Host    patterns `json:"host,omitempty"`
+	Path    patterns `json:"path,omitempty"`
+	Method  patterns `json:"method,omitempty"`
+	Profile patterns `json:"profile,omitempty"`
+
+	Request  *HeaderRewrite `json:"request,omitempty"`
+	Response *HeaderRewrite `json:"response,omitempty"`
+}
+
+// HeaderRewrite is applied as remove, rename, set, defaults and then order
+type HeaderRewrite struct {
+	// Remove drops headers
+	Remove []string `json:"remove,omitempty"`
+	// Rename moves the values of a header to another name, keeping its position
+	Rename headerFields `json:"rename,omitempty"`
+	// Set replaces the value of a header or adds it
+	Set headerFields `json:"set,omitempty"`
+	// Defaults adds headers the client did not send
+	Defaults headerFields `json:"defaults,omitempty"`
+	// Order lists headers in the order they are sent, others follow in their own order
+	Order []string `json:"order,omitempty"`
+}
+
+// headerFields is a JSON object of header names to values, kept in file order so added
+// headers are always sent in the same order
+type headerFields []headerField
+
+type headerField struct {
+	name, value string
+}
+
+func (f *headerFields) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("expected an object of header names to values")
+	}
+
+	*f = nil
+	for dec.More() {
+		var name, value string
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, _ = tok.(string)
+
+		if err := dec.Decode(&value); err != nil {
+			return fmt.Errorf("header %q: expected a string value", name)
+		}
+
+		*f = append(*f, headerField{name: name, value: value})
+	}
+
+	return nil
+}
+
+// patterns are globs where * matches any run of characters, a JSON string or array
+type patterns struct {
+	re []*regexp.Regexp
+}
+
+func (p *patterns) UnmarshalJSON(data []byte) error {
+	var globs []string
+	if err := json.Unmarshal(data, &globs); err != nil {
+		var glob string
+		if err := json.Unmarshal(data, &glob); err != nil {
+			return fmt.Errorf("expected a pattern or a list of patterns")
+		}
+		globs = []string{glob}
+	}
+
+	p.re = nil
+	for _, glob := range globs {
+		expr := strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, `.*`)
+		p.re = append(p.re, regexp.MustCompile(`(?i)^`+expr+`$`))
+	}
+
+	return nil
+}
+
+func (p patterns) match(value string) bool {
+	if len(p.re) == 0 {
+		return true
+	}
+
+	for _, re := range p.re {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadHeaderRules reads a JSON array of header rules from path
+func LoadHeaderRules(path string) (HeaderRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules HeaderRules
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid header rules file %s: %w", path, err)
+	}
+
+	for i, rule := range rules {
+		if rule == nil || rule.Request == nil && rule.Response == nil {
+			return nil, fmt.Errorf("header rule %d has no request or response rewrite", i)
+		}
+	}
+
+	return rules, nil
+}
+
+func (r *HeaderRule) matches(req *http.Request, profile string) bool {
+	if profile == "" {
+		profile = DEFAULT_RULE_PROFILE
+	}
+
+	return r.Host.match(req.URL.Hostname()) && r.Path.match(req.URL.Path) &&
+		r.Method.match(req.Method) && r.Profile.match(profile)
+}
+
+// Request rewrites the headers of req sent with profile, the proxy-tls-setup value
+func (rules HeaderRules) Request(req *http.Request, profile string) {
+	for _, rule := range rules {
+		if rule.Request != nil && rule.matches(req, profile) {
+			rule.Request.apply(req.Header, &req.HeaderOrder)
+		}
+	}
+}
+
+// Response rewrites the headers of resp to the request req sent with profile
+func (rules HeaderRules) Response(resp *http.Response, req *http.Request, profile string) {
+	for _, rule := range rules {
+		if rule.Response != nil && rule.matches(req, profile) {
+			rule.Response.apply(resp.Header, &resp.Order)
+		}
+	}
+}
+
+// apply rewrites header and the header order it is sent in
+func (w *HeaderRewrite) apply(header http.Header, order *textproto.HeaderOrder) {
+	for _, key := range w.Remove {
+		header.Del(key)
+		order.Del(key)
+	}
+
+	for _, rename := range w.Rename {
+		from, to := rename.name, rename.value
+		values := header.Values(from)
+		if len(values) == 0 || strings.EqualFold(from, to) {
+			continue
+		}
+
+		header.Del(from)
+		header[http.CanonicalHeaderKey(to)] = values
+
+		order.Del(to)
+		if i := order.FindIndex(strings.ToLower(from)); i >= 0 {
+			order.Order[i] = strings.ToLower(to)
+		} else {
+			order.Add(to)
+		}
+	}
+
+	for _, field := range w.Set {
+		header.Set(field.name, field.value)
+		order.Add(field.name)
+	}
+
+	for _, field := range w.Defaults {
+		if header.Get(field.name) == "" {
+			header.Set(field.name, field.value)
+			order.Add(field.name)
+		}
+	}
+
+	if len(w.Order) > 0 {
+		var sorted textproto.HeaderOrder
+		for _, key := range w.Order {
+			sorted.Add(key)
+		}
+
+		for _, key := range order.Order {
+			sorted.Add(key)
+		}
+
+		order.Order = sorted.Order
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/textproto"
+)
+
+func TestHeaderRewriteApply(t *testing.T) {
+	// Every case starts from these headers sent in this order
+	start := [][2]string{
+		{"Host", "example.com"},
+		{"User-Agent", "agent"},
+		{"Accept", "*/*"},
+		{"X-Old", "old"},
+		{"Accept-Language", "en"},
+	}
+
+	tests := []struct {
+		name    string
+		rewrite string
+		header  map[string]string
+		order   []string
+	}{
+		{
+			"remove",
+			`{"remove": ["x-old", "Not-There"]}`,
+			map[string]string{"X-Old": ""},
+			[]string{"host", "user-agent", "accept", "accept-language"},
+		},
+		{
+			"rename keeps the position",
+			`{"rename": {"X-Old": "X-New"}}`,
+			map[string]string{"X-Old": "", "X-New": "old"},
+			[]string{"host", "user-agent", "accept", "x-new", "accept-language"},
+		},
+		{
+			"rename over an existing header",
+			`{"rename": {"X-Old": "Accept"}}`,
+			map[string]string{"X-Old": "", "Accept": "old"},
+			[]string{"host", "user-agent", "accept", "accept-language"},
+		},
+		{
+			"rename of a missing header",
+			`{"rename": {"X-Missing": "X-New"}}`,
+			map[string]string{"X-New": ""},
+			[]string{"host", "user-agent", "accept", "x-old", "accept-language"},
+		},
+		{
+			"set replaces in place and appends new headers",
+			`{"set": {"accept": "text/html", "X-Added": "1", "X-Second": "2"}}`,
+			map[string]string{"Accept": "text/html", "X-Added": "1"},
+			[]string{"host", "user-agent", "accept", "x-old", "accept-language", "x-added", "x-second"},
+		},
+		{
+			"defaults fill only missing headers",
+			`{"defaults": {"Accept": "text/html", "DNT": "1"}}`,
+			map[string]string{"Accept": "*/*", "Dnt": "1"},
+			[]string{"host", "user-agent", "accept", "x-old", "accept-language", "dnt"},
+		},
+		{
+			"order places listed headers first",
+			`{"order": ["Accept-Language", "accept", "x-unknown"]}`,
+			nil,
+			[]string{"accept-language", "accept", "x-unknown", "host", "user-agent", "x-old"},
+		},
+		{
+			"steps apply in order",
+			`{"remove": ["X-New"], "rename": {"X-Old": "X-New"}, "set": {"X-New": "set"}, "defaults": {"X-New": "default"}, "order": ["x-new"]}`,
+			map[string]string{"X-Old": "", "X-New": "set"},
+			[]string{"x-new", "host", "user-agent", "accept", "accept-language"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rewrite HeaderRewrite
+			if err := json.Unmarshal([]byte(tt.rewrite), &rewrite); err != nil {
+				t.Fatal(err)
+			}
+
+			header := make(http.Header)
+			var order textproto.HeaderOrder
+			for _, field := range start {
+				header.Set(field[0], field[1])
+				order.Add(field[0])
+			}
+
+			rewrite.apply(header, &order)
+
+			for key, want := range tt.header {
+				if got := header.Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+
+			if !slices.Equal(order.Order, tt.order) {
+				t.Errorf("order = %v, want %v", order.Order, tt.order)
+			}
+		})
+	}
+}
+
+func TestHeaderRulesMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"host": "*.example.com", "method": ["GET", "HEAD"], "request": {"set": {"X-Site": "example"}}},
+		{"path": "/api/*", "profile": "firefox", "request": {"set": {"X-Firefox": "1"}}},
+		{"profile": "chrome", "request": {"set": {"X-Chrome": "1"}}, "response": {"remove": ["Server"]}}
+	]`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadHeaderRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, url, profile string
+		want                 []string
+	}{
+		{"GET", "https://www.example.com/", "", []string{"X-Site", "X-Chrome"}},
+		{"POST", "https://www.example.com/", "chrome", []string{"X-Chrome"}},
+		{"GET", "https://example.org/api/v1", "FireFox", []string{"X-Firefox"}},
+		{"GET", "https://example.org/other", "firefox", nil},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		loaded.Request(req, tt.profile)
+
+		var got []string
+		for _, key := range []string{"X-Site", "X-Firefox", "X-Chrome"} {
+			if req.Header.Get(key) != "" {
+				got = append(got, key)
+			}
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s with %q set %v, want %v", tt.method, tt.url, tt.profile, got, tt.want)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.org/", nil)
+	resp := &http.Response{Header: http.Header{"Server": {"nginx"}}}
+	resp.Order.Add("server")
+
+	loaded.Response(resp, req, "")
+	if resp.Header.Get("Server") != "" || len(resp.Order.Order) != 0 {
+		t.Fatalf("response rewrite left %v in %v", resp.Header, resp.Order.Order)
+	}
+}
+
+func TestLoadHeaderRulesInvalid(t *testing.T) {
+	for _, rules := range []string{
+		`[{"host": "example.com"}]`,
+		`[null]`,
+		`[{"request": {"set": {"X-Number": 1}}}]`,
+		`[{"request": {"set": ["X-List"]}}]`,
+		`{"request": {}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadHeaderRules(path); err == nil {
+			t.Errorf("LoadHeaderRules accepted %s", rules)
+		}
+	}
+}
@@ -7,76 +7,335 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/proxy"
 
 	"github.com/Kolosok86/http"
 	"github.com/Kolosok86/http/http2"
+	"github.com/quic-go/quic-go/http3"
 )
 
-var errProtocolNegotiated = errors.New("protocol negotiated")
+// DEFAULT_PROTOCOL_TTL is how long a negotiated ALPN result is trusted
+const DEFAULT_PROTOCOL_TTL = time.Hour
 
-type roundTripper struct {
-	sync.Mutex
+// IDLE_CONN_TIMEOUT closes kept-alive HTTP/1.1 connections nobody used for that long, idle
+// HTTP/2 connections of sticky sessions are closed by the session sweep after the same time
+const IDLE_CONN_TIMEOUT = 90 * time.Second
+
+// HTTP/2 SETTINGS sent by every transport, those of Chrome
+const (
+	H2_HEADER_TABLE_SIZE    = 65536
+	H2_INITIAL_WINDOW_SIZE  = 6291456
+	H2_MAX_HEADER_LIST_SIZE = 262144
+)
+
+// uTLS fails this way when the server picks a key share group the hello did not offer
+var errUnsupportedCurve = errors.New("tls: curve preferences includes unsupported curve")
 
+// Options describes how a round tripper fingerprints and verifies upstream connections
+type Options struct {
 	JA3       string
 	Setup     string
 	UserAgent string
 	Downgrade bool
 
+	// Spec tunes the ClientHello beyond what the JA3 token or preset describes
+	Spec SpecOptions
+	// Shuffle permutes the extension order per connection like Chrome 106+,
+	// GREASE, padding and pre_shared_key keep their positions
+	Shuffle bool
+
+	// Verify holds the certificate checks, nil verifies against the system pool
+	Verify *VerifyConfig
+	// Insecure skips chain verification for this round tripper only
+	Insecure bool
+
+	// Sessions caches TLS sessions per profile, nil disables resumption
+	Sessions *SessionStore
+	// FreshSession skips cached sessions, the new one is still stored
+	FreshSession bool
+
+	// ECH supplies Encrypted Client Hello configs, profiles without one send GREASE ECH
+	ECH *ECHConfig
+	// ECHConfigList overrides the ECH config of every host for this round tripper
+	ECHConfigList []byte
+	// DisableECH removes both real and GREASE ECH from the ClientHello
+	DisableECH bool
+
+	// HTTP3 selects when https requests go over QUIC
+	HTTP3 HTTP3Mode
+	// QUIC holds the transport parameters for HTTP/3, nil uses DefaultQUICOptions
+	QUIC *QUICOptions
+
+	// Protocols remembers ALPN results, Alt-Svc and failures per origin,
+	// nil keeps them for the lifetime of the round tripper only
+	Protocols *ProtocolCache
+
+	// Resolver looks up upstream hosts, nil uses the system resolver
+	Resolver *Resolver
+	// Resolve maps "host" or "host:port" to the address dialed instead of a lookup
+	Resolve map[string]string
+	// Bind picks the local address of outbound connections
+	Bind Bind
+	// Upstream tunnels every connection through a proxy, HTTP/3 is not used then
+	Upstream *Upstream
+
+	// Breakers refuse requests to failing origins, nil never refuses
+	Breakers *Breakers
+	// ACL limits the hosts, addresses and ports connections go to, nil allows all
+	ACL *ACL
+}
+
+type roundTripper struct {
+	sync.Mutex
+	Options
+
+	// Established transports and TLS states are read without locking on every request
+	transports sync.Map // addr -> http.RoundTripper
+	states     sync.Map // addr -> *utls.ConnectionState
+
+	// Guarded by the mutex, which is never held across network I/O
 	connections map[string]net.Conn
-	transports  map[string]http.RoundTripper
+	probes      map[string]*probeCall
 
 	dialer proxy.ContextDialer
+
+	// h3 is the HTTP/3 transport of a request with its own dialing rules, guarded by the mutex
+	h3 *http3.Transport
+}
+
+// probeCall is an in-flight ALPN probe that concurrent requests to the same origin wait for
+type probeCall struct {
+	done chan struct{}
+	err  error
+	// canceled is set when the probing request's context ended the probe
+	canceled bool
 }
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := breakerOrigin(req, rt.Resolve)
+
+	probe, err := rt.Breakers.allow(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.roundTrip(req)
+	rt.Breakers.record(origin, probe, req, resp, err)
+
+	return resp, err
+}
+
+func (rt *roundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	if isWebSocketUpgrade(req) {
+		return rt.roundTripWebSocket(req)
+	}
+
 	addr := rt.getDialTLSAddr(req)
 
-	if _, ok := rt.transports[addr]; !ok {
-		if err := rt.getTransport(req, addr); err != nil {
-			return nil, err
+	if rt.useHTTP3(req, addr) {
+		resp, err := rt.roundTripHTTP3(req)
+		if err == nil || rt.HTTP3 == HTTP3Force || !isReplayable(req) {
+			return resp, err
+		}
+
+		// The advertised QUIC endpoint is unusable, stay on TCP for a while
+		rt.Protocols.markBroken(addr, http3.NextProtoH3)
+	}
+
+	transport, err := rt.getTransport(req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		if isHTTP2Failure(err) {
+			rt.Protocols.markBroken(addr, http2.NextProtoTLS)
+		}
+
+		return nil, err
+	}
+
+	// http.Transport only records the state of *tls.Conn, fill it in for uTLS connections
+	if resp.TLS == nil {
+		if state, ok := rt.states.Load(addr); ok {
+			resp.TLS = state.(*utls.ConnectionState)
+		}
+	}
+
+	if strings.ToLower(req.URL.Scheme) == "https" {
+		rt.Protocols.setAltSvc(addr, resp.Header.Get("Alt-Svc"))
+	}
+
+	return resp, nil
+}
+
+// CloseIdleConnections closes the kept-alive connections of every transport of this round tripper
+func (rt *roundTripper) CloseIdleConnections() {
+	rt.transports.Range(func(_, transport any) bool {
+		if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
 		}
+		return true
+	})
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	for addr, conn := range rt.connections {
+		_ = conn.Close()
+		delete(rt.connections, addr)
 	}
 
-	return rt.transports[addr].RoundTrip(req)
+	if rt.h3 != nil {
+		rt.h3.CloseIdleConnections()
+	}
 }
 
-func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
+func (rt *roundTripper) useHTTP3(req *http.Request, addr string) bool {
+	if strings.ToLower(req.URL.Scheme) != "https" || rt.Upstream != nil {
+		return false
+	}
+
+	switch rt.HTTP3 {
+	case HTTP3Force:
+		return true
+	case HTTP3Auto:
+		return rt.Protocols.http3(addr)
+	default:
+		return false
+	}
+}
+
+// isReplayable reports whether req can be sent again after a failed attempt
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+func (rt *roundTripper) getTransport(req *http.Request, addr string) (http.RoundTripper, error) {
+	if transport, ok := rt.transports.Load(addr); ok {
+		return transport.(http.RoundTripper), nil
+	}
+
 	switch strings.ToLower(req.URL.Scheme) {
 	case "http":
-		rt.transports[addr] = &http.Transport{DialContext: rt.dialer.DialContext, DisableKeepAlives: true}
-		return nil
+		transport, _ := rt.transports.LoadOrStore(addr, &http.Transport{DialContext: rt.dialer.DialContext, DisableKeepAlives: true, DisableCompression: true})
+		return transport.(http.RoundTripper), nil
 	case "https":
 	default:
-		return fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
+		return nil, fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
 	}
 
-	_, err := rt.dialTLS(context.Background(), "tcp", addr)
-	switch err {
-	case errProtocolNegotiated:
-	case nil:
-		// Should never happen.
-		panic("dialTLS returned no error when determining cached transports")
-	default:
+	spec, err := rt.clientHelloSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// A known origin gets its transport right away instead of a probe connection
+	if proto := rt.Protocols.alpn(addr, offeredALPN(spec)); proto != "" {
+		transport, _ := rt.transports.LoadOrStore(addr, rt.newTLSTransport(proto))
+		return transport.(http.RoundTripper), nil
+	}
+
+	if err := rt.probe(req.Context(), addr); err != nil {
+		return nil, err
+	}
+
+	transport, _ := rt.transports.Load(addr)
+	return transport.(http.RoundTripper), nil
+}
+
+// probe connects once per origin to learn its ALPN protocol and stores the matching
+// transport, concurrent callers share the result of the first one
+func (rt *roundTripper) probe(ctx context.Context, addr string) error {
+	rt.Lock()
+	if call, ok := rt.probes[addr]; ok {
+		rt.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// The leading request went away mid-probe, ours is still wanted
+		if call.err != nil && call.canceled && ctx.Err() == nil {
+			return rt.probe(ctx, addr)
+		}
+
+		return call.err
+	}
+
+	call := &probeCall{done: make(chan struct{})}
+	rt.probes[addr] = call
+	rt.Unlock()
+
+	defer func() {
+		rt.Lock()
+		delete(rt.probes, addr)
+		rt.Unlock()
+		close(call.done)
+	}()
+
+	conn, err := rt.handshake(ctx, "tcp", addr)
+	if err != nil {
+		call.err, call.canceled = err, ctx.Err() != nil
 		return err
 	}
 
+	// Stash the connection just established for use servicing the
+	// actual request (should be near-immediate).
+	rt.Lock()
+	rt.connections[addr] = conn
+	rt.Unlock()
+
+	rt.transports.Store(addr, rt.newTLSTransport(conn.ConnectionState().NegotiatedProtocol))
 	return nil
 }
 
 func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
-	rt.Lock()
-	defer rt.Unlock()
-
 	// If we have the connection from when we determined the HTTPS
 	// cached transports to use, return that.
-	if conn := rt.connections[addr]; conn != nil {
-		delete(rt.connections, addr)
+	rt.Lock()
+	conn := rt.connections[addr]
+	delete(rt.connections, addr)
+	rt.Unlock()
+
+	if conn != nil {
 		return conn, nil
 	}
 
+	return rt.handshake(ctx, network, addr)
+}
+
+// handshake dials addr and completes the fingerprinted TLS handshake
+func (rt *roundTripper) handshake(ctx context.Context, network, addr string) (*utls.UConn, error) {
+	spec, err := rt.clientHelloSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := rt.handshakeSpec(ctx, network, addr, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := conn.ConnectionState().NegotiatedProtocol
+	if proto != http2.NextProtoTLS {
+		proto = "http/1.1"
+	}
+
+	// Refresh the remembered protocol, a mismatch with a cached transport corrects the next request
+	rt.Protocols.setALPN(addr, offeredALPN(spec), proto)
+
+	return conn, nil
+}
+
+// handshakeSpec dials addr and completes the TLS handshake with spec
+func (rt *roundTripper) handshakeSpec(ctx context.Context, network, addr string, spec *utls.ClientHelloSpec) (*utls.UConn, error) {
 	rawConn, err := rt.dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
@@ -87,78 +346,166 @@ func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.
 		host = addr
 	}
 
-	helloAgent := rt.getClientHello(rt.Setup, rt.JA3)
-	conn := utls.UClient(rawConn, &utls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         host,
-	},
-		helloAgent,
-	)
+	config := &utls.Config{ServerName: host, OmitEmptyPsk: true}
+	rt.verifyConfig().apply(config, rt.Insecure)
+	rt.applySessionCache(config)
+	rt.applyECH(ctx, config, spec, host)
 
-	if err = rt.setSpec(conn, helloAgent); err != nil {
+	conn := utls.UClient(rawConn, config, utls.HelloCustom)
+	if err = conn.ApplyPreset(spec); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
-	if err = conn.Handshake(); err != nil {
+	if err = conn.HandshakeContext(ctx); err != nil {
 		_ = conn.Close()
 
-		if err.Error() == "tls: curve preferences includes unsupported curve" {
-			return nil, fmt.Errorf("conn.Handshake() error for tls 1.3 (please retry request): %+v", err)
+		if err.Error() == errUnsupportedCurve.Error() {
+			return nil, fmt.Errorf("conn.HandshakeContext() error for tls 1.3 (please retry request): %w", errUnsupportedCurve)
 		}
 
-		return nil, fmt.Errorf("uTlsConn.Handshake() error: %+v", err)
+		return nil, fmt.Errorf("uTlsConn.HandshakeContext() error: %w", err)
 	}
 
-	if rt.transports[addr] != nil {
-		return conn, nil
-	}
+	state := conn.ConnectionState()
+	rt.states.Store(addr, &state)
+
+	return conn, nil
+}
 
-	// No http.Transport constructed yet, create one based on the results of ALPN.
-	if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
-		rt.transports[addr] = &http2.Transport{
-			DialTLS: rt.dialTLSHTTP2,
+func (rt *roundTripper) newTLSTransport(proto string) http.RoundTripper {
+	if proto == http2.NextProtoTLS {
+		return &http2.Transport{
+			DialTLSContext: rt.dialTLSHTTP2,
+
+			// keep Accept-Encoding and the body as the client and the origin send them
+			DisableCompression: true,
 
 			// set chrome initial params
-			HeaderTableSize:      65536,
-			InitialWindowSize:    6291456,
-			InitMaxReadFrameSize: 262144,
+			HeaderTableSize:      H2_HEADER_TABLE_SIZE,
+			InitialWindowSize:    H2_INITIAL_WINDOW_SIZE,
+			InitMaxReadFrameSize: H2_MAX_HEADER_LIST_SIZE,
 		}
-	} else {
-		// Assume the remote peer is speaking HTTP 1.x + TLS.
-		rt.transports[addr] = &http.Transport{DialTLSContext: rt.dialTLS}
 	}
 
-	// Stash the connection just established for use servicing the
-	// actual request (should be near-immediate).
-	rt.connections[addr] = conn
+	// Assume the remote peer is speaking HTTP 1.x + TLS.
+	return &http.Transport{DialTLSContext: rt.dialTLS, DisableCompression: true, IdleConnTimeout: IDLE_CONN_TIMEOUT}
+}
 
-	return nil, errProtocolNegotiated
+func (rt *roundTripper) verifyConfig() *VerifyConfig {
+	if rt.Verify == nil {
+		return &VerifyConfig{}
+	}
+
+	return rt.Verify
 }
 
-func (rt *roundTripper) setSpec(conn *utls.UConn, helloAgent utls.ClientHelloID) error {
-	if helloAgent.Client != "Custom" {
-		return nil
+func (rt *roundTripper) applySessionCache(config *utls.Config) {
+	cache := rt.Sessions.cache(rt.profile())
+	if cache == nil {
+		return
 	}
 
+	if rt.FreshSession {
+		config.ClientSessionCache = freshSessionCache{cache}
+	} else {
+		config.ClientSessionCache = cache
+	}
+
+	// Presets without a pre_shared_key extension only resume TLS 1.2 sessions
+	config.PreferSkipResumptionOnNilExtension = true
+}
+
+// profile identifies the ClientHello this round tripper sends
+func (rt *roundTripper) profile() string {
+	if rt.JA3 != "" {
+		return "ja3:" + rt.JA3
+	}
+
+	return "setup:" + rt.Setup
+}
+
+// clientHelloSpec builds the ClientHelloSpec of the selected JA3 or preset, fresh for every connection
+func (rt *roundTripper) clientHelloSpec(addr string) (*utls.ClientHelloSpec, error) {
 	proto := []string{"h2", "http/1.1"}
-	if rt.Downgrade {
+	if rt.Downgrade || rt.Protocols.h2Broken(addr) {
 		proto = proto[1:]
 	}
 
-	spec, err := StringToSpec(rt.JA3, rt.UserAgent, proto)
+	spec, err := BuildClientHelloSpec(rt.Setup, rt.JA3, rt.UserAgent, proto, rt.Spec)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err = conn.ApplyPreset(spec); err != nil {
-		return err
+	if rt.Shuffle {
+		spec.Extensions = utls.ShuffleChromeTLSExtensions(spec.Extensions)
 	}
 
-	return nil
+	return spec, nil
+}
+
+// offeredALPN returns the ALPN protocols of spec, the key the negotiated protocol is remembered by
+func offeredALPN(spec *utls.ClientHelloSpec) string {
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			return strings.Join(alpn.AlpnProtocols, ",")
+		}
+	}
+
+	return ""
+}
+
+// BuildClientHelloSpec returns the ClientHelloSpec of a JA3 token, or of the built in setup
+// without one, offering proto in ALPN
+func BuildClientHelloSpec(setup, ja3, userAgent string, proto []string, opts SpecOptions) (*utls.ClientHelloSpec, error) {
+	var spec *utls.ClientHelloSpec
+
+	helloAgent := getClientHello(setup, ja3)
+	if helloAgent.Client != "Custom" {
+		preset, err := utls.UTLSIdToSpec(helloAgent)
+		if err != nil {
+			return nil, err
+		}
+
+		spec = &preset
+	} else {
+		var err error
+		if spec, err = StringToSpec(ja3, userAgent, proto); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ApplySpecOptions(spec, opts); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
 }
 
-func (rt *roundTripper) dialTLSHTTP2(network, addr string, _ *utls.Config) (net.Conn, error) {
-	return rt.dialTLS(context.Background(), network, addr)
+// applyECH turns the GREASE ECH extension of spec into a real one when a config list is known
+func (rt *roundTripper) applyECH(ctx context.Context, config *utls.Config, spec *utls.ClientHelloSpec, host string) {
+	if rt.DisableECH {
+		removeECHExtension(spec)
+		return
+	}
+
+	if !hasECHExtension(spec) {
+		return
+	}
+
+	configList := rt.ECHConfigList
+	if configList == nil {
+		configList = rt.ECH.configList(ctx, host)
+	}
+
+	if configList != nil {
+		config.EncryptedClientHelloConfigList = configList
+		config.MinVersion = utls.VersionTLS13
+	}
+}
+
+func (rt *roundTripper) dialTLSHTTP2(ctx context.Context, network, addr string, _ *utls.Config) (net.Conn, error) {
+	return rt.dialTLS(ctx, network, addr)
 }
 
 func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
@@ -170,33 +517,51 @@ func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
 	return net.JoinHostPort(req.URL.Host, "443")
 }
 
-func (rt *roundTripper) getClientHello(setup, ja3 string) utls.ClientHelloID {
-	switch {
-	case ja3 != "":
+// ClientHello presets of the built in setups, any other setup without a JA3 is chrome
+var builtinHellos = map[string]utls.ClientHelloID{
+	"android": utls.HelloAndroid_11_OkHttp,
+	"ios":     utls.HelloIOS_14,
+	"firefox": utls.HelloFirefox_120,
+	"chrome":  utls.HelloChrome_120,
+}
+
+func getClientHello(setup, ja3 string) utls.ClientHelloID {
+	if ja3 != "" {
 		return utls.HelloCustom
-	case setup == "android":
-		return utls.HelloAndroid_11_OkHttp
-	case setup == "ios":
-		return utls.HelloIOS_14
-	case setup == "firefox":
-		return utls.HelloFirefox_105
-	case setup == "chrome":
-		return utls.HelloChrome_106_Shuffle
-	default:
-		return utls.HelloChrome_106_Shuffle
 	}
+
+	if hello, ok := builtinHellos[setup]; ok {
+		return hello
+	}
+
+	return utls.HelloChrome_120
 }
 
-func NewRoundTripper(JA3, Setup, UserAgent string, downgrade bool) http.RoundTripper {
-	return &roundTripper{
-		dialer: proxy.Direct,
+func NewRoundTripper(opts Options) http.RoundTripper {
+	if opts.Protocols == nil {
+		opts.Protocols = NewProtocolCache(DEFAULT_PROTOCOL_TTL)
+	}
+
+	var dialer proxy.ContextDialer = proxy.Direct
+	if opts.Upstream != nil {
+		dialer = &resolvingDialer{overrides: opts.Resolve, forward: opts.Upstream.dialer, acl: opts.ACL}
+	} else if opts.Resolver != nil || len(opts.Resolve) > 0 || opts.Bind.Mode != BindOff || !opts.ACL.Empty() {
+		resolving := &resolvingDialer{resolver: opts.Resolver, overrides: opts.Resolve, acl: opts.ACL}
 
-		JA3:       JA3,
-		Setup:     Setup,
-		UserAgent: UserAgent,
-		Downgrade: downgrade,
+		// One source address per family for every connection of the request
+		if opts.Bind.Mode != BindOff {
+			resolving.bound = true
+			resolving.source4, resolving.source6 = opts.Bind.sources()
+		}
+
+		dialer = resolving
+	}
+
+	return &roundTripper{
+		dialer:  dialer,
+		Options: opts,
 
-		transports:  make(map[string]http.RoundTripper),
 		connections: make(map[string]net.Conn),
+		probes:      make(map[string]*probeCall),
 	}
 }
@@ -0,0 +1,350 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+	utls "github.com/refraction-networking/utls"
+)
+
+// helloFingerprint marshals spec into a ClientHello and returns its JA3 and JA3N strings and
+// the extension ids in order, GREASE values included. Padding is left out of both strings as
+// it is only sent when the hello length calls for it
+func helloFingerprint(t *testing.T, spec *utls.ClientHelloSpec) (ja3, ja3n string, extensions []uint16) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := utls.UClient(client, &utls.Config{ServerName: "example.test", OmitEmptyPsk: true}, utls.HelloCustom)
+	if err := conn.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := conn.HandshakeState.Hello.Raw
+
+	// Skip the handshake header, version, random and session id
+	off := 4 + 2 + 32
+	off += 1 + int(raw[off])
+
+	var ciphers []string
+	suites := int(binary.BigEndian.Uint16(raw[off:]))
+	for i := off + 2; i < off+2+suites; i += 2 {
+		if id := binary.BigEndian.Uint16(raw[i:]); !isGREASE(id) {
+			ciphers = append(ciphers, fmt.Sprint(id))
+		}
+	}
+	off += 2 + suites
+	off += 1 + int(raw[off])
+
+	var exts, curves, points []string
+	end := off + 2 + int(binary.BigEndian.Uint16(raw[off:]))
+	for off += 2; off < end; {
+		id := binary.BigEndian.Uint16(raw[off:])
+		length := int(binary.BigEndian.Uint16(raw[off+2:]))
+		data := raw[off+4 : off+4+length]
+		off += 4 + length
+
+		extensions = append(extensions, id)
+		if isGREASE(id) || id == 21 {
+			continue
+		}
+		exts = append(exts, fmt.Sprint(id))
+
+		switch id {
+		case 10:
+			for i := 2; i < len(data); i += 2 {
+				if curve := binary.BigEndian.Uint16(data[i:]); !isGREASE(curve) {
+					curves = append(curves, fmt.Sprint(curve))
+				}
+			}
+		case 11:
+			for _, point := range data[1:] {
+				points = append(points, fmt.Sprint(point))
+			}
+		}
+	}
+
+	join := func(values []string) string { return strings.Join(values, "-") }
+	ja3 = strings.Join([]string{"771", join(ciphers), join(exts), join(curves), join(points)}, ",")
+
+	sort.Slice(exts, func(i, j int) bool {
+		return len(exts[i]) < len(exts[j]) || len(exts[i]) == len(exts[j]) && exts[i] < exts[j]
+	})
+	ja3n = strings.Join([]string{"771", join(ciphers), join(exts), join(curves), join(points)}, ",")
+
+	return ja3, ja3n, extensions
+}
+
+func TestShuffleKeepsJA3N(t *testing.T) {
+	rt := NewRoundTripper(Options{JA3: testChromeJA3, UserAgent: testChromeUA, Shuffle: true}).(*roundTripper)
+
+	ja3s := make(map[string]bool)
+	ja3ns := make(map[string]bool)
+
+	for i := 0; i < 20; i++ {
+		spec, err := rt.clientHelloSpec("example.test:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ja3, ja3n, extensions := helloFingerprint(t, spec)
+		ja3s[ja3], ja3ns[ja3n] = true, true
+
+		last := len(extensions) - 1
+		if extensions[last] == 21 {
+			last--
+		}
+		if !isGREASE(extensions[0]) {
+			t.Fatalf("first extension %d is not GREASE: %v", extensions[0], extensions)
+		}
+		if !isGREASE(extensions[last]) {
+			t.Fatalf("GREASE is not last before padding: %v", extensions)
+		}
+	}
+
+	if len(ja3ns) != 1 {
+		t.Fatalf("JA3N changed across connections: %v", ja3ns)
+	}
+	if len(ja3s) < 2 {
+		t.Fatalf("JA3 stayed %v over 20 connections", ja3s)
+	}
+}
+
+func TestShuffleOff(t *testing.T) {
+	rt := NewRoundTripper(Options{JA3: testChromeJA3, UserAgent: testChromeUA}).(*roundTripper)
+
+	ja3s := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		spec, err := rt.clientHelloSpec("example.test:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ja3, _, _ := helloFingerprint(t, spec)
+		ja3s[ja3] = true
+	}
+
+	if len(ja3s) != 1 {
+		t.Fatalf("JA3 changed without shuffling: %v", ja3s)
+	}
+}
+
+func TestShuffleKeepsPreSharedKeyLast(t *testing.T) {
+	ja3 := strings.Replace(testChromeJA3, "-21,", "-21-41,", 1)
+	plain := NewRoundTripper(Options{JA3: ja3, UserAgent: testChromeUA}).(*roundTripper)
+	shuffled := NewRoundTripper(Options{JA3: ja3, UserAgent: testChromeUA, Shuffle: true}).(*roundTripper)
+
+	want, err := plain.clientHelloSpec("example.test:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed := func(ext utls.TLSExtension) bool {
+		switch ext.(type) {
+		case *utls.UtlsGREASEExtension, *utls.UtlsPaddingExtension, *utls.UtlsPreSharedKeyExtension:
+			return true
+		}
+		return false
+	}
+
+	for i := 0; i < 20; i++ {
+		spec, err := shuffled.clientHelloSpec("example.test:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := spec.Extensions[len(spec.Extensions)-1].(*utls.UtlsPreSharedKeyExtension); !ok {
+			t.Fatalf("pre_shared_key is not last: %T", spec.Extensions[len(spec.Extensions)-1])
+		}
+
+		for j, ext := range want.Extensions {
+			if fixed(ext) && fmt.Sprintf("%T", spec.Extensions[j]) != fmt.Sprintf("%T", ext) {
+				t.Fatalf("extension %d is %T, want %T", j, spec.Extensions[j], ext)
+			}
+		}
+	}
+}
+
+// startOrigin serves the protocol of each request over TLS, h2 decides whether HTTP/2 is offered,
+// and counts the connections accepted
+func startOrigin(t *testing.T, h2 bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+
+	var conns atomic.Int32
+	server.Config.ConnState = func(_ net.Conn, state stdhttp.ConnState) {
+		if state == stdhttp.StateNew {
+			conns.Add(1)
+		}
+	}
+
+	server.EnableHTTP2 = h2
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, &conns
+}
+
+func TestRoundTripConcurrentOrigins(t *testing.T) {
+	type origin struct {
+		url   string
+		proto string
+		conns *atomic.Int32
+	}
+
+	var origins []origin
+	for i := 0; i < 6; i++ {
+		h2 := i%2 == 0
+		server, conns := startOrigin(t, h2)
+
+		proto := "HTTP/1.1"
+		if h2 {
+			proto = "HTTP/2.0"
+		}
+
+		origins = append(origins, origin{url: server.URL, proto: proto, conns: conns})
+	}
+
+	opts := Options{
+		JA3:       testChromeJA3,
+		UserAgent: testChromeUA,
+		Insecure:  true,
+		Shuffle:   true,
+		Protocols: NewProtocolCache(time.Hour),
+		Sessions:  NewSessionStore(64, time.Hour),
+	}
+
+	shared := NewRoundTripper(opts)
+	defer shared.(*roundTripper).CloseIdleConnections()
+
+	tests := []struct {
+		name string
+		// roundTripper returns the round tripper of one request
+		roundTripper func() http.RoundTripper
+	}{
+		// One round tripper per sticky session
+		{"shared", func() http.RoundTripper { return shared }},
+		// One round tripper per request, only the caches are shared
+		{"per request", func() http.RoundTripper { return NewRoundTripper(opts) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make(chan error, 32*len(origins))
+
+			for g := 0; g < 32; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+
+					for i := 0; i < len(origins); i++ {
+						o := origins[(g+i)%len(origins)]
+						rt := tt.roundTripper()
+
+						req, err := http.NewRequest("GET", o.url, nil)
+						if err != nil {
+							errs <- err
+							return
+						}
+
+						resp, err := rt.RoundTrip(req)
+						if err != nil {
+							errs <- fmt.Errorf("%s: %w", o.url, err)
+							continue
+						}
+
+						body, err := io.ReadAll(resp.Body)
+						resp.Body.Close()
+
+						if err != nil || string(body) != o.proto || resp.TLS == nil {
+							errs <- fmt.Errorf("%s: body %q (%v), want %s", o.url, body, err, o.proto)
+						}
+
+						if rt != shared {
+							rt.(*roundTripper).CloseIdleConnections()
+						}
+					}
+				}(g)
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+
+		if tt.name == "shared" {
+			// Concurrent requests waited for one probe per origin and share its HTTP/2 connection
+			for _, o := range origins {
+				if o.proto == "HTTP/2.0" && o.conns.Load() != 1 {
+					t.Errorf("%s accepted %d connections, want 1", o.url, o.conns.Load())
+				}
+			}
+		}
+	}
+}
+
+func TestRoundTripProbeCanceled(t *testing.T) {
+	server, _ := startOrigin(t, true)
+
+	rt := NewRoundTripper(Options{JA3: testChromeJA3, UserAgent: testChromeUA, Insecure: true})
+	defer rt.(*roundTripper).CloseIdleConnections()
+
+	// A canceled request must not fail the others probing the same origin
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			if i == 0 {
+				req = req.WithContext(ctx)
+			}
+
+			resp, err := rt.RoundTrip(req)
+			if i == 0 {
+				if err == nil {
+					resp.Body.Close()
+				}
+				return
+			}
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(i)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Profiles with a session cache, the least recently used one is dropped beyond it;
+// custom JA3 strings are profiles too, so clients can make up any number of them
+const MAX_SESSION_PROFILES = 256
+
+// SessionStore keeps a TLS session cache for every client profile
+type SessionStore struct {
+	sync.Mutex
+
+	size   int
+	ttl    time.Duration
+	order  *list.List
+	caches map[string]*list.Element
+}
+
+type profileCache struct {
+	profile string
+	cache   *sessionCache
+}
+
+// NewSessionStore creates a store whose per-profile caches hold up to size hosts for ttl
+func NewSessionStore(size int, ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		size:   size,
+		ttl:    ttl,
+		order:  list.New(),
+		caches: make(map[string]*list.Element),
+	}
+}
+
+// cache returns the session cache of a profile, nil when resumption is disabled
+func (s *SessionStore) cache(profile string) *sessionCache {
+	if s == nil || s.size <= 0 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if elem, ok := s.caches[profile]; ok {
+		s.order.MoveToFront(elem)
+		return elem.Value.(*profileCache).cache
+	}
+
+	cache := &sessionCache{
+		size:    s.size,
+		ttl:     s.ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	s.caches[profile] = s.order.PushFront(&profileCache{profile: profile, cache: cache})
+
+	for s.order.Len() > MAX_SESSION_PROFILES {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.caches, oldest.Value.(*profileCache).profile)
+	}
+
+	return cache
+}
+
+type sessionEntry struct {
+	key     string
+	state   *utls.ClientSessionState
+	expires time.Time
+}
+
+// sessionCache is an LRU utls.ClientSessionCache with expiring entries,
+// keys are server names so one cache covers every host of a profile
+type sessionCache struct {
+	sync.Mutex
+
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func (c *sessionCache) Get(key string) (*utls.ClientSessionState, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*sessionEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.state, true
+}
+
+func (c *sessionCache) Put(key string, state *utls.ClientSessionState) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		if state == nil {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+			return
+		}
+
+		entry := elem.Value.(*sessionEntry)
+		entry.state, entry.expires = state, time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if state == nil {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&sessionEntry{
+		key:     key,
+		state:   state,
+		expires: time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionEntry).key)
+	}
+}
+
+// freshSessionCache never offers a cached session but still stores the new one
+type freshSessionCache struct {
+	*sessionCache
+}
+
+func (c freshSessionCache) Get(string) (*utls.ClientSessionState, bool) {
+	return nil, false
+}
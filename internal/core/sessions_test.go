@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestSessionStoreBoundsProfiles(t *testing.T) {
+	store := NewSessionStore(8, time.Hour)
+
+	first := store.cache("setup:chrome")
+	for i := 0; i < MAX_SESSION_PROFILES+50; i++ {
+		store.cache(fmt.Sprintf("ja3:771,%d,0,29,0", i))
+
+		// The built in profile stays in use
+		if store.cache("setup:chrome") != first {
+			t.Fatal("cache of a profile in use was dropped")
+		}
+	}
+
+	if len(store.caches) != MAX_SESSION_PROFILES || store.order.Len() != MAX_SESSION_PROFILES {
+		t.Fatalf("store holds %d profiles, want %d", len(store.caches), MAX_SESSION_PROFILES)
+	}
+	if _, ok := store.caches["ja3:771,0,0,29,0"]; ok {
+		t.Fatal("least recently used profile was kept")
+	}
+}
+
+func TestSessionStoreDisabled(t *testing.T) {
+	var nilStore *SessionStore
+	if nilStore.cache("setup:chrome") != nil || NewSessionStore(0, time.Hour).cache("setup:chrome") != nil {
+		t.Fatal("disabled store returned a cache")
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	store := NewSessionStore(2, time.Hour)
+	cache := store.cache("setup:chrome")
+
+	a, b, c := &utls.ClientSessionState{}, &utls.ClientSessionState{}, &utls.ClientSessionState{}
+	cache.Put("a.test", a)
+	cache.Put("b.test", b)
+
+	if got, ok := cache.Get("a.test"); !ok || got != a {
+		t.Fatal("session of a.test is missing")
+	}
+
+	// b.test is the least recently used host now
+	cache.Put("c.test", c)
+	if _, ok := cache.Get("b.test"); ok {
+		t.Fatal("least recently used session was kept")
+	}
+
+	cache.Put("a.test", nil)
+	if _, ok := cache.Get("a.test"); ok {
+		t.Fatal("a nil session did not remove the entry")
+	}
+
+	cache.entries["c.test"].Value.(*sessionEntry).expires = time.Now().Add(-time.Second)
+	if _, ok := cache.Get("c.test"); ok || len(cache.entries) != 0 {
+		t.Fatal("expired session was returned")
+	}
+
+	cache.Put("a.test", a)
+	if _, ok := (freshSessionCache{cache}).Get("a.test"); ok {
+		t.Fatal("fresh cache offered a session")
+	}
+}
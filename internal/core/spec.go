@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// SpecOptions tunes the parts of a ClientHello that a JA3 token does not describe,
+// every field is a JA3 style dash separated list of decimal ids and empty keeps the default
+type SpecOptions struct {
+	SignatureAlgorithms  string `json:"signature_algorithms,omitempty"`
+	DelegatedCredentials string `json:"delegated_credentials,omitempty"`
+	CertCompression      string `json:"cert_compression,omitempty"`
+	KeyShares            string `json:"key_shares,omitempty"`
+}
+
+var defaultSignatureAlgorithms = []utls.SignatureScheme{
+	utls.ECDSAWithP256AndSHA256,
+	utls.PSSWithSHA256,
+	utls.PKCS1WithSHA256,
+	utls.ECDSAWithP384AndSHA384,
+	utls.PSSWithSHA384,
+	utls.PKCS1WithSHA384,
+	utls.PSSWithSHA512,
+	utls.PKCS1WithSHA512,
+}
+
+// Firefox advertises delegated credentials with these schemes
+var defaultDelegatedCredentials = []utls.SignatureScheme{
+	utls.ECDSAWithP256AndSHA256,
+	utls.ECDSAWithP384AndSHA384,
+	utls.ECDSAWithP521AndSHA512,
+	utls.ECDSAWithSHA1,
+}
+
+// Override returns o with every non empty field of other taking precedence
+func (o SpecOptions) Override(other SpecOptions) SpecOptions {
+	if other.SignatureAlgorithms != "" {
+		o.SignatureAlgorithms = other.SignatureAlgorithms
+	}
+	if other.DelegatedCredentials != "" {
+		o.DelegatedCredentials = other.DelegatedCredentials
+	}
+	if other.CertCompression != "" {
+		o.CertCompression = other.CertCompression
+	}
+	if other.KeyShares != "" {
+		o.KeyShares = other.KeyShares
+	}
+
+	return o
+}
+
+// ApplySpecOptions rewrites the matching extensions of spec, extensions missing from spec are left out
+func ApplySpecOptions(spec *utls.ClientHelloSpec, opts SpecOptions) error {
+	sigAlgs, err := parseSchemes(opts.SignatureAlgorithms)
+	if err != nil {
+		return fmt.Errorf("invalid signature algorithms: %w", err)
+	}
+
+	delegated, err := parseSchemes(opts.DelegatedCredentials)
+	if err != nil {
+		return fmt.Errorf("invalid delegated credentials: %w", err)
+	}
+
+	compression, err := parseIDs(opts.CertCompression)
+	if err != nil {
+		return fmt.Errorf("invalid cert compression: %w", err)
+	}
+
+	keyShares, err := parseIDs(opts.KeyShares)
+	if err != nil {
+		return fmt.Errorf("invalid key shares: %w", err)
+	}
+
+	for _, ext := range spec.Extensions {
+		switch e := ext.(type) {
+		case *utls.SignatureAlgorithmsExtension:
+			if sigAlgs != nil {
+				e.SupportedSignatureAlgorithms = sigAlgs
+			}
+		case *utls.SignatureAlgorithmsCertExtension:
+			if sigAlgs != nil {
+				e.SupportedSignatureAlgorithms = sigAlgs
+			}
+		case *utls.DelegatedCredentialsExtension:
+			if delegated != nil {
+				e.SupportedSignatureAlgorithms = delegated
+			}
+		case *utls.UtlsCompressCertExtension:
+			if compression != nil {
+				e.Algorithms = make([]utls.CertCompressionAlgo, len(compression))
+				for i, id := range compression {
+					e.Algorithms[i] = utls.CertCompressionAlgo(id)
+				}
+			}
+		case *utls.KeyShareExtension:
+			if keyShares != nil {
+				e.KeyShares = make([]utls.KeyShare, len(keyShares))
+				for i, id := range keyShares {
+					e.KeyShares[i] = keyShare(utls.CurveID(id))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// deriveKeyShares picks the groups a browser with these supported curves sends key shares for:
+// the first post-quantum hybrid and X25519, plus P-256 for non Chromium clients
+func deriveKeyShares(curves []utls.CurveID, chrome bool) []utls.KeyShare {
+	var shares []utls.KeyShare
+	if chrome {
+		shares = append(shares, keyShare(utls.CurveID(utls.GREASE_PLACEHOLDER)))
+	}
+
+	supported := make(map[utls.CurveID]bool, len(curves))
+	for _, curve := range curves {
+		supported[curve] = true
+	}
+
+	for _, curve := range curves {
+		if curve == utls.X25519MLKEM768 || curve == utls.X25519Kyber768Draft00 {
+			shares = append(shares, keyShare(curve))
+			break
+		}
+	}
+
+	if supported[utls.X25519] {
+		shares = append(shares, keyShare(utls.X25519))
+	}
+
+	if supported[utls.CurveP256] && (!chrome || !supported[utls.X25519]) {
+		shares = append(shares, keyShare(utls.CurveP256))
+	}
+
+	// Fall back to the most preferred real curve
+	if len(shares) == 0 || chrome && len(shares) == 1 {
+		for _, curve := range curves {
+			if !isGREASE(uint16(curve)) {
+				shares = append(shares, keyShare(curve))
+				break
+			}
+		}
+	}
+
+	return shares
+}
+
+func keyShare(curve utls.CurveID) utls.KeyShare {
+	if isGREASE(uint16(curve)) {
+		return utls.KeyShare{Group: utls.CurveID(utls.GREASE_PLACEHOLDER), Data: []byte{0}}
+	}
+
+	return utls.KeyShare{Group: curve}
+}
+
+func isGREASE(id uint16) bool {
+	return id&0x0f0f == 0x0a0a && id>>8 == id&0xff
+}
+
+func parseSchemes(value string) ([]utls.SignatureScheme, error) {
+	ids, err := parseIDs(value)
+	if err != nil || ids == nil {
+		return nil, err
+	}
+
+	schemes := make([]utls.SignatureScheme, len(ids))
+	for i, id := range ids {
+		schemes[i] = utls.SignatureScheme(id)
+	}
+
+	return schemes, nil
+}
+
+func parseIDs(value string) ([]uint16, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var ids []uint16
+	for _, token := range strings.Split(value, "-") {
+		id, err := strconv.ParseUint(strings.TrimSpace(token), 10, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, uint16(id))
+	}
+
+	return ids, nil
+}
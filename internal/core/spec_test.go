@@ -0,0 +1,181 @@
+package core
+
+import (
+	"slices"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const testFirefoxUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:120.0) Gecko/20100101 Firefox/120.0"
+
+func shareGroups(shares []utls.KeyShare) []utls.CurveID {
+	groups := make([]utls.CurveID, len(shares))
+	for i, share := range shares {
+		groups[i] = share.Group
+	}
+
+	return groups
+}
+
+func TestDeriveKeyShares(t *testing.T) {
+	grease := utls.CurveID(utls.GREASE_PLACEHOLDER)
+
+	tests := []struct {
+		name   string
+		curves []utls.CurveID
+		chrome bool
+		want   []utls.CurveID
+	}{
+		{"chrome", []utls.CurveID{utls.X25519, utls.CurveP256, utls.CurveP384}, true, []utls.CurveID{grease, utls.X25519}},
+		{"chrome post-quantum", []utls.CurveID{utls.X25519MLKEM768, utls.X25519, utls.CurveP256}, true, []utls.CurveID{grease, utls.X25519MLKEM768, utls.X25519}},
+		{"chrome kyber draft", []utls.CurveID{utls.X25519Kyber768Draft00, utls.X25519}, true, []utls.CurveID{grease, utls.X25519Kyber768Draft00, utls.X25519}},
+		{"first hybrid only", []utls.CurveID{utls.X25519MLKEM768, utls.X25519Kyber768Draft00, utls.X25519}, true, []utls.CurveID{grease, utls.X25519MLKEM768, utls.X25519}},
+		{"chrome without x25519", []utls.CurveID{utls.CurveP256, utls.CurveP384}, true, []utls.CurveID{grease, utls.CurveP256}},
+		{"firefox", []utls.CurveID{utls.X25519, utls.CurveP256, utls.CurveP384, utls.CurveP521}, false, []utls.CurveID{utls.X25519, utls.CurveP256}},
+		{"firefox post-quantum", []utls.CurveID{utls.X25519MLKEM768, utls.X25519, utls.CurveP256}, false, []utls.CurveID{utls.X25519MLKEM768, utls.X25519, utls.CurveP256}},
+		{"no key share curve", []utls.CurveID{utls.CurveP384, utls.CurveP521}, false, []utls.CurveID{utls.CurveP384}},
+		{"chrome no key share curve", []utls.CurveID{utls.CurveP384}, true, []utls.CurveID{grease, utls.CurveP384}},
+		{"grease skipped in fallback", []utls.CurveID{0x1a1a, utls.CurveP384}, false, []utls.CurveID{utls.CurveP384}},
+		{"no curves", nil, false, []utls.CurveID{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares := deriveKeyShares(tt.curves, tt.chrome)
+			if got := shareGroups(shares); !slices.Equal(got, tt.want) {
+				t.Fatalf("key shares = %v, want %v", got, tt.want)
+			}
+
+			if tt.chrome && len(shares) > 0 && (len(shares[0].Data) != 1 || shares[0].Data[0] != 0) {
+				t.Fatalf("GREASE key share data = %v, want one zero byte", shares[0].Data)
+			}
+		})
+	}
+}
+
+func TestStringToSpecKeySharesFromCurves(t *testing.T) {
+	ja3 := "771,4865-4866-4867,0-10-11-13-43-51,4588-29-23-24,0"
+
+	for _, tt := range []struct {
+		userAgent string
+		want      []utls.CurveID
+	}{
+		{testChromeUA, []utls.CurveID{utls.CurveID(utls.GREASE_PLACEHOLDER), utls.X25519MLKEM768, utls.X25519}},
+		{testFirefoxUA, []utls.CurveID{utls.X25519MLKEM768, utls.X25519, utls.CurveP256}},
+	} {
+		spec, err := StringToSpec(ja3, tt.userAgent, []string{"h2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, ext := range spec.Extensions {
+			if keyShares, ok := ext.(*utls.KeyShareExtension); ok {
+				if got := shareGroups(keyShares.KeyShares); !slices.Equal(got, tt.want) {
+					t.Errorf("%s: key shares = %v, want %v", tt.userAgent, got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestApplySpecOptions(t *testing.T) {
+	// Firefox style token with signature algorithms, delegated credentials, compress_certificate,
+	// key_share and signature_algorithms_cert
+	ja3 := "771,4865-4867-4866,0-23-65281-10-11-35-16-5-34-51-43-13-45-28-27-50,29-23-24-25,0"
+
+	spec, err := StringToSpec(ja3, testFirefoxUA, []string{"h2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplySpecOptions(spec, SpecOptions{
+		SignatureAlgorithms:  "1027-2052-1025",
+		DelegatedCredentials: "1027-1283",
+		CertCompression:      "2-1-3",
+		KeyShares:            "29-23",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := 0
+	for _, ext := range spec.Extensions {
+		switch e := ext.(type) {
+		case *utls.SignatureAlgorithmsExtension:
+			seen++
+			if want := []utls.SignatureScheme{1027, 2052, 1025}; !slices.Equal(e.SupportedSignatureAlgorithms, want) {
+				t.Errorf("signature algorithms = %v, want %v", e.SupportedSignatureAlgorithms, want)
+			}
+		case *utls.SignatureAlgorithmsCertExtension:
+			seen++
+			if want := []utls.SignatureScheme{1027, 2052, 1025}; !slices.Equal(e.SupportedSignatureAlgorithms, want) {
+				t.Errorf("signature algorithms cert = %v, want %v", e.SupportedSignatureAlgorithms, want)
+			}
+		case *utls.DelegatedCredentialsExtension:
+			seen++
+			if want := []utls.SignatureScheme{1027, 1283}; !slices.Equal(e.SupportedSignatureAlgorithms, want) {
+				t.Errorf("delegated credentials = %v, want %v", e.SupportedSignatureAlgorithms, want)
+			}
+		case *utls.UtlsCompressCertExtension:
+			seen++
+			if want := []utls.CertCompressionAlgo{2, 1, 3}; !slices.Equal(e.Algorithms, want) {
+				t.Errorf("cert compression = %v, want %v", e.Algorithms, want)
+			}
+		case *utls.KeyShareExtension:
+			seen++
+			if want := []utls.CurveID{utls.X25519, utls.CurveP256}; !slices.Equal(shareGroups(e.KeyShares), want) {
+				t.Errorf("key shares = %v, want %v", shareGroups(e.KeyShares), want)
+			}
+		}
+	}
+
+	if seen != 5 {
+		t.Fatalf("found %d of the 5 tuned extensions", seen)
+	}
+
+	// The defaults other specs start from are left alone
+	if defaultSignatureAlgorithms[0] != utls.ECDSAWithP256AndSHA256 || len(defaultDelegatedCredentials) != 4 {
+		t.Fatal("default lists were modified")
+	}
+}
+
+func TestApplySpecOptionsKeepsMissingExtensionsOut(t *testing.T) {
+	spec, err := StringToSpec("771,4865,0-10-11,29,0", testFirefoxUA, []string{"h2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(spec.Extensions)
+	if err := ApplySpecOptions(spec, SpecOptions{DelegatedCredentials: "1027", CertCompression: "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spec.Extensions) != before {
+		t.Fatalf("extensions = %d, want %d", len(spec.Extensions), before)
+	}
+}
+
+func TestApplySpecOptionsInvalid(t *testing.T) {
+	for _, opts := range []SpecOptions{
+		{SignatureAlgorithms: "1027-abc"},
+		{DelegatedCredentials: "70000"},
+		{CertCompression: "-"},
+		{KeyShares: "29--23"},
+	} {
+		spec, _ := StringToSpec("771,4865,0-10-11-13-51,29,0", testChromeUA, []string{"h2"})
+		if err := ApplySpecOptions(spec, opts); err == nil {
+			t.Errorf("ApplySpecOptions(%+v) accepted the options", opts)
+		}
+	}
+}
+
+func TestSpecOptionsOverride(t *testing.T) {
+	base := SpecOptions{SignatureAlgorithms: "1027", CertCompression: "2"}
+	got := base.Override(SpecOptions{CertCompression: "1", KeyShares: "29"})
+
+	want := SpecOptions{SignatureAlgorithms: "1027", CertCompression: "1", KeyShares: "29"}
+	if got != want {
+		t.Fatalf("override = %+v, want %+v", got, want)
+	}
+}
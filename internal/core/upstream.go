@@ -0,0 +1,154 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/Kolosok86/http/http2"
+	"golang.org/x/net/proxy"
+)
+
+// Upstream is a proxy outbound connections are tunneled through
+type Upstream struct {
+	URL    *url.URL
+	dialer proxy.ContextDialer
+}
+
+// ParseUpstream reads an upstream proxy URL, socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port for an HTTP CONNECT proxy
+func ParseUpstream(raw string) (*Upstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy %q", raw)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy %q: %w", raw, err)
+		}
+
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("invalid upstream proxy %q: no context support", raw)
+		}
+
+		return &Upstream{URL: u, dialer: contextDialer}, nil
+	case "http":
+		return &Upstream{URL: u, dialer: &connectDialer{proxy: u}}, nil
+	default:
+		return nil, fmt.Errorf("invalid upstream proxy %q: unsupported scheme %s", raw, u.Scheme)
+	}
+}
+
+// upstreamError is a failure to open a tunnel through the upstream proxy
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// String returns the upstream URL without credentials
+func (u *Upstream) String() string {
+	return u.URL.Redacted()
+}
+
+// connectDialer opens tunnels through an HTTP proxy with CONNECT
+type connectDialer struct {
+	proxy  *url.URL
+	dialer net.Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("upstream proxy: network %s is not supported", network)
+	}
+
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is bound to ctx like any dial
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	req := &stdhttp.Request{
+		Method: stdhttp.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(stdhttp.Header),
+	}
+
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := stdhttp.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != stdhttp.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("upstream proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		_ = conn.Close()
+		return nil, errors.New("upstream proxy: data after CONNECT response")
+	}
+
+	return conn, nil
+}
+
+// IsRetryable reports whether err is a transient connection failure a request can be sent
+// again after: resets, handshake failures, refused dials and HTTP/2 GOAWAY
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var goAway http2.GoAwayError
+	if errors.As(err, &goAway) || errors.Is(err, errUnsupportedCurve) {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	// A connection that closes before the response or during the handshake
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/Kolosok86/http/http2"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("net/http: HTTP/1.x transport connection broken: %w", io.ErrUnexpectedEOF), true},
+		{fmt.Errorf("handshake: %w", io.EOF), true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("no route to host")}, true},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeNo}, true},
+		{context.Canceled, false},
+		{fmt.Errorf("read: %w", context.DeadlineExceeded), false},
+		// Only the error value counts, not a message mentioning EOF
+		{errors.New("upstream proxy: CONNECT example.com:443: 502 EOF from origin"), false},
+		{errors.New("x509: certificate signed by unknown authority"), false},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
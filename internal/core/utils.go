@@ -20,6 +20,27 @@ var blacklist = []string{
 	"proxy-downgrade",
 	"proxy-tls-setup",
 	"proxy-tls",
+	"proxy-insecure",
+	"proxy-tls-peer",
+	"proxy-tls-fresh",
+	"proxy-ech",
+	"proxy-tls-sigalgs",
+	"proxy-tls-delegated-credentials",
+	"proxy-tls-cert-compression",
+	"proxy-tls-keyshares",
+	"proxy-tls-shuffle",
+	"proxy-http3",
+	"proxy-resolve",
+	"proxy-bind",
+	"proxy-session",
+	"proxy-cookies",
+	"proxy-redirect",
+	"proxy-retries",
+	"proxy-decompress",
+	"proxy-max-request-body",
+	"proxy-max-response-body",
+	"proxy-client-hints",
+	"proxy-consistency",
 }
 
 func itsChrome(userAgent string) bool {
@@ -101,6 +122,7 @@ func StringToSpec(ja3 string, userAgent string, proto []string) (*utls.ClientHel
 	}
 
 	extMap["10"] = &utls.SupportedCurvesExtension{Curves: targetCurves}
+	extMap["51"] = &utls.KeyShareExtension{KeyShares: deriveKeyShares(targetCurves[1:], chrome)}
 
 	// Parse point formats
 	var targetPointFormats []byte
@@ -124,7 +146,7 @@ func StringToSpec(ja3 string, userAgent string, proto []string) (*utls.ClientHel
 	for _, e := range extensions {
 		te, ok := extMap[e]
 		if !ok {
-			return nil, nil
+			return nil, fmt.Errorf("invalid JA3 string: unsupported extension %s", e)
 		}
 
 		// Optionally add Chrome Grease Extension
@@ -164,16 +186,7 @@ func genMap(proto []string) (extMap map[string]utls.TLSExtension) {
 		"0": &utls.SNIExtension{},
 		"5": &utls.StatusRequestExtension{},
 		"13": &utls.SignatureAlgorithmsExtension{
-			SupportedSignatureAlgorithms: []utls.SignatureScheme{
-				utls.ECDSAWithP256AndSHA256,
-				utls.PSSWithSHA256,
-				utls.PKCS1WithSHA256,
-				utls.ECDSAWithP384AndSHA384,
-				utls.PSSWithSHA384,
-				utls.PKCS1WithSHA384,
-				utls.PSSWithSHA512,
-				utls.PKCS1WithSHA512,
-			},
+			SupportedSignatureAlgorithms: defaultSignatureAlgorithms,
 		},
 		"16": &utls.ALPNExtension{
 			AlpnProtocols: proto,
@@ -187,9 +200,11 @@ func genMap(proto []string) (extMap map[string]utls.TLSExtension) {
 			Algorithms: []utls.CertCompressionAlgo{utls.CertCompressionBrotli},
 		},
 		"28": &utls.FakeRecordSizeLimitExtension{}, //Limit: 0x4001
-		"34": &utls.GenericExtension{Id: 34},
+		"34": &utls.DelegatedCredentialsExtension{
+			SupportedSignatureAlgorithms: defaultDelegatedCredentials,
+		},
 		"35": &utls.SessionTicketExtension{},
-		"41": &utls.GenericExtension{Id: 41},
+		"41": &utls.UtlsPreSharedKeyExtension{},
 		"43": &utls.SupportedVersionsExtension{Versions: []uint16{
 			utls.GREASE_PLACEHOLDER,
 			utls.VersionTLS13,
@@ -200,17 +215,16 @@ func genMap(proto []string) (extMap map[string]utls.TLSExtension) {
 			utls.PskModeDHE,
 		}},
 		"49": &utls.GenericExtension{Id: 49}, // post_handshake_auth
-		"50": &utls.GenericExtension{Id: 50}, // signature_algorithms_cert
-		"51": &utls.KeyShareExtension{KeyShares: []utls.KeyShare{
-			{Group: utls.CurveID(utls.GREASE_PLACEHOLDER), Data: []byte{0}},
-			{Group: utls.X25519},
-		}},
+		"50": &utls.SignatureAlgorithmsCertExtension{
+			SupportedSignatureAlgorithms: defaultSignatureAlgorithms,
+		},
 		"13172": &utls.NPNExtension{},
 		"17513": &utls.ApplicationSettingsExtension{
 			SupportedProtocols: []string{
 				"h2",
 			},
 		},
+		"65037": utls.BoringGREASEECH(),
 		"65281": &utls.RenegotiationInfoExtension{
 			Renegotiation: utls.RenegotiateOnceAsClient,
 		},
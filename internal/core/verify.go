@@ -0,0 +1,140 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+var errPinMismatch = errors.New("tls: server certificate chain does not match any pinned key")
+
+// VerifyConfig controls how upstream server certificates are checked
+type VerifyConfig struct {
+	// RootCAs is the pool used for chain verification, nil means the system pool
+	RootCAs *x509.CertPool
+
+	// Pins maps a host to the accepted base64 SHA-256 hashes of a SubjectPublicKeyInfo
+	Pins map[string][]string
+
+	// Insecure disables chain verification, pinned keys are still enforced
+	Insecure bool
+}
+
+// LoadCertPool reads PEM encoded certificates from path into a new pool
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// AddPin parses a "host=hash" value and registers the pin, the hash may carry a "sha256/" prefix
+func (vc *VerifyConfig) AddPin(value string) error {
+	host, pin, ok := strings.Cut(value, "=")
+	if !ok || host == "" || pin == "" {
+		return fmt.Errorf("invalid pin %q: expected host=sha256/base64", value)
+	}
+
+	pin = strings.TrimPrefix(pin, "sha256/")
+	if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+		return fmt.Errorf("invalid pin %q: expected base64 encoded SHA-256 hash", value)
+	}
+
+	if vc.Pins == nil {
+		vc.Pins = make(map[string][]string)
+	}
+
+	host = strings.ToLower(host)
+	vc.Pins[host] = append(vc.Pins[host], pin)
+	return nil
+}
+
+func (vc *VerifyConfig) apply(config *utls.Config, insecure bool) {
+	config.RootCAs = vc.RootCAs
+	config.InsecureSkipVerify = vc.Insecure || insecure
+
+	if len(vc.Pins[strings.ToLower(config.ServerName)]) == 0 {
+		return
+	}
+
+	config.VerifyConnection = func(state utls.ConnectionState) error {
+		return vc.checkPins(config.ServerName, pinCandidates(state.VerifiedChains, state.PeerCertificates, config.InsecureSkipVerify))
+	}
+}
+
+// pinCandidates returns the certificates a pin may match: those of the verified chains, or
+// the leaf alone when the chain is not verified. Extra certificates a server sends are not
+// checked by anyone, a pinned public certificate among them proves nothing
+func pinCandidates(verified [][]*x509.Certificate, peers []*x509.Certificate, insecure bool) []*x509.Certificate {
+	if insecure {
+		if len(peers) == 0 {
+			return nil
+		}
+		return peers[:1]
+	}
+
+	var certs []*x509.Certificate
+	for _, chain := range verified {
+		certs = append(certs, chain...)
+	}
+
+	return certs
+}
+
+// checkPins accepts the chain when host has no pins or one of certs matches a pin
+func (vc *VerifyConfig) checkPins(host string, certs []*x509.Certificate) error {
+	pins := vc.Pins[strings.ToLower(host)]
+	if len(pins) == 0 {
+		return nil
+	}
+
+	for _, cert := range certs {
+		hash := spkiHash(cert)
+		for _, pin := range pins {
+			if hash == pin {
+				return nil
+			}
+		}
+	}
+
+	return errPinMismatch
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PeerChainSummary describes every certificate presented by the server, leaf first
+func PeerChainSummary(state *utls.ConnectionState) []string {
+	if state == nil {
+		return nil
+	}
+
+	summary := make([]string, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		fingerprint := sha256.Sum256(cert.Raw)
+		summary = append(summary, fmt.Sprintf("subject=%q; issuer=%q; not-after=%s; sha256=%s",
+			cert.Subject.String(),
+			cert.Issuer.String(),
+			cert.NotAfter.UTC().Format("2006-01-02T15:04:05Z"),
+			hex.EncodeToString(fingerprint[:]),
+		))
+	}
+
+	return summary
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+)
+
+// testIssuer is a certificate with its key that can sign others
+type testIssuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by parent, a self-signed CA when parent is nil
+func newTestCert(t *testing.T, name string, parent *testIssuer) *testIssuer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testIssuer{cert: cert, key: key}
+}
+
+// startChainServer serves over TLS with the leaf followed by the extra certificates
+func startChainServer(t *testing.T, leaf *testIssuer, extra ...*x509.Certificate) string {
+	t.Helper()
+
+	chain := tls.Certificate{Certificate: [][]byte{leaf.cert.Raw}, PrivateKey: leaf.key}
+	for _, cert := range extra {
+		chain.Certificate = append(chain.Certificate, cert.Raw)
+	}
+
+	server := httptest.NewUnstartedServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{chain}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestPins(t *testing.T) {
+	root := newTestCert(t, "test root", nil)
+	leaf := newTestCert(t, "test leaf", root)
+
+	// A public certificate of the pinned key an attacker can append to any chain
+	pinnedElsewhere := newTestCert(t, "pinned elsewhere", nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	tests := []struct {
+		name     string
+		pin      *x509.Certificate
+		extra    []*x509.Certificate
+		insecure bool
+		want     error
+	}{
+		{"pinned root", root.cert, []*x509.Certificate{root.cert}, false, nil},
+		{"pinned root not sent", root.cert, nil, false, nil},
+		{"pinned leaf", leaf.cert, nil, false, nil},
+		{"other key", pinnedElsewhere.cert, nil, false, errPinMismatch},
+		{"appended pinned certificate", pinnedElsewhere.cert, []*x509.Certificate{pinnedElsewhere.cert}, false, errPinMismatch},
+		{"insecure pinned leaf", leaf.cert, nil, true, nil},
+		{"insecure pinned root", root.cert, []*x509.Certificate{root.cert}, true, errPinMismatch},
+		{"insecure appended pinned certificate", pinnedElsewhere.cert, []*x509.Certificate{pinnedElsewhere.cert}, true, errPinMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := startChainServer(t, leaf, tt.extra...)
+
+			verify := &VerifyConfig{RootCAs: roots}
+			if err := verify.AddPin("127.0.0.1=sha256/" + spkiHash(tt.pin)); err != nil {
+				t.Fatal(err)
+			}
+
+			rt := NewRoundTripper(Options{JA3: testChromeJA3, UserAgent: testChromeUA, Verify: verify, Insecure: tt.insecure})
+			defer rt.(*roundTripper).CloseIdleConnections()
+
+			req, _ := http.NewRequest("GET", url, nil)
+			resp, err := rt.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinCandidates(t *testing.T) {
+	issuer := newTestCert(t, "test root", nil)
+	root, leaf := issuer.cert, newTestCert(t, "test leaf", issuer).cert
+	extra := newTestCert(t, "extra", nil).cert
+
+	peers := []*x509.Certificate{leaf, root, extra}
+
+	if got := pinCandidates([][]*x509.Certificate{{leaf, root}}, peers, false); len(got) != 2 || got[0] != leaf || got[1] != root {
+		t.Fatalf("verified candidates = %d certificates, want the leaf and the root", len(got))
+	}
+	if got := pinCandidates(nil, peers, false); len(got) != 0 {
+		t.Fatalf("unverified chain gave %d candidates, want none", len(got))
+	}
+	if got := pinCandidates(nil, peers, true); len(got) != 1 || got[0] != leaf {
+		t.Fatalf("insecure candidates = %d certificates, want the leaf", len(got))
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	root := newTestCert(t, "test root", nil)
+
+	files := map[string][]byte{
+		"root.pem":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw}),
+		"empty.pem":   nil,
+		"garbage.pem": []byte("not a certificate"),
+		"broken.pem":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("broken")}),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := LoadCertPool(filepath.Join(dir, "root.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"empty.pem", "garbage.pem", "broken.pem", "missing.pem"} {
+		if _, err := LoadCertPool(filepath.Join(dir, name)); err == nil {
+			t.Errorf("LoadCertPool(%s) accepted the file", name)
+		}
+	}
+}
+
+func TestAddPin(t *testing.T) {
+	valid := "sha256/" + spkiHash(newTestCert(t, "pin", nil).cert)
+
+	tests := []struct {
+		value string
+		err   bool
+	}{
+		{"Example.COM=" + valid, false},
+		{"example.com=" + valid[len("sha256/"):], false},
+		{"example.com", true},
+		{"=" + valid, true},
+		{"example.com=sha256/not-base64", true},
+		{"example.com=sha256/AAAA", true},
+	}
+
+	for _, tt := range tests {
+		vc := &VerifyConfig{}
+		if err := vc.AddPin(tt.value); (err != nil) != tt.err {
+			t.Errorf("AddPin(%q) error = %v", tt.value, err)
+		}
+	}
+}
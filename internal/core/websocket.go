@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/http2"
+)
+
+// Appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept (RFC 6455)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWebSocketAccept = errors.New("websocket: server answered with a wrong Sec-WebSocket-Accept")
+
+// isWebSocketUpgrade reports whether req asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.EqualFold(strings.TrimSpace(req.Header.Get("Upgrade")), "websocket")
+}
+
+// roundTripWebSocket opens a connection of its own for a WebSocket upgrade like a browser:
+// origins known to speak HTTP/2 get an RFC 8441 extended CONNECT stream when they allow it,
+// any other origin an HTTP/1.1 upgrade on a connection that offers only http/1.1 in ALPN.
+// A switched response has a body that is also an io.Writer, like with http.Transport
+func (rt *roundTripper) roundTripWebSocket(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	switch strings.ToLower(req.URL.Scheme) {
+	case "http":
+		conn, err := rt.dialer.DialContext(ctx, "tcp", webSocketAddr(req, "80"))
+		if err != nil {
+			return nil, err
+		}
+
+		return upgradeHTTP1(ctx, conn, req)
+	case "https":
+	default:
+		return nil, fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
+	}
+
+	addr := webSocketAddr(req, "443")
+
+	spec, err := rt.clientHelloSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rt.Downgrade && rt.Protocols.alpn(addr, offeredALPN(spec)) == http2.NextProtoTLS {
+		conn, err := rt.handshake(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+			resp, err := upgradeHTTP1(ctx, conn, req)
+			return withTLSState(resp, err, conn)
+		}
+
+		resp, err := connectHTTP2(ctx, conn, req)
+		if err != errExtendedConnectUnsupported {
+			return withTLSState(resp, err, conn)
+		}
+	}
+
+	offerOnlyHTTP1(spec)
+
+	conn, err := rt.handshakeSpec(ctx, "tcp", addr, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upgradeHTTP1(ctx, conn, req)
+	return withTLSState(resp, err, conn)
+}
+
+// withTLSState records the TLS state of conn in a successful response
+func withTLSState(resp *http.Response, err error, conn *utls.UConn) (*http.Response, error) {
+	if err == nil {
+		state := conn.ConnectionState()
+		resp.TLS = &state
+	}
+
+	return resp, err
+}
+
+func webSocketAddr(req *http.Request, port string) string {
+	if _, _, err := net.SplitHostPort(req.URL.Host); err == nil {
+		return req.URL.Host
+	}
+
+	return net.JoinHostPort(req.URL.Host, port)
+}
+
+// offerOnlyHTTP1 limits the ALPN extension to http/1.1, as browsers do on connections
+// they open for a WebSocket
+func offerOnlyHTTP1(spec *utls.ClientHelloSpec) {
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+}
+
+// upgradeHTTP1 sends the upgrade request on conn and hands the connection over on 101
+func upgradeHTTP1(ctx context.Context, conn net.Conn, req *http.Request) (*http.Response, error) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	// A node escape drops Connection, the upgrade needs it back
+	if !headerHasToken(req.Header, "Connection", "upgrade") {
+		req.Header.Add("Connection", "Upgrade")
+	}
+
+	if err := req.Write(conn); err != nil {
+		stop()
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if !stop() {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+		return resp, nil
+	}
+
+	// A browser fails the connection when the server did not answer our key (RFC 6455 4.1)
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(req.Header.Get("Sec-WebSocket-Key")) {
+		_ = conn.Close()
+		return nil, errWebSocketAccept
+	}
+
+	resp.Body = &upgradedConn{reader: reader, Conn: conn}
+	return resp, nil
+}
+
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketAccept computes the Sec-WebSocket-Accept answer to key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// connBody closes the connection of a refused upgrade with the response body
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	_ = b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+// upgradedConn is the body of a switched response, reads start with the bytes buffered
+// while the response was parsed
+type upgradedConn struct {
+	reader *bufio.Reader
+	net.Conn
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite ends the sending side while frames of the peer can still arrive
+func (c *upgradedConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
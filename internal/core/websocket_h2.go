@@ -0,0 +1,508 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// SETTINGS_ENABLE_CONNECT_PROTOCOL of RFC 8441
+const settingEnableConnectProtocol http2.SettingID = 0x8
+
+// The only stream of a WebSocket connection
+const webSocketStreamID = 1
+
+var errExtendedConnectUnsupported = errors.New("http2: server does not allow extended CONNECT")
+
+// Headers that belong to the HTTP/1.1 upgrade and are not sent on an HTTP/2 stream
+var webSocketHTTP1Headers = map[string]bool{
+	"connection":        true,
+	"upgrade":           true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"host":              true,
+	"te":                true,
+	"sec-websocket-key": true,
+}
+
+// Pseudo-header order of an extended CONNECT sent by Chrome
+var webSocketPseudoOrder = []string{":method", ":authority", ":scheme", ":path", ":protocol"}
+
+// h2Stream carries a WebSocket over an extended CONNECT stream (RFC 8441) on a connection
+// of its own, sent with the same SETTINGS and window as the regular HTTP/2 transport
+type h2Stream struct {
+	conn   net.Conn
+	framer *http2.Framer
+
+	// wmu serializes frame writes
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	// mu guards the send windows and the connection error
+	mu         sync.Mutex
+	cond       *sync.Cond
+	sendConn   int64
+	sendStream int64
+	maxFrame   int
+	err        error
+	closedSend bool
+
+	headers chan *http2.MetaHeadersFrame
+	body    *io.PipeReader
+	bodyW   *io.PipeWriter
+}
+
+// connectHTTP2 opens the WebSocket of req as an extended CONNECT stream on conn, which must
+// have negotiated h2. errExtendedConnectUnsupported means the server did not allow it and conn
+// is closed; a 200 is turned into the 101 the HTTP/1.1 client expects
+func connectHTTP2(ctx context.Context, conn net.Conn, req *http.Request) (*http.Response, error) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	s := &h2Stream{
+		conn:       conn,
+		bw:         bufio.NewWriter(conn),
+		sendConn:   65535,
+		sendStream: 65535,
+		maxFrame:   16384,
+		headers:    make(chan *http2.MetaHeadersFrame, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.framer = http2.NewFramer(s.bw, bufio.NewReader(conn))
+	s.framer.ReadMetaHeaders = hpack.NewDecoder(65536, nil)
+	s.body, s.bodyW = io.Pipe()
+
+	allowed, err := s.start()
+	if err == nil && !allowed {
+		err = errExtendedConnectUnsupported
+	}
+
+	if err == nil {
+		err = s.writeHeaders(req)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	go s.readLoop()
+
+	var frame *http2.MetaHeadersFrame
+	select {
+	case frame = <-s.headers:
+	case <-ctx.Done():
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+
+	if frame == nil {
+		_ = conn.Close()
+		return nil, s.failure()
+	}
+
+	return s.response(frame, req)
+}
+
+// start sends the preface with the transport's SETTINGS and reads those of the server,
+// reporting whether they allow extended CONNECT
+func (s *h2Stream) start() (bool, error) {
+	s.bw.WriteString(http2.ClientPreface)
+	s.framer.WriteSettings(
+		http2.Setting{ID: http2.SettingHeaderTableSize, Val: H2_HEADER_TABLE_SIZE},
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: H2_INITIAL_WINDOW_SIZE},
+		http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: H2_MAX_HEADER_LIST_SIZE},
+	)
+	s.framer.WriteWindowUpdate(0, 0xEF0001)
+	if err := s.bw.Flush(); err != nil {
+		return false, err
+	}
+
+	frame, err := s.framer.ReadFrame()
+	if err != nil {
+		return false, err
+	}
+
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok || settings.IsAck() {
+		return false, errors.New("http2: server did not start with SETTINGS")
+	}
+
+	allowed := false
+	err = settings.ForeachSetting(func(setting http2.Setting) error {
+		switch setting.ID {
+		case settingEnableConnectProtocol:
+			allowed = setting.Val == 1
+		case http2.SettingInitialWindowSize:
+			s.sendStream = int64(setting.Val)
+		case http2.SettingMaxFrameSize:
+			s.maxFrame = int(setting.Val)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, s.write(func() error { return s.framer.WriteSettingsAck() })
+}
+
+// writeHeaders sends the extended CONNECT with the client's pseudo-header and header order
+func (s *h2Stream) writeHeaders(req *http.Request) error {
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	pseudo := map[string]string{
+		":method":    http.MethodConnect,
+		":authority": host,
+		":scheme":    "https",
+		":path":      req.URL.RequestURI(),
+		":protocol":  "websocket",
+	}
+
+	order := webSocketPseudoOrder
+	if len(req.PseudoOrder.Order) > 0 {
+		order = append([]string(nil), req.PseudoOrder.Order...)
+		if !slices.Contains(order, ":protocol") {
+			order = append(order, ":protocol")
+		}
+	}
+
+	for _, name := range order {
+		if value, ok := pseudo[name]; ok {
+			encoder.WriteField(hpack.HeaderField{Name: name, Value: value})
+			delete(pseudo, name)
+		}
+	}
+
+	for _, name := range webSocketPseudoOrder {
+		if value, ok := pseudo[name]; ok {
+			encoder.WriteField(hpack.HeaderField{Name: name, Value: value})
+		}
+	}
+
+	for _, name := range orderedHeaderKeys(req) {
+		for _, value := range req.Header.Values(name) {
+			encoder.WriteField(hpack.HeaderField{Name: name, Value: value})
+		}
+	}
+
+	return s.write(func() error {
+		fragment := block.Bytes()
+		for first := true; first || len(fragment) > 0; first = false {
+			chunk := fragment[:min(len(fragment), s.maxFrame)]
+			fragment = fragment[len(chunk):]
+
+			var err error
+			if first {
+				err = s.framer.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      webSocketStreamID,
+					BlockFragment: chunk,
+					EndHeaders:    len(fragment) == 0,
+				})
+			} else {
+				err = s.framer.WriteContinuation(webSocketStreamID, len(fragment) == 0, chunk)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// orderedHeaderKeys lists the lowercase header names of req allowed on the stream, those
+// of the header order first and the rest sorted
+func orderedHeaderKeys(req *http.Request) []string {
+	var keys []string
+	seen := make(map[string]bool)
+
+	for _, name := range req.HeaderOrder.Order {
+		name = strings.ToLower(name)
+		if !seen[name] && !webSocketHTTP1Headers[name] && len(req.Header.Values(name)) > 0 {
+			keys = append(keys, name)
+		}
+		seen[name] = true
+	}
+
+	var rest []string
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if !seen[name] && !webSocketHTTP1Headers[name] {
+			rest = append(rest, name)
+		}
+		seen[name] = true
+	}
+	slices.Sort(rest)
+
+	return append(keys, rest...)
+}
+
+// response turns the answer of the server into an HTTP/1.1 response, a 200 becomes the 101
+// with the Sec-WebSocket-Accept for the client's key
+func (s *h2Stream) response(frame *http2.MetaHeadersFrame, req *http.Request) (*http.Response, error) {
+	status, err := strconv.Atoi(frame.PseudoValue("status"))
+	if err != nil {
+		_ = s.conn.Close()
+		return nil, fmt.Errorf("http2: malformed response status %q", frame.PseudoValue("status"))
+	}
+
+	header := make(http.Header)
+	for _, field := range frame.RegularFields() {
+		header.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+	}
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: -1,
+		Request:       req,
+	}
+
+	if status != http.StatusOK {
+		resp.Body = s
+		return resp, nil
+	}
+
+	resp.Status, resp.StatusCode = "101 Switching Protocols", http.StatusSwitchingProtocols
+	resp.ContentLength = 0
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", webSocketAccept(req.Header.Get("Sec-WebSocket-Key")))
+	resp.Body = s
+
+	return resp, nil
+}
+
+// readLoop serves the connection: DATA feeds the body, windows and control frames are
+// answered until the stream or the connection ends
+func (s *h2Stream) readLoop() {
+	err := s.serve()
+
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	select {
+	case s.headers <- nil:
+	default:
+	}
+
+	_ = s.bodyW.CloseWithError(err)
+}
+
+func (s *h2Stream) serve() error {
+	gotHeaders := false
+
+	for {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != webSocketStreamID {
+				continue
+			}
+
+			if !gotHeaders {
+				gotHeaders = true
+				s.headers <- f
+			}
+
+			if f.StreamEnded() {
+				return io.EOF
+			}
+		case *http2.DataFrame:
+			if f.StreamID != webSocketStreamID {
+				continue
+			}
+
+			if len(f.Data()) > 0 {
+				if _, err := s.bodyW.Write(f.Data()); err != nil {
+					return err
+				}
+			}
+
+			// Hand back the window once the relay took the data
+			if n := f.Header().Length; n > 0 {
+				err := s.write(func() error {
+					if err := s.framer.WriteWindowUpdate(0, n); err != nil {
+						return err
+					}
+					return s.framer.WriteWindowUpdate(webSocketStreamID, n)
+				})
+				if err != nil && !f.StreamEnded() {
+					return err
+				}
+			}
+
+			if f.StreamEnded() {
+				return io.EOF
+			}
+		case *http2.WindowUpdateFrame:
+			s.mu.Lock()
+			if f.StreamID == 0 {
+				s.sendConn += int64(f.Increment)
+			} else if f.StreamID == webSocketStreamID {
+				s.sendStream += int64(f.Increment)
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+
+			s.mu.Lock()
+			_ = f.ForeachSetting(func(setting http2.Setting) error {
+				if setting.ID == http2.SettingMaxFrameSize {
+					s.maxFrame = int(setting.Val)
+				}
+				return nil
+			})
+			s.mu.Unlock()
+
+			if err := s.write(func() error { return s.framer.WriteSettingsAck() }); err != nil {
+				return err
+			}
+		case *http2.PingFrame:
+			if f.IsAck() {
+				continue
+			}
+
+			if err := s.write(func() error { return s.framer.WritePing(true, f.Data) }); err != nil {
+				return err
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == webSocketStreamID {
+				return fmt.Errorf("http2: stream reset by server: %v", f.ErrCode)
+			}
+		case *http2.GoAwayFrame:
+			if f.LastStreamID < webSocketStreamID || f.ErrCode != http2.ErrCodeNo {
+				return fmt.Errorf("http2: server sent GOAWAY: %v", f.ErrCode)
+			}
+		}
+	}
+}
+
+// write runs one or more frame writes under the write lock and flushes them
+func (s *h2Stream) write(frames func() error) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if err := frames(); err != nil {
+		return err
+	}
+
+	return s.bw.Flush()
+}
+
+// failure returns why the connection ended
+func (s *h2Stream) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil || s.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return s.err
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+// Write sends p as DATA frames within the flow control windows of the server
+func (s *h2Stream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.err == nil && !s.closedSend && (s.sendConn <= 0 || s.sendStream <= 0) {
+			s.cond.Wait()
+		}
+
+		if s.err != nil || s.closedSend {
+			s.mu.Unlock()
+			if s.closedSend {
+				return written, io.ErrClosedPipe
+			}
+			return written, s.failure()
+		}
+
+		n := int64(min(len(p), s.maxFrame))
+		n = min(n, s.sendConn, s.sendStream)
+		s.sendConn -= n
+		s.sendStream -= n
+		s.mu.Unlock()
+
+		chunk := p[:n]
+		if err := s.write(func() error { return s.framer.WriteData(webSocketStreamID, false, chunk) }); err != nil {
+			return written, err
+		}
+
+		written += int(n)
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite ends the stream from our side while the server can still send
+func (s *h2Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closedSend {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closedSend = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return s.write(func() error { return s.framer.WriteData(webSocketStreamID, true, nil) })
+}
+
+// Close resets the stream and closes the connection
+func (s *h2Stream) Close() error {
+	// The reset is a courtesy, a server that stopped reading does not hold us
+	_ = s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = s.write(func() error { return s.framer.WriteRSTStream(webSocketStreamID, http2.ErrCodeCancel) })
+	_ = s.body.Close()
+	return s.conn.Close()
+}
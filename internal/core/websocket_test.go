@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"testing"
+	"time"
+
+	"github.com/Kolosok86/http"
+	"github.com/Kolosok86/http/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// webSocketServer echoes WebSocket payloads over an extended CONNECT stream on h2 connections
+// and over an upgraded connection on http/1.1 ones
+type webSocketServer struct {
+	addr string
+	// connectProtocol advertises SETTINGS_ENABLE_CONNECT_PROTOCOL
+	connectProtocol bool
+	// accept answers the HTTP/1.1 upgrade, the right Sec-WebSocket-Accept when nil
+	accept func(key string) string
+
+	// protocols receives the :protocol of every extended CONNECT and "http/1.1" for every upgrade
+	protocols chan string
+}
+
+func startWebSocketServer(t *testing.T, connectProtocol bool, accept func(string) string) *webSocketServer {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &webSocketServer{
+		addr:            listener.Addr().String(),
+		connectProtocol: connectProtocol,
+		accept:          accept,
+		protocols:       make(chan string, 4),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+
+				if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+					server.serveHTTP2(conn)
+				} else {
+					server.serveHTTP1(conn)
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+func (s *webSocketServer) serveHTTP1(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	req, err := stdhttp.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	s.protocols <- "http/1.1"
+
+	accept := webSocketAccept(req.Header.Get("Sec-WebSocket-Key"))
+	if s.accept != nil {
+		accept = s.accept(req.Header.Get("Sec-WebSocket-Key"))
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+	_, _ = io.Copy(conn, reader)
+}
+
+func (s *webSocketServer) serveHTTP2(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(reader, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+
+	// The framer's own header validation refuses :protocol, the block is decoded here
+	framer := http2.NewFramer(conn, reader)
+	decoder := hpack.NewDecoder(65536, nil)
+
+	var settings []http2.Setting
+	if s.connectProtocol {
+		settings = append(settings, http2.Setting{ID: settingEnableConnectProtocol, Val: 1})
+	}
+	if framer.WriteSettings(settings...) != nil {
+		return
+	}
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				_ = framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			fields, err := decoder.DecodeFull(frame.HeaderBlockFragment())
+			if err != nil {
+				return
+			}
+
+			pseudo := map[string]string{}
+			for _, field := range fields {
+				pseudo[field.Name] = field.Value
+			}
+			if pseudo[":method"] != "CONNECT" {
+				return
+			}
+			s.protocols <- pseudo[":protocol"]
+
+			var block bytes.Buffer
+			encoder := hpack.NewEncoder(&block)
+			_ = encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			_ = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: frame.StreamID, BlockFragment: block.Bytes(), EndHeaders: true})
+		case *http2.DataFrame:
+			if len(frame.Data()) > 0 {
+				_ = framer.WriteData(frame.StreamID, false, frame.Data())
+			}
+		}
+	}
+}
+
+// dialWebSocket opens a WebSocket to the server through a round tripper that knows the origin speaks h2
+func dialWebSocket(t *testing.T, server *webSocketServer) (*http.Response, error) {
+	t.Helper()
+
+	rt := NewRoundTripper(Options{JA3: testChromeJA3, UserAgent: testChromeUA, Insecure: true}).(*roundTripper)
+
+	spec, err := rt.clientHelloSpec(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.Protocols.setALPN(server.addr, offeredALPN(spec), http2.NextProtoTLS)
+
+	req, err := http.NewRequest("GET", "https://"+server.addr+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	return rt.RoundTrip(req)
+}
+
+func echoWebSocket(t *testing.T, resp *http.Response) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	if _, err := resp.Body.(io.Writer).Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo = %q (%v), want ping", echo, err)
+	}
+}
+
+func TestWebSocketExtendedConnect(t *testing.T) {
+	server := startWebSocketServer(t, true, nil)
+
+	resp, err := dialWebSocket(t, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if protocol := <-server.protocols; protocol != "websocket" {
+		t.Fatalf("server got %q, want an extended CONNECT for websocket", protocol)
+	}
+
+	echoWebSocket(t, resp)
+}
+
+func TestWebSocketFallsBackToHTTP1(t *testing.T) {
+	server := startWebSocketServer(t, false, nil)
+
+	resp, err := dialWebSocket(t, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if protocol := <-server.protocols; protocol != "http/1.1" {
+		t.Fatalf("server got %q, want an HTTP/1.1 upgrade", protocol)
+	}
+
+	echoWebSocket(t, resp)
+}
+
+func TestWebSocketWrongAccept(t *testing.T) {
+	server := startWebSocketServer(t, false, func(string) string { return webSocketAccept("another key") })
+
+	resp, err := dialWebSocket(t, server)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	if err != errWebSocketAccept {
+		t.Fatalf("error = %v, want %v", err, errWebSocketAccept)
+	}
+
+	select {
+	case <-server.protocols:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server got no upgrade")
+	}
+}